@@ -934,13 +934,7 @@ func run(config *Config) error {
 		return err
 	}
 
-	if config.Debug {
-		jwtPreview := jwt
-		if len(jwt) > 50 {
-			jwtPreview = jwt[:50] + "..."
-		}
-		logger.Debug("JWT received from OIDC provider", zap.String("jwt_preview", jwtPreview))
-	}
+	logger.Debug("JWT received from OIDC provider", logging.Secret("jwt", jwt))
 
 	tailscaleClient := NewTailscaleClient(logger)
 	accessToken, err := tailscaleClient.ExchangeToken(config.TailscaleClientID, jwt)
@@ -0,0 +1,84 @@
+// pkg/logging/level.go
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LevelPath is the HTTP path the level handler is served on by ServeLevel.
+const LevelPath = "/log/level"
+
+// AtomicLevel returns the level shared by this logger and every logger
+// derived from it via WithComponent or WithFields.
+func (l *Logger) AtomicLevel() zap.AtomicLevel {
+	return l.level
+}
+
+// Level returns the current minimum enabled level.
+func (l *Logger) Level() zapcore.Level {
+	return l.level.Level()
+}
+
+// SetLevel changes the minimum enabled level at runtime.
+func (l *Logger) SetLevel(level zapcore.Level) {
+	l.level.SetLevel(level)
+}
+
+// ToggleDebug switches between debug and the level the logger was built
+// with, returning the newly active level.
+func (l *Logger) ToggleDebug() zapcore.Level {
+	next := zapcore.DebugLevel
+	if l.Level() == zapcore.DebugLevel && l.base != zapcore.DebugLevel {
+		next = l.base
+	}
+	l.SetLevel(next)
+	return next
+}
+
+// LevelHandler returns zap's level handler: GET reports the current level and
+// PUT with {"level":"debug"} (or a level=debug form) changes it.
+func (l *Logger) LevelHandler() http.Handler {
+	return l.level
+}
+
+// ServeLevel serves LevelHandler on addr until ctx is cancelled. Only
+// loopback addresses are accepted, as the endpoint is unauthenticated.
+func (l *Logger) ServeLevel(ctx context.Context, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid level address %q: %w", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("level address %q is not a loopback address", addr)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(LevelPath, l.LevelHandler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	l.Info("Serving log level endpoint", zap.String("addr", ln.Addr().String()), zap.String("path", LevelPath))
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -2,6 +2,8 @@
 package logging
 
 import (
+	"context"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -9,7 +11,10 @@ import (
 
 type Logger struct {
 	*zap.Logger
-	level zapcore.Level
+	level     zap.AtomicLevel
+	base      zapcore.Level
+	component string
+	shutdown  func(context.Context) error
 }
 
 type Config struct {
@@ -18,6 +23,18 @@ type Config struct {
 	Encoding         string   `json:"encoding" yaml:"encoding"` // json or console
 	OutputPaths      []string `json:"output_paths" yaml:"output_paths"`
 	ErrorOutputPaths []string `json:"error_output_paths" yaml:"error_output_paths"`
+
+	// File additionally writes JSON logs to a size-rotated file when set.
+	File *FileConfig `json:"file,omitempty" yaml:"file,omitempty"`
+	// System selects an optional system log sink: "syslog" or "journald".
+	System    string `json:"system,omitempty" yaml:"system,omitempty"`
+	SystemTag string `json:"system_tag,omitempty" yaml:"system_tag,omitempty"`
+	// OTLP additionally exports logs to an OpenTelemetry collector when set.
+	OTLP *OTLPConfig `json:"otlp,omitempty" yaml:"otlp,omitempty"`
+
+	// DisableRedaction turns off masking of tokens, keys and signatures.
+	// Only use it when debugging locally.
+	DisableRedaction bool `json:"disable_redaction" yaml:"disable_redaction"`
 }
 
 func DefaultConfig() *Config {
@@ -53,8 +70,9 @@ func NewLogger(config *Config) (*Logger, error) {
 		zapConfig = zap.NewProductionConfig()
 	}
 
-	zapConfig.Level = zap.NewAtomicLevelAt(level)
-	
+	atomicLevel := zap.NewAtomicLevelAt(level)
+	zapConfig.Level = atomicLevel
+
 	// Set encoding - default to console for development, json for production
 	if config.Encoding != "" {
 		zapConfig.Encoding = config.Encoding
@@ -63,7 +81,7 @@ func NewLogger(config *Config) (*Logger, error) {
 	} else {
 		zapConfig.Encoding = "json"
 	}
-	
+
 	zapConfig.OutputPaths = config.OutputPaths
 	zapConfig.ErrorOutputPaths = config.ErrorOutputPaths
 
@@ -79,14 +97,34 @@ func NewLogger(config *Config) (*Logger, error) {
 		zapConfig.EncoderConfig.EncodeLevel = zapcore.LowercaseLevelEncoder
 	}
 
-	logger, err := zapConfig.Build(zap.AddCallerSkip(1))
+	sinks, err := buildSinks(config, zapConfig.EncoderConfig, atomicLevel)
 	if err != nil {
 		return nil, err
 	}
 
+	var shutdown func(context.Context) error
+	if config.OTLP != nil {
+		core, otlpShutdown, err := newOTLPCore(config.OTLP, atomicLevel)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, core)
+		shutdown = otlpShutdown
+	}
+
+	logger, err := build(zapConfig, sinks, !config.DisableRedaction, zap.AddCallerSkip(1))
+	if err != nil {
+		if shutdown != nil {
+			_ = shutdown(context.Background())
+		}
+		return nil, err
+	}
+
 	return &Logger{
-		Logger: logger,
-		level:  level,
+		Logger:   logger,
+		level:    atomicLevel,
+		base:     level,
+		shutdown: shutdown,
 	}, nil
 }
 
@@ -101,39 +139,89 @@ func NewSimpleLogger(debug bool) *Logger {
 	logger, err := NewLogger(config)
 	if err != nil {
 		// Fallback to a basic logger if configuration fails
-		var fallback *zap.Logger
-		if debug {
-			fallback, _ = zap.NewDevelopment()
-		} else {
-			fallback, _ = zap.NewProduction()
-		}
-		return &Logger{Logger: fallback, level: zapcore.InfoLevel}
+		return newFallbackLogger(debug)
 	}
 
 	return logger
 }
 
+// build builds zapConfig's logger with sinks teed alongside its own output.
+// Redaction wraps each sink individually, beneath zapConfig's sampling, so
+// that no sink ever sees an unmasked secret while sampling and each sink's
+// level still apply.
+func build(zapConfig zap.Config, sinks []zapcore.Core, redact bool, opts ...zap.Option) (*zap.Logger, error) {
+	sampling := zapConfig.Sampling
+	zapConfig.Sampling = nil
+	wrap := func(core zapcore.Core) zapcore.Core {
+		if redact {
+			return NewRedactingCore(core)
+		}
+		return core
+	}
+	opts = append(opts, zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		core = wrap(core)
+		if sampling != nil {
+			var samplerOpts []zapcore.SamplerOption
+			if sampling.Hook != nil {
+				samplerOpts = append(samplerOpts, zapcore.SamplerHook(sampling.Hook))
+			}
+			core = zapcore.NewSamplerWithOptions(core, time.Second, sampling.Initial, sampling.Thereafter, samplerOpts...)
+		}
+		if len(sinks) == 0 {
+			return core
+		}
+		cores := []zapcore.Core{core}
+		for _, sink := range sinks {
+			cores = append(cores, wrap(sink))
+		}
+		return zapcore.NewTee(cores...)
+	}))
+	return zapConfig.Build(opts...)
+}
+
+// newFallbackLogger builds a basic logger that still shares its level, so
+// that SetLevel and ToggleDebug take effect.
+func newFallbackLogger(debug bool) *Logger {
+	base := zapcore.InfoLevel
+	zapConfig := zap.NewProductionConfig()
+	if debug {
+		base = zapcore.DebugLevel
+		zapConfig = zap.NewDevelopmentConfig()
+	}
+	atomicLevel := zap.NewAtomicLevelAt(base)
+	zapConfig.Level = atomicLevel
+	logger, err := build(zapConfig, nil, true)
+	if err != nil {
+		logger = zap.NewNop()
+	}
+	return &Logger{Logger: logger, level: atomicLevel, base: base}
+}
+
 // Convenience methods
 func (l *Logger) WithComponent(component string) *Logger {
-	return &Logger{
-		Logger: l.Logger.With(zap.String("component", component)),
-		level:  l.level,
-	}
+	derived := l.derive(l.Logger.With(zap.String("component", component)))
+	derived.component = component
+	return derived
 }
 
 func (l *Logger) WithFields(fields ...zap.Field) *Logger {
-	return &Logger{
-		Logger: l.Logger.With(fields...),
-		level:  l.level,
-	}
+	return l.derive(l.Logger.With(fields...))
+}
+
+// derive returns a copy of l that logs through logger but shares its level
+// and exporters.
+func (l *Logger) derive(logger *zap.Logger) *Logger {
+	derived := *l
+	derived.Logger = logger
+	return &derived
 }
 
 func (l *Logger) IsDebugEnabled() bool {
-	return l.level <= zapcore.DebugLevel
+	return l.level.Enabled(zapcore.DebugLevel)
 }
 
 func (l *Logger) IsInfoEnabled() bool {
-	return l.level <= zapcore.InfoLevel
+	return l.level.Enabled(zapcore.InfoLevel)
 }
 
 // Safe sync that doesn't panic
@@ -143,6 +231,16 @@ func (l *Logger) SafeSync() {
 	}
 }
 
+// Shutdown flushes buffered entries and stops any exporters. The logger
+// should not be used afterwards.
+func (l *Logger) Shutdown(ctx context.Context) error {
+	l.SafeSync()
+	if l.shutdown != nil {
+		return l.shutdown(ctx)
+	}
+	return nil
+}
+
 // Global logger instance
 var globalLogger *Logger
 
@@ -184,4 +282,4 @@ func Fatal(msg string, fields ...zap.Field) {
 
 func Sync() {
 	globalLogger.SafeSync()
-}
\ No newline at end of file
+}
@@ -0,0 +1,143 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func newTestLogger(t *testing.T, config *Config) *Logger {
+	t.Helper()
+	logger, err := NewLogger(config)
+	if err != nil {
+		t.Fatalf("NewLogger failed: %v", err)
+	}
+	t.Cleanup(logger.SafeSync)
+	return logger
+}
+
+// TestSetLevel tests that level changes are visible to derived loggers.
+func TestSetLevel(t *testing.T) {
+	config := DefaultConfig()
+	config.OutputPaths = []string{filepath.Join(t.TempDir(), "out.log")}
+	logger := newTestLogger(t, config)
+	component := logger.WithComponent("test")
+
+	if component.IsDebugEnabled() {
+		t.Fatal("Expected debug to be disabled at info level")
+	}
+
+	logger.SetLevel(zapcore.DebugLevel)
+	if !component.IsDebugEnabled() {
+		t.Error("Expected debug to be enabled on derived logger after SetLevel")
+	}
+	if !component.Core().Enabled(zapcore.DebugLevel) {
+		t.Error("Expected core to accept debug entries after SetLevel")
+	}
+
+	if got := logger.ToggleDebug(); got != zapcore.InfoLevel {
+		t.Errorf("ToggleDebug() = %v, want %v", got, zapcore.InfoLevel)
+	}
+	if got := logger.ToggleDebug(); got != zapcore.DebugLevel {
+		t.Errorf("ToggleDebug() = %v, want %v", got, zapcore.DebugLevel)
+	}
+}
+
+// TestFallbackLoggerLevel tests that the fallback logger obeys its level.
+func TestFallbackLoggerLevel(t *testing.T) {
+	logger := newFallbackLogger(false)
+	if logger.Core().Enabled(zapcore.DebugLevel) {
+		t.Fatal("Expected core to reject debug entries at info level")
+	}
+	logger.ToggleDebug()
+	if !logger.IsDebugEnabled() || !logger.Core().Enabled(zapcore.DebugLevel) {
+		t.Error("Expected core to accept debug entries after ToggleDebug")
+	}
+}
+
+// TestLevelHandler tests changing the level over HTTP.
+func TestLevelHandler(t *testing.T) {
+	config := DefaultConfig()
+	config.OutputPaths = []string{filepath.Join(t.TempDir(), "out.log")}
+	logger := newTestLogger(t, config)
+
+	req := httptest.NewRequest(http.MethodPut, LevelPath, strings.NewReader(`{"level":"debug"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	logger.LevelHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !logger.IsDebugEnabled() {
+		t.Error("Expected debug to be enabled after PUT")
+	}
+}
+
+// TestServeLevel_NonLoopback tests that the level endpoint refuses to bind publicly.
+func TestServeLevel_NonLoopback(t *testing.T) {
+	logger := NewSimpleLogger(false)
+
+	for _, addr := range []string{"0.0.0.0:0", ":0", "192.0.2.1:8080"} {
+		err := logger.ServeLevel(context.Background(), addr)
+		if err == nil || !strings.Contains(err.Error(), "not a loopback") {
+			t.Errorf("ServeLevel(%q) error = %v, want loopback error", addr, err)
+		}
+	}
+}
+
+// TestFileSink tests that the file sink rotates once it exceeds its size.
+func TestFileSink(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.OutputPaths = []string{filepath.Join(dir, "stdout.log")}
+	config.File = &FileConfig{
+		Path:       filepath.Join(dir, "app.log"),
+		MaxSizeMB:  1,
+		MaxBackups: 2,
+	}
+	logger := newTestLogger(t, config)
+
+	line := strings.Repeat("x", 1024)
+	for i := 0; i < 1500; i++ {
+		logger.Info(line)
+	}
+	logger.SafeSync()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var rotated int
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "app-") {
+			rotated++
+		}
+	}
+	if rotated == 0 {
+		t.Errorf("Expected at least one rotated file, got entries %v", entries)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "app.log"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !strings.Contains(string(data), `"level":"info"`) {
+		t.Errorf("Expected JSON entries in file sink, got %q", string(data[:min(len(data), 200)]))
+	}
+}
+
+// TestUnknownSystemSink tests that an unknown system sink is rejected.
+func TestUnknownSystemSink(t *testing.T) {
+	config := DefaultConfig()
+	config.System = "eventlog"
+	if _, err := NewLogger(config); err == nil {
+		t.Fatal("Expected error for unknown system sink, got nil")
+	}
+}
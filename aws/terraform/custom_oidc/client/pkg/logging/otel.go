@@ -0,0 +1,114 @@
+// pkg/logging/otel.go
+package logging
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/contrib/bridges/otelzap"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const instrumentationName = "github.com/jaxxstorm/tailscale-examples/aws/terraform/oidc/client/pkg/logging"
+
+// OTLPConfig configures exporting logs over OTLP/HTTP.
+type OTLPConfig struct {
+	// Endpoint is the collector's host:port, e.g. localhost:4318.
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	// URLPath overrides the default /v1/logs path.
+	URLPath     string            `json:"url_path,omitempty" yaml:"url_path,omitempty"`
+	Insecure    bool              `json:"insecure" yaml:"insecure"`
+	Headers     map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	ServiceName string            `json:"service_name" yaml:"service_name"`
+}
+
+// newOTLPCore returns a core that exports entries to an OTLP collector,
+// gated by level, and a function that flushes and stops the exporter.
+func newOTLPCore(config *OTLPConfig, level zapcore.LevelEnabler) (zapcore.Core, func(context.Context) error, error) {
+	if config.Endpoint == "" {
+		return nil, nil, fmt.Errorf("OTLP endpoint is required")
+	}
+
+	opts := []otlploghttp.Option{otlploghttp.WithEndpoint(config.Endpoint)}
+	if config.URLPath != "" {
+		opts = append(opts, otlploghttp.WithURLPath(config.URLPath))
+	}
+	if config.Insecure {
+		opts = append(opts, otlploghttp.WithInsecure())
+	}
+	if len(config.Headers) > 0 {
+		opts = append(opts, otlploghttp.WithHeaders(config.Headers))
+	}
+
+	exporter, err := otlploghttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create OTLP log exporter: %w", err)
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "tailscale-oidc"
+	}
+
+	provider := sdklog.NewLoggerProvider(
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)),
+		sdklog.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+
+	core, err := zapcore.NewIncreaseLevelCore(otelzap.NewCore(instrumentationName, otelzap.WithLoggerProvider(provider)), level)
+	if err != nil {
+		_ = provider.Shutdown(context.Background())
+		return nil, nil, fmt.Errorf("failed to create OTLP core: %w", err)
+	}
+
+	return core, provider.Shutdown, nil
+}
+
+// WithContext returns a logger that adds the trace and span IDs of the span
+// in ctx to every entry, so logs can be correlated with traces. Entries
+// exported over OTLP carry the span context natively. If ctx holds no valid
+// span, l is returned unchanged.
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return l
+	}
+	return l.derive(l.Logger.With(zap.Inline(spanContext{ctx})))
+}
+
+// spanContext is encoded inline as trace fields by ordinary encoders. The
+// OTLP core recognises it as a context.Context and emits records with it.
+type spanContext struct {
+	context.Context
+}
+
+func (s spanContext) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	sc := trace.SpanContextFromContext(s.Context)
+	enc.AddString("trace_id", sc.TraceID().String())
+	enc.AddString("span_id", sc.SpanID().String())
+	if sc.IsSampled() {
+		enc.AddBool("trace_sampled", true)
+	}
+	return nil
+}
+
+// SpanAttributes returns the component set by WithComponent as span
+// attributes, or nil if the logger has no component.
+func (l *Logger) SpanAttributes() []attribute.KeyValue {
+	if l.component == "" {
+		return nil
+	}
+	return []attribute.KeyValue{attribute.String("component", l.component)}
+}
+
+// AnnotateSpan adds SpanAttributes to the span in ctx.
+func (l *Logger) AnnotateSpan(ctx context.Context) {
+	if attrs := l.SpanAttributes(); attrs != nil {
+		trace.SpanFromContext(ctx).SetAttributes(attrs...)
+	}
+}
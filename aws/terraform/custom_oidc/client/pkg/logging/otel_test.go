@@ -0,0 +1,182 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collectorStub is an in-process OTLP/HTTP logs receiver.
+type collectorStub struct {
+	*httptest.Server
+	mu      sync.Mutex
+	records []*logspb.LogRecord
+}
+
+func newCollectorStub(t *testing.T) *collectorStub {
+	t.Helper()
+	c := &collectorStub{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/logs" {
+			t.Errorf("Expected path /v1/logs, got %s", r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Failed to read body: %v", err)
+			return
+		}
+		var req collogspb.ExportLogsServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Errorf("Failed to decode export request: %v", err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		for _, rl := range req.ResourceLogs {
+			for _, sl := range rl.ScopeLogs {
+				c.records = append(c.records, sl.LogRecords...)
+			}
+		}
+		c.mu.Unlock()
+
+		resp, _ := proto.Marshal(&collogspb.ExportLogsServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(resp)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *collectorStub) find(body string) *logspb.LogRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.records {
+		if r.Body.GetStringValue() == body {
+			return r
+		}
+	}
+	return nil
+}
+
+func testSpanContext(t *testing.T) (context.Context, trace.SpanContext) {
+	t.Helper()
+	traceID, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	spanID, _ := trace.SpanIDFromHex("b7ad6b7169203331")
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})
+	return trace.ContextWithSpanContext(context.Background(), sc), sc
+}
+
+// TestOTLPExport tests exporting correlated, redacted logs to a collector.
+func TestOTLPExport(t *testing.T) {
+	collector := newCollectorStub(t)
+	u, _ := url.Parse(collector.URL)
+
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.OutputPaths = []string{filepath.Join(dir, "stdout.log")}
+	config.OTLP = &OTLPConfig{Endpoint: u.Host, Insecure: true, ServiceName: "test"}
+	logger, err := NewLogger(config)
+	if err != nil {
+		t.Fatalf("NewLogger failed: %v", err)
+	}
+
+	ctx, sc := testSpanContext(t)
+	logger.WithComponent("oidc").WithContext(ctx).Info("Exchanging token", Secret("jwt", testJWT))
+	logger.Debug("Not exported at info level")
+
+	if err := logger.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	record := collector.find("Exchanging token")
+	if record == nil {
+		t.Fatalf("Expected record to be exported, got %v", collector.records)
+	}
+	traceID, spanID := sc.TraceID(), sc.SpanID()
+	if !bytes.Equal(record.TraceId, traceID[:]) {
+		t.Errorf("Expected trace ID %s, got %x", sc.TraceID(), record.TraceId)
+	}
+	if !bytes.Equal(record.SpanId, spanID[:]) {
+		t.Errorf("Expected span ID %s, got %x", sc.SpanID(), record.SpanId)
+	}
+
+	attrs := map[string]string{}
+	for _, kv := range record.Attributes {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	if attrs["component"] != "oidc" {
+		t.Errorf("Expected component attribute oidc, got %v", attrs)
+	}
+	if strings.Contains(attrs["jwt"], testJWT) {
+		t.Errorf("Expected secret field to be masked, got %q", attrs["jwt"])
+	}
+
+	if collector.find("Not exported at info level") != nil {
+		t.Error("Expected debug entry to be filtered by level")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "stdout.log"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !strings.Contains(string(data), `"trace_id":"`+sc.TraceID().String()+`"`) {
+		t.Errorf("Expected trace_id in stdout output, got %q", string(data))
+	}
+}
+
+// TestWithContext_NoSpan tests that a context without a span adds nothing.
+func TestWithContext_NoSpan(t *testing.T) {
+	logger := NewSimpleLogger(false)
+	if got := logger.WithContext(context.Background()); got != logger {
+		t.Error("Expected WithContext to return the same logger without a span")
+	}
+}
+
+// TestAnnotateSpan tests that component names become span attributes.
+func TestAnnotateSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, span := provider.Tracer("test").Start(context.Background(), "exchange")
+
+	logger := NewSimpleLogger(false)
+	if attrs := logger.SpanAttributes(); attrs != nil {
+		t.Errorf("Expected no attributes without a component, got %v", attrs)
+	}
+	logger.WithComponent("tailscale").AnnotateSpan(ctx)
+	span.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	var found bool
+	for _, attr := range spans[0].Attributes() {
+		if attr.Key == "component" && attr.Value.AsString() == "tailscale" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected component attribute, got %v", spans[0].Attributes())
+	}
+}
@@ -0,0 +1,177 @@
+// pkg/logging/redact.go
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const redacted = "[REDACTED]"
+
+type redactRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// redactRules are applied in order. Each replacement keeps enough of the
+// match to tell what kind of secret was there.
+var redactRules = []redactRule{
+	// Secret-bearing JSON members, e.g. the signed instance identity in the
+	// OIDC request or the access_token in a token exchange response.
+	{
+		pattern:     regexp.MustCompile(`(?i)("(?:signature|access_token|refresh_token|id_token|jwt|key|secret|client_secret|password|authkey)"\s*:\s*")[^"]*(")`),
+		replacement: "${1}" + redacted + "${2}",
+	},
+	// Tailscale auth, API and OAuth client keys: tskey-auth-..., tskey-api-...
+	{
+		pattern:     regexp.MustCompile(`\b(tskey-(?:[a-z]+-)?)[A-Za-z0-9][A-Za-z0-9-]*`),
+		replacement: "${1}" + redacted,
+	},
+	// Authorization headers.
+	{
+		pattern:     regexp.MustCompile(`(?i)\b(Bearer|Basic)\s+[A-Za-z0-9\-._~+/]+=*`),
+		replacement: "${1} " + redacted,
+	},
+	// JWTs. The header always starts with base64url("{").
+	{
+		pattern:     regexp.MustCompile(`\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+		replacement: "eyJ" + redacted,
+	},
+	// AWS SigV4 signatures and session tokens, in headers or query strings.
+	{
+		pattern:     regexp.MustCompile(`((?:X-Amz-)?Signature=)[0-9a-fA-F]{64}`),
+		replacement: "${1}" + redacted,
+	},
+	{
+		pattern:     regexp.MustCompile(`((?:X-Amz-Security-Token|X-Amz-Credential)=)[^&\s,"]+`),
+		replacement: "${1}" + redacted,
+	},
+	// AWS access key IDs.
+	{
+		pattern:     regexp.MustCompile(`\b((?:AKIA|ASIA))[0-9A-Z]{16}\b`),
+		replacement: "${1}" + redacted,
+	},
+}
+
+// Redact masks any secrets recognised in s.
+func Redact(s string) string {
+	for _, rule := range redactRules {
+		s = rule.pattern.ReplaceAllString(s, rule.replacement)
+	}
+	return s
+}
+
+// Secret returns a field that logs a short prefix of value and a hash of it,
+// so the same secret can be recognised across log lines without revealing it.
+func Secret(key, value string) zap.Field {
+	return zap.Stringer(key, secretValue(value))
+}
+
+type secretValue string
+
+func (s secretValue) String() string {
+	v := string(s)
+	if v == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(v))
+	// Show at most a quarter of the secret, and never more than 6 characters.
+	n := min(len(v)/4, 6)
+	return v[:n] + "…sha256:" + hex.EncodeToString(sum[:4])
+}
+
+// redactingCore masks secrets in messages and fields before handing entries
+// to the wrapped core. It wraps a single sink: wrapping a sampler or a tee
+// would write to every core beneath it, bypassing their own checks.
+type redactingCore struct {
+	zapcore.Core
+}
+
+// NewRedactingCore wraps the sink core so that no recognised secret reaches
+// it.
+func NewRedactingCore(core zapcore.Core) zapcore.Core {
+	return &redactingCore{Core: core}
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(redactFields(fields))}
+}
+
+func (c *redactingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	// Let the wrapped core decide, but write through c so that the entry
+	// is redacted first.
+	if c.Core.Check(ent, nil) != nil {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *redactingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = Redact(ent.Message)
+	ent.Stack = Redact(ent.Stack)
+	return c.Core.Write(ent, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		out[i] = redactField(f)
+	}
+	return out
+}
+
+// redactField returns f unchanged unless it carries a secret, in which case
+// it is replaced with a string field holding the masked value.
+func redactField(f zapcore.Field) zapcore.Field {
+	var s string
+	switch f.Type {
+	case zapcore.StringType:
+		f.String = Redact(f.String)
+		return f
+	case zapcore.ByteStringType:
+		b, _ := f.Interface.([]byte)
+		s = string(b)
+	case zapcore.StringerType:
+		if _, ok := f.Interface.(secretValue); ok {
+			return f
+		}
+		str, ok := f.Interface.(fmt.Stringer)
+		if !ok {
+			return f
+		}
+		s = str.String()
+	case zapcore.ErrorType:
+		err, ok := f.Interface.(error)
+		if !ok || err == nil {
+			return f
+		}
+		s = err.Error()
+	case zapcore.ArrayMarshalerType, zapcore.ObjectMarshalerType:
+		enc := zapcore.NewMapObjectEncoder()
+		f.AddTo(enc)
+		b, err := json.Marshal(enc.Fields[f.Key])
+		if err != nil {
+			return zap.String(f.Key, redacted)
+		}
+		s = string(b)
+	case zapcore.ReflectType:
+		b, err := json.Marshal(f.Interface)
+		if err != nil {
+			return zap.String(f.Key, redacted)
+		}
+		s = string(b)
+	default:
+		return f
+	}
+
+	if masked := Redact(s); masked != s {
+		return zap.String(f.Key, masked)
+	}
+	return f
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+// pkg/logging/signal_other.go
+package logging
+
+import "context"
+
+// HandleLevelSignal is a no-op on Windows and Plan 9, which have no
+// SIGUSR1. Use ServeLevel to change the level at runtime instead.
+func (l *Logger) HandleLevelSignal(ctx context.Context) {}
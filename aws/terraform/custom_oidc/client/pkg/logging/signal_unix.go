@@ -0,0 +1,33 @@
+//go:build !windows && !plan9
+
+// pkg/logging/signal_unix.go
+package logging
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// HandleLevelSignal toggles debug logging each time the process receives
+// SIGUSR1, until ctx is cancelled.
+func (l *Logger) HandleLevelSignal(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigs:
+				level := l.ToggleDebug()
+				l.Info("Log level changed by SIGUSR1", zap.Stringer("level", level))
+			}
+		}
+	}()
+}
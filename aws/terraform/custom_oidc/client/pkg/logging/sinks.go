@@ -0,0 +1,121 @@
+// pkg/logging/sinks.go
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	SystemSyslog   = "syslog"
+	SystemJournald = "journald"
+)
+
+var errJournaldUnavailable = errors.New("journald is not available")
+
+// FileConfig configures a JSON log file that is rotated once it reaches
+// MaxSizeMB megabytes.
+type FileConfig struct {
+	Path       string `json:"path" yaml:"path"`
+	MaxSizeMB  int    `json:"max_size_mb" yaml:"max_size_mb"`
+	MaxBackups int    `json:"max_backups" yaml:"max_backups"`
+	MaxAgeDays int    `json:"max_age_days" yaml:"max_age_days"`
+	Compress   bool   `json:"compress" yaml:"compress"`
+}
+
+// buildSinks returns the cores for the optional file and system sinks. They
+// share the logger's level so runtime changes apply to every sink.
+func buildSinks(config *Config, encoderConfig zapcore.EncoderConfig, level zapcore.LevelEnabler) ([]zapcore.Core, error) {
+	var cores []zapcore.Core
+
+	if config.File != nil && config.File.Path != "" {
+		fileEncoderConfig := encoderConfig
+		fileEncoderConfig.EncodeLevel = zapcore.LowercaseLevelEncoder
+
+		writer := &lumberjack.Logger{
+			Filename:   config.File.Path,
+			MaxSize:    config.File.MaxSizeMB,
+			MaxBackups: config.File.MaxBackups,
+			MaxAge:     config.File.MaxAgeDays,
+			Compress:   config.File.Compress,
+		}
+		cores = append(cores, zapcore.NewCore(zapcore.NewJSONEncoder(fileEncoderConfig), zapcore.AddSync(writer), level))
+	}
+
+	if config.System != "" {
+		// The system logger records its own timestamp and priority.
+		systemEncoderConfig := encoderConfig
+		systemEncoderConfig.TimeKey = zapcore.OmitKey
+		systemEncoderConfig.LevelKey = zapcore.OmitKey
+
+		tag := config.SystemTag
+		if tag == "" {
+			tag = "tailscale-oidc"
+		}
+
+		var write func(zapcore.Level, string) error
+		var err error
+		switch config.System {
+		case SystemSyslog:
+			write, err = newSyslogWriter(tag)
+		case SystemJournald:
+			write, err = newJournaldWriter(tag)
+		default:
+			return nil, fmt.Errorf("unknown system log sink %q", config.System)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s sink: %w", config.System, err)
+		}
+		cores = append(cores, &priorityCore{
+			LevelEnabler: level,
+			enc:          zapcore.NewConsoleEncoder(systemEncoderConfig),
+			write:        write,
+		})
+	}
+
+	return cores, nil
+}
+
+// priorityCore is a zapcore.Core for sinks that take one message per entry
+// along with its level, such as syslog and journald.
+type priorityCore struct {
+	zapcore.LevelEnabler
+	enc   zapcore.Encoder
+	write func(zapcore.Level, string) error
+}
+
+func (c *priorityCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := &priorityCore{
+		LevelEnabler: c.LevelEnabler,
+		enc:          c.enc.Clone(),
+		write:        c.write,
+	}
+	for _, f := range fields {
+		f.AddTo(clone.enc)
+	}
+	return clone
+}
+
+func (c *priorityCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *priorityCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+	return c.write(ent.Level, strings.TrimSuffix(buf.String(), "\n"))
+}
+
+func (c *priorityCore) Sync() error {
+	return nil
+}
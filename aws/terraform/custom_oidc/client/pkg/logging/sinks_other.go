@@ -0,0 +1,18 @@
+//go:build windows || plan9
+
+// pkg/logging/sinks_other.go
+package logging
+
+import (
+	"errors"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func newSyslogWriter(tag string) (func(zapcore.Level, string) error, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func newJournaldWriter(tag string) (func(zapcore.Level, string) error, error) {
+	return nil, errJournaldUnavailable
+}
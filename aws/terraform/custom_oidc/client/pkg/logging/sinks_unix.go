@@ -0,0 +1,57 @@
+//go:build !windows && !plan9
+
+// pkg/logging/sinks_unix.go
+package logging
+
+import (
+	"log/syslog"
+
+	"github.com/coreos/go-systemd/v22/journal"
+	"go.uber.org/zap/zapcore"
+)
+
+func newSyslogWriter(tag string) (func(zapcore.Level, string) error, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return func(level zapcore.Level, msg string) error {
+		switch level {
+		case zapcore.DebugLevel:
+			return w.Debug(msg)
+		case zapcore.InfoLevel:
+			return w.Info(msg)
+		case zapcore.WarnLevel:
+			return w.Warning(msg)
+		case zapcore.ErrorLevel:
+			return w.Err(msg)
+		default:
+			return w.Crit(msg)
+		}
+	}, nil
+}
+
+func newJournaldWriter(tag string) (func(zapcore.Level, string) error, error) {
+	if !journal.Enabled() {
+		return nil, errJournaldUnavailable
+	}
+	vars := map[string]string{"SYSLOG_IDENTIFIER": tag}
+	return func(level zapcore.Level, msg string) error {
+		return journal.Send(msg, journalPriority(level), vars)
+	}, nil
+}
+
+func journalPriority(level zapcore.Level) journal.Priority {
+	switch level {
+	case zapcore.DebugLevel:
+		return journal.PriDebug
+	case zapcore.InfoLevel:
+		return journal.PriInfo
+	case zapcore.WarnLevel:
+		return journal.PriWarning
+	case zapcore.ErrorLevel:
+		return journal.PriErr
+	default:
+		return journal.PriCrit
+	}
+}
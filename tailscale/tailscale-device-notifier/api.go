@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/oauth2/clientcredentials"
+	"tailscale.com/tailcfg"
+)
+
+// apiDevice is the subset of a Tailscale v2 API device that the notifier
+// uses. See https://tailscale.com/api#tag/devices.
+type apiDevice struct {
+	NodeID            tailcfg.StableNodeID `json:"nodeId"`
+	Name              string               `json:"name"`
+	Hostname          string               `json:"hostname"`
+	OS                string               `json:"os"`
+	User              string               `json:"user"`
+	Addresses         []string             `json:"addresses"`
+	Tags              []string             `json:"tags"`
+	Authorized        bool                 `json:"authorized"`
+	KeyExpiryDisabled bool                 `json:"keyExpiryDisabled"`
+	Expires           time.Time            `json:"expires"`
+	UpdateAvailable   bool                 `json:"updateAvailable"`
+	ClientVersion     string               `json:"clientVersion"`
+	LastSeen          time.Time            `json:"lastSeen"`
+	IsExternal        bool                 `json:"isExternal"`
+}
+
+func (d apiDevice) state() DeviceState {
+	s := DeviceState{
+		ID:            d.NodeID,
+		DNSName:       d.Name,
+		HostName:      d.Hostname,
+		OS:            d.OS,
+		User:          d.User,
+		Tags:          d.Tags,
+		LastSeen:      d.LastSeen,
+		Shared:        d.IsExternal,
+		Authorized:    &d.Authorized,
+		ClientVersion: d.ClientVersion,
+	}
+	if !d.KeyExpiryDisabled {
+		s.KeyExpiry = d.Expires
+	}
+	for _, a := range d.Addresses {
+		if ip, err := netip.ParseAddr(a); err == nil {
+			s.IPs = append(s.IPs, ip)
+		}
+	}
+	return s
+}
+
+// keyExpiring reports whether d's key expires within warn of now.
+func (d apiDevice) keyExpiring(now time.Time, warn time.Duration) bool {
+	return !d.KeyExpiryDisabled && !d.Expires.IsZero() && d.Expires.Sub(now) <= warn
+}
+
+// diffAPIDevices returns the events between two polls of the devices API,
+// taken at prevTime and now. Devices joining or leaving, and changes the
+// netmap carries such as tags, are left to the LocalAPI source; this only
+// reports attributes it cannot see.
+func diffAPIDevices(prev, cur map[tailcfg.StableNodeID]apiDevice, prevTime, now time.Time, warn time.Duration) []Event {
+	var events []Event
+	for _, id := range slices.Sorted(maps.Keys(cur)) {
+		d := cur[id]
+		last, existed := prev[id]
+		event := func(typ EventType) Event {
+			e := Event{Type: typ, Time: now, Device: d.state()}
+			if existed {
+				p := last.state()
+				e.Previous = &p
+			}
+			return e
+		}
+
+		if !d.Authorized && (!existed || last.Authorized) {
+			events = append(events, event(EventNeedsAuth))
+		}
+		if d.keyExpiring(now, warn) && (!existed || !last.keyExpiring(prevTime, warn) || !last.Expires.Equal(d.Expires)) {
+			events = append(events, event(EventKeyExpiring))
+		}
+		if d.UpdateAvailable && (!existed || !last.UpdateAvailable) {
+			events = append(events, event(EventUpdateAvailable))
+		}
+	}
+	return events
+}
+
+// APISource polls the Tailscale v2 devices API. Unlike the LocalAPI, it
+// sees every device in the tailnet regardless of ACLs, along with key expiry,
+// authorization and update state.
+type APISource struct {
+	client   *http.Client
+	url      string
+	interval time.Duration
+	warn     time.Duration
+	logger   *log.Logger
+
+	last     map[tailcfg.StableNodeID]apiDevice
+	lastPoll time.Time
+}
+
+// NewAPISource returns a source that authenticates with an OAuth client
+// holding the devices:core:read scope. keyExpiryWarning is how far ahead of
+// a key's expiry to warn about it.
+func NewAPISource(ctx context.Context, baseURL, tailnet, clientID, clientSecret string, interval, keyExpiryWarning time.Duration, logger *log.Logger) *APISource {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	oauth := clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     baseURL + "/api/v2/oauth/token",
+	}
+	return &APISource{
+		client:   oauth.Client(ctx),
+		url:      fmt.Sprintf("%s/api/v2/tailnet/%s/devices?fields=all", baseURL, url.PathEscape(tailnet)),
+		interval: interval,
+		warn:     keyExpiryWarning,
+		logger:   logger,
+	}
+}
+
+func (a *APISource) fetch(ctx context.Context) (map[tailcfg.StableNodeID]apiDevice, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("devices API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var out struct {
+		Devices []apiDevice `json:"devices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode devices: %w", err)
+	}
+	devices := make(map[tailcfg.StableNodeID]apiDevice, len(out.Devices))
+	for _, d := range out.Devices {
+		devices[d.NodeID] = d
+	}
+	return devices, nil
+}
+
+// poll fetches devices once and returns the events since the last poll. The
+// first poll is the baseline and yields none.
+func (a *APISource) poll(ctx context.Context, now time.Time) ([]Event, error) {
+	devices, err := a.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		a.last = devices
+		a.lastPoll = now
+	}()
+
+	if a.last == nil {
+		a.printInitialStatus(devices, now)
+		return nil, nil
+	}
+	return diffAPIDevices(a.last, devices, a.lastPoll, now, a.warn), nil
+}
+
+func (a *APISource) printInitialStatus(devices map[tailcfg.StableNodeID]apiDevice, now time.Time) {
+	a.logger.Info("Tailscale API devices",
+		"count", len(devices))
+	for _, id := range slices.Sorted(maps.Keys(devices)) {
+		d := devices[id]
+		if !d.Authorized {
+			a.logger.Warn("Device needs authorization",
+				"dns_name", d.Name)
+		}
+		if d.keyExpiring(now, a.warn) {
+			a.logger.Warn("Device key expiring",
+				"dns_name", d.Name,
+				"expires", d.Expires.Format(time.DateTime))
+		}
+	}
+}
+
+// Run polls until ctx is done, passing events to emit.
+func (a *APISource) Run(ctx context.Context, emit func([]Event, string)) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		events, err := a.poll(ctx, time.Now())
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			a.logger.Error("Error fetching devices from the Tailscale API",
+				"error", err)
+		} else if len(events) > 0 {
+			emit(events, "api")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
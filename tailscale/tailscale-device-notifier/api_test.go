@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"tailscale.com/tailcfg"
+)
+
+// fakeDevicesAPI serves the OAuth token endpoint and a mutable device list.
+type fakeDevicesAPI struct {
+	*httptest.Server
+	mu      sync.Mutex
+	devices []apiDevice
+}
+
+func newFakeDevicesAPI(t *testing.T) *fakeDevicesAPI {
+	t.Helper()
+	f := &fakeDevicesAPI{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/oauth/token":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"access_token": "access", "token_type": "Bearer", "expires_in": 3600}`)
+		case "/api/v2/tailnet/example.com/devices":
+			if r.Header.Get("Authorization") != "Bearer access" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get("fields") != "all" {
+				t.Errorf("Expected fields=all, got %q", r.URL.RawQuery)
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]any{"devices": f.devices})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeDevicesAPI) set(devices ...apiDevice) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.devices = devices
+}
+
+func testAPIDevice(id tailcfg.StableNodeID, name string) apiDevice {
+	return apiDevice{
+		NodeID:        id,
+		Name:          name + ".example.ts.net",
+		Hostname:      name,
+		OS:            "linux",
+		User:          "alice@example.com",
+		Addresses:     []string{"100.64.0.1", "fd7a:115c:a1e0::1"},
+		Authorized:    true,
+		Expires:       testNow.Add(90 * 24 * time.Hour),
+		ClientVersion: "1.86.5",
+	}
+}
+
+func eventTypes(events []Event) string {
+	var types []string
+	for _, e := range events {
+		types = append(types, string(e.Type))
+	}
+	return strings.Join(types, ",")
+}
+
+// TestDiffAPIDevices tests the events raised between two API polls.
+func TestDiffAPIDevices(t *testing.T) {
+	const warn = 7 * 24 * time.Hour
+	later := testNow.Add(time.Hour)
+
+	base := testAPIDevice("n1", "laptop")
+	with := func(f func(*apiDevice)) apiDevice {
+		d := base
+		f(&d)
+		return d
+	}
+	unauthorized := with(func(d *apiDevice) { d.Authorized = false })
+
+	cases := []struct {
+		name      string
+		prev, cur apiDevice
+		want      string
+	}{
+		{"unchanged", base, base, ""},
+		{"needs authorization", base, unauthorized, "needs_authorization"},
+		{"still unauthorized", unauthorized, unauthorized, ""},
+		{"key outside warning window", with(func(d *apiDevice) { d.Expires = later.Add(warn + 30*time.Minute) }), with(func(d *apiDevice) { d.Expires = later.Add(warn + 30*time.Minute) }), ""},
+		{"key enters warning window", with(func(d *apiDevice) { d.Expires = testNow.Add(warn + 30*time.Minute) }), with(func(d *apiDevice) { d.Expires = testNow.Add(warn + 30*time.Minute) }), "key_expiring"},
+		{"key still in warning window", with(func(d *apiDevice) { d.Expires = testNow.Add(time.Hour * 24) }), with(func(d *apiDevice) { d.Expires = testNow.Add(time.Hour * 24) }), ""},
+		{"key expiry disabled", base, with(func(d *apiDevice) { d.Expires = testNow; d.KeyExpiryDisabled = true }), ""},
+		{"update available", base, with(func(d *apiDevice) { d.UpdateAvailable = true }), "update_available"},
+		{"tags changed", base, with(func(d *apiDevice) { d.Tags = []string{"tag:server"} }), ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			prev := map[tailcfg.StableNodeID]apiDevice{c.prev.NodeID: c.prev}
+			cur := map[tailcfg.StableNodeID]apiDevice{c.cur.NodeID: c.cur}
+			if got := eventTypes(diffAPIDevices(prev, cur, testNow, later, warn)); got != c.want {
+				t.Errorf("Expected %q, got %q", c.want, got)
+			}
+		})
+	}
+}
+
+// TestDiffAPIDevices_NewDevice tests that a device joining in an attention
+// state is reported straight away.
+func TestDiffAPIDevices_NewDevice(t *testing.T) {
+	d := testAPIDevice("n2", "phone")
+	d.Authorized = false
+	d.UpdateAvailable = true
+
+	events := diffAPIDevices(nil, map[tailcfg.StableNodeID]apiDevice{d.NodeID: d}, testNow, testNow, time.Hour)
+	if got := eventTypes(events); got != "needs_authorization,update_available" {
+		t.Errorf("Unexpected events %q", got)
+	}
+	if events[0].Previous != nil {
+		t.Errorf("Expected no previous state for a new device")
+	}
+}
+
+// TestAPISource tests polling a fake devices API and merging its events
+// into the monitor's stream.
+func TestAPISource(t *testing.T) {
+	api := newFakeDevicesAPI(t)
+	laptop := testAPIDevice("n1", "laptop")
+	api.set(laptop)
+
+	logger := log.New(io.Discard)
+	source := NewAPISource(context.Background(), api.URL+"/", "example.com", "client-id", "client-secret", time.Minute, 7*24*time.Hour, logger)
+
+	events, err := source.poll(context.Background(), testNow)
+	if err != nil {
+		t.Fatalf("poll failed: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("Expected no events from the baseline poll, got %q", eventTypes(events))
+	}
+
+	// Tags come from the LocalAPI, so retagging alone is not reported here.
+	laptop.Tags = []string{"tag:prod"}
+	api.set(laptop)
+	events, err = source.poll(context.Background(), testNow.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("poll failed: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("Expected no events for a tag change, got %q", eventTypes(events))
+	}
+
+	laptop.UpdateAvailable = true
+	api.set(laptop)
+	events, err = source.poll(context.Background(), testNow.Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("poll failed: %v", err)
+	}
+	if got := eventTypes(events); got != "update_available" {
+		t.Fatalf("Expected update_available, got %q", got)
+	}
+	e := events[0]
+	if e.Device.DNSName != "laptop.example.ts.net" || len(e.Device.IPs) != 2 || e.Previous == nil || !slices.Equal(e.Previous.Tags, []string{"tag:prod"}) {
+		t.Errorf("Unexpected event %+v", e)
+	}
+
+	dm := NewDeviceMonitor(time.Second, true)
+	dm.logger = logger
+	s := &sent{}
+	dm.router, _ = NewRouter([]RuleConfig{{Name: "updates", When: `type == "update_available" && "tag:prod" in tags`}}, nil, s.send, logger)
+	dm.emit(events, "api")
+	if calls := s.get(); len(calls) != 1 || calls[0].n.Events[0].Source != "api" {
+		t.Errorf("Expected the event to be routed, got %+v", calls)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tailscale/hujson"
+)
+
+// Config is the notifier configuration file. It is HuJSON, so comments and
+// trailing commas are allowed.
+type Config struct {
+	// DeadLetter is a file that notifications are appended to, one JSON
+	// object per line, when a sink fails after all retries. If empty, they
+	// are logged instead.
+	DeadLetter string       `json:"dead_letter,omitempty"`
+	Sinks      []SinkConfig `json:"sinks"`
+	// Rules select which events reach which sinks. Without rules, every
+	// event goes to every sink.
+	Rules []RuleConfig `json:"rules,omitempty"`
+}
+
+// SinkConfig configures one notification sink. Fields that do not apply to
+// the sink's type are ignored.
+type SinkConfig struct {
+	Name string `json:"name"`
+	// Type is one of webhook, slack, ntfy, gotify or smtp.
+	Type string `json:"type"`
+	URL  string `json:"url,omitempty"`
+	// Secret is the HMAC-SHA256 key used to sign webhook bodies.
+	Secret string `json:"secret,omitempty"`
+	// Token authenticates to ntfy (bearer token) or gotify (app token).
+	Token    string            `json:"token,omitempty"`
+	Priority int               `json:"priority,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	SMTP     *SMTPConfig       `json:"smtp,omitempty"`
+
+	// Template renders the message body. TitleTemplate renders the ntfy and
+	// gotify title and the email subject. Both are text/template templates
+	// executed against a Notification.
+	Template      string `json:"template,omitempty"`
+	TitleTemplate string `json:"title_template,omitempty"`
+
+	Retries      *int     `json:"retries,omitempty"`
+	RetryBackoff Duration `json:"retry_backoff,omitempty"`
+	Timeout      Duration `json:"timeout,omitempty"`
+}
+
+// SMTPConfig configures the smtp sink.
+type SMTPConfig struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// Duration is a time.Duration that is written as a string such as "30s" in
+// the config file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads and validates the config file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = hujson.Standardize(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+	for i, sink := range cfg.Sinks {
+		if sink.Name == "" {
+			return nil, fmt.Errorf("sink %d: name is required", i)
+		}
+		if names[sink.Name] {
+			return nil, fmt.Errorf("sink %q: duplicate name", sink.Name)
+		}
+		names[sink.Name] = true
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// DeviceState is what the monitor tracks about a device between updates. It
+// is built from either a LocalAPI status or an IPN bus netmap, so both paths
+// feed the same change detection.
+type DeviceState struct {
+	ID             tailcfg.StableNodeID `json:"id"`
+	DNSName        string               `json:"dns_name"`
+	HostName       string               `json:"hostname"`
+	OS             string               `json:"os"`
+	User           string               `json:"user,omitempty"`
+	IPs            []netip.Addr         `json:"ips,omitempty"`
+	Tags           []string             `json:"tags,omitempty"`
+	Online         bool                 `json:"online"`
+	LastSeen       time.Time            `json:"last_seen,omitempty"`
+	ExitNodeOption bool                 `json:"exit_node_option,omitempty"`
+	Shared         bool                 `json:"shared,omitempty"`
+
+	// Set by the Tailscale API source.
+	KeyExpiry     time.Time `json:"key_expiry,omitzero"`
+	Authorized    *bool     `json:"authorized,omitempty"`
+	ClientVersion string    `json:"client_version,omitempty"`
+}
+
+// Snapshot is the state of the tailnet as seen by this node at one point in time.
+type Snapshot struct {
+	BackendState   string                               `json:"backend_state"`
+	MagicDNSSuffix string                               `json:"magic_dns_suffix,omitempty"`
+	Self           *DeviceState                         `json:"self,omitempty"`
+	Peers          map[tailcfg.StableNodeID]DeviceState `json:"peers"`
+}
+
+// SelfOnline reports whether this node is connected to the tailnet.
+func (s *Snapshot) SelfOnline() bool {
+	return s != nil && s.BackendState == ipn.Running.String()
+}
+
+// snapshotFromStatus builds a Snapshot from a LocalAPI status response. A
+// nil status yields an empty snapshot with no peer list.
+func snapshotFromStatus(status *ipnstate.Status) *Snapshot {
+	if status == nil {
+		return &Snapshot{}
+	}
+	snap := &Snapshot{BackendState: status.BackendState}
+	// As with the IPN bus, the peer list is only known while Running. A
+	// logged out or stopped node reports no peers, which is not the same
+	// as every device having been removed.
+	if status.BackendState == ipn.Running.String() {
+		snap.Peers = make(map[tailcfg.StableNodeID]DeviceState, len(status.Peer))
+	}
+	if status.CurrentTailnet != nil {
+		snap.MagicDNSSuffix = status.CurrentTailnet.MagicDNSSuffix
+	}
+	if status.Self != nil {
+		self := deviceFromPeerStatus(status, status.Self)
+		self.Online = snap.SelfOnline()
+		snap.Self = &self
+	}
+	for _, peer := range status.Peer {
+		if peer == nil || snap.Peers == nil {
+			continue
+		}
+		snap.Peers[peer.ID] = deviceFromPeerStatus(status, peer)
+	}
+	return snap
+}
+
+func deviceFromPeerStatus(status *ipnstate.Status, peer *ipnstate.PeerStatus) DeviceState {
+	d := DeviceState{
+		ID:             peer.ID,
+		DNSName:        peer.DNSName,
+		HostName:       peer.HostName,
+		OS:             peer.OS,
+		IPs:            slices.Clone(peer.TailscaleIPs),
+		Online:         peer.Online,
+		LastSeen:       peer.LastSeen,
+		ExitNodeOption: peer.ExitNodeOption,
+		Shared:         peer.ShareeNode,
+	}
+	if peer.Tags != nil {
+		d.Tags = peer.Tags.AsSlice()
+	}
+	if user, ok := status.User[peer.UserID]; ok {
+		d.User = user.LoginName
+	}
+	return d
+}
+
+// snapshotFromNetMap builds a Snapshot from an IPN bus netmap. nm may be nil
+// when the node is logged out, in which case only the backend state is known
+// and Peers is nil.
+func snapshotFromNetMap(nm *netmap.NetworkMap, state ipn.State) *Snapshot {
+	snap := &Snapshot{BackendState: state.String()}
+	if nm == nil {
+		return snap
+	}
+	snap.MagicDNSSuffix = nm.MagicDNSSuffix()
+	if nm.SelfNode.Valid() {
+		self := deviceFromNode(nm, nm.SelfNode)
+		self.Online = snap.SelfOnline()
+		snap.Self = &self
+	}
+	snap.Peers = make(map[tailcfg.StableNodeID]DeviceState, len(nm.Peers))
+	for _, peer := range nm.Peers {
+		if !peer.Valid() {
+			continue
+		}
+		snap.Peers[peer.StableID()] = deviceFromNode(nm, peer)
+	}
+	return snap
+}
+
+func deviceFromNode(nm *netmap.NetworkMap, n tailcfg.NodeView) DeviceState {
+	d := DeviceState{
+		ID:             n.StableID(),
+		DNSName:        n.Name(),
+		Tags:           n.Tags().AsSlice(),
+		Online:         n.Online().Get(),
+		LastSeen:       n.LastSeen().Get(),
+		ExitNodeOption: tsaddr.ContainsExitRoutes(n.AllowedIPs()),
+	}
+	for _, addr := range n.Addresses().All() {
+		if addr.IsSingleIP() {
+			d.IPs = append(d.IPs, addr.Addr())
+		}
+	}
+	if hi := n.Hostinfo(); hi.Valid() {
+		d.HostName = hi.Hostname()
+		d.OS = hi.OS()
+		d.Shared = hi.ShareeNode()
+	}
+	if profile, ok := nm.UserProfiles[n.User()]; ok && profile.Valid() {
+		d.User = profile.LoginName()
+	}
+	return d
+}
+
+// EventType identifies a kind of device transition.
+type EventType string
+
+const (
+	EventAdded   EventType = "added"
+	EventRemoved EventType = "removed"
+	EventOnline  EventType = "online"
+	EventOffline EventType = "offline"
+
+	// Changes to a device that stays in the tailnet. These carry the
+	// previous state in Event.Previous.
+	EventIPsChanged  EventType = "ips_changed"
+	EventOSChanged   EventType = "os_changed"
+	EventTagsChanged EventType = "tags_changed"
+
+	// Raised by the Tailscale API source only.
+	EventKeyExpiring     EventType = "key_expiring"
+	EventNeedsAuth       EventType = "needs_authorization"
+	EventUpdateAvailable EventType = "update_available"
+)
+
+// Event is a single device transition detected between two snapshots.
+type Event struct {
+	Type   EventType   `json:"type"`
+	Time   time.Time   `json:"time"`
+	Self   bool        `json:"self,omitempty"`
+	Device DeviceState `json:"device"`
+	// Previous is the device's prior state, for changes to its attributes.
+	Previous *DeviceState `json:"previous,omitempty"`
+	// Source is the path that observed the change: "ipnbus", "poll" or "api".
+	Source string `json:"source"`
+}
+
+// diffSnapshots returns the transitions from prev to cur. It is a pure
+// function of its arguments. A nil prev or cur yields nothing, and a nil
+// Peers on either side (no netmap) yields no peer events.
+//
+// Events are ordered: self first, then for each current peer in ID order its
+// added, online/offline and attribute changes, then removed peers.
+func diffSnapshots(prev, cur *Snapshot, now time.Time) []Event {
+	var events []Event
+	if prev == nil || cur == nil {
+		return nil
+	}
+
+	if prev.SelfOnline() != cur.SelfOnline() && cur.Self != nil {
+		typ := EventOffline
+		if cur.SelfOnline() {
+			typ = EventOnline
+		}
+		events = append(events, Event{Type: typ, Time: now, Self: true, Device: *cur.Self})
+	}
+
+	if prev.Peers == nil || cur.Peers == nil {
+		return events
+	}
+
+	for _, id := range sortedIDs(cur.Peers) {
+		device := cur.Peers[id]
+		last, existed := prev.Peers[id]
+		switch {
+		case !existed:
+			events = append(events, Event{Type: EventAdded, Time: now, Device: device})
+		case last.Online != device.Online:
+			typ := EventOffline
+			if device.Online {
+				typ = EventOnline
+			}
+			events = append(events, Event{Type: typ, Time: now, Device: device})
+		}
+		if existed {
+			events = append(events, attributeChanges(last, device, now)...)
+		}
+	}
+
+	for _, id := range sortedIDs(prev.Peers) {
+		if _, exists := cur.Peers[id]; !exists {
+			events = append(events, Event{Type: EventRemoved, Time: now, Device: prev.Peers[id]})
+		}
+	}
+
+	return events
+}
+
+// attributeChanges returns events for changes to last's addresses, OS and
+// tags. An empty OS is treated as unknown rather than a change, since
+// netmaps can omit Hostinfo.
+func attributeChanges(last, cur DeviceState, now time.Time) []Event {
+	var events []Event
+	add := func(typ EventType) {
+		prev := last
+		events = append(events, Event{Type: typ, Time: now, Device: cur, Previous: &prev})
+	}
+	if !slices.Equal(sortedAddrs(last.IPs), sortedAddrs(cur.IPs)) {
+		add(EventIPsChanged)
+	}
+	if last.OS != "" && cur.OS != "" && last.OS != cur.OS {
+		add(EventOSChanged)
+	}
+	if !slices.Equal(sortedTags(last.Tags), sortedTags(cur.Tags)) {
+		add(EventTagsChanged)
+	}
+	return events
+}
+
+func sortedAddrs(ips []netip.Addr) []netip.Addr {
+	return slices.SortedFunc(slices.Values(ips), netip.Addr.Compare)
+}
+
+func sortedTags(tags []string) []string {
+	return slices.Sorted(slices.Values(tags))
+}
+
+func sortedIDs(peers map[tailcfg.StableNodeID]DeviceState) []tailcfg.StableNodeID {
+	ids := make([]tailcfg.StableNodeID, 0, len(peers))
+	for id := range peers {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/ptr"
+)
+
+var testNow = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func testNode(id tailcfg.StableNodeID, name string, online bool) *tailcfg.Node {
+	return &tailcfg.Node{
+		ID:        tailcfg.NodeID(len(id)),
+		StableID:  id,
+		Name:      name + ".example.ts.net.",
+		User:      1,
+		Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		Online:    ptr.To(online),
+		LastSeen:  ptr.To(testNow.Add(-time.Hour)),
+		Hostinfo:  (&tailcfg.Hostinfo{Hostname: name, OS: "linux"}).View(),
+	}
+}
+
+func testNetMap(peers ...*tailcfg.Node) *netmap.NetworkMap {
+	nm := &netmap.NetworkMap{
+		SelfNode: testNode("self", "self", true).View(),
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfileView{
+			1: (&tailcfg.UserProfile{ID: 1, LoginName: "alice@example.com"}).View(),
+		},
+	}
+	for _, p := range peers {
+		nm.Peers = append(nm.Peers, p.View())
+	}
+	return nm
+}
+
+// TestSnapshotFromNetMap tests converting a netmap into the shared event model.
+func TestSnapshotFromNetMap(t *testing.T) {
+	exitNode := testNode("n2", "exit", true)
+	exitNode.AllowedIPs = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	exitNode.Tags = []string{"tag:exit"}
+
+	snap := snapshotFromNetMap(testNetMap(testNode("n1", "laptop", false), exitNode), ipn.Running)
+
+	if !snap.SelfOnline() || snap.Self == nil || !snap.Self.Online {
+		t.Errorf("Expected self to be online, got %+v", snap.Self)
+	}
+	if len(snap.Peers) != 2 {
+		t.Fatalf("Expected 2 peers, got %d", len(snap.Peers))
+	}
+
+	laptop := snap.Peers["n1"]
+	if laptop.Online || laptop.HostName != "laptop" || laptop.OS != "linux" || laptop.User != "alice@example.com" {
+		t.Errorf("Unexpected laptop state: %+v", laptop)
+	}
+	if len(laptop.IPs) != 1 || laptop.IPs[0] != netip.MustParseAddr("100.64.0.1") {
+		t.Errorf("Expected laptop IP 100.64.0.1, got %v", laptop.IPs)
+	}
+
+	exit := snap.Peers["n2"]
+	if !exit.ExitNodeOption || len(exit.Tags) != 1 || exit.Tags[0] != "tag:exit" {
+		t.Errorf("Unexpected exit node state: %+v", exit)
+	}
+}
+
+// TestSnapshotFromNetMap_LoggedOut tests that a missing netmap leaves peers unknown.
+func TestSnapshotFromNetMap_LoggedOut(t *testing.T) {
+	snap := snapshotFromNetMap(nil, ipn.NeedsLogin)
+	if snap.SelfOnline() || snap.Self != nil || snap.Peers != nil {
+		t.Errorf("Expected empty offline snapshot, got %+v", snap)
+	}
+}
+
+// TestDiffSnapshots_NetMap tests change detection across synthetic netmaps.
+func TestDiffSnapshots_NetMap(t *testing.T) {
+	prev := snapshotFromNetMap(testNetMap(
+		testNode("n1", "laptop", true),
+		testNode("n2", "server", true),
+		testNode("n3", "phone", false),
+	), ipn.Running)
+	cur := snapshotFromNetMap(testNetMap(
+		testNode("n1", "laptop", false),
+		testNode("n3", "phone", true),
+		testNode("n4", "tablet", true),
+	), ipn.Running)
+
+	events := diffSnapshots(prev, cur, testNow)
+
+	want := []struct {
+		typ EventType
+		id  tailcfg.StableNodeID
+	}{
+		{EventOffline, "n1"},
+		{EventOnline, "n3"},
+		{EventAdded, "n4"},
+		{EventRemoved, "n2"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %d: %+v", len(want), len(events), events)
+	}
+	for i, w := range want {
+		if events[i].Type != w.typ || events[i].Device.ID != w.id {
+			t.Errorf("Event %d = %s %s, want %s %s", i, events[i].Type, events[i].Device.ID, w.typ, w.id)
+		}
+		if !events[i].Time.Equal(testNow) {
+			t.Errorf("Event %d time = %v, want %v", i, events[i].Time, testNow)
+		}
+	}
+}
+
+// TestDiffSnapshots_Self tests that backend state changes report self transitions.
+func TestDiffSnapshots_Self(t *testing.T) {
+	nm := testNetMap(testNode("n1", "laptop", true))
+	running := snapshotFromNetMap(nm, ipn.Running)
+	stopped := snapshotFromNetMap(nm, ipn.Stopped)
+
+	events := diffSnapshots(running, stopped, testNow)
+	if len(events) != 1 || !events[0].Self || events[0].Type != EventOffline {
+		t.Fatalf("Expected a single self offline event, got %+v", events)
+	}
+
+	events = diffSnapshots(stopped, running, testNow)
+	if len(events) != 1 || !events[0].Self || events[0].Type != EventOnline {
+		t.Fatalf("Expected a single self online event, got %+v", events)
+	}
+}
+
+// TestDiffSnapshots_StatusAndNetMap tests that both paths produce the same model.
+func TestDiffSnapshots_StatusAndNetMap(t *testing.T) {
+	status := &ipnstate.Status{
+		BackendState:   ipn.Running.String(),
+		CurrentTailnet: &ipnstate.TailnetStatus{MagicDNSSuffix: "example.ts.net"},
+		Self:           &ipnstate.PeerStatus{ID: "self", DNSName: "self.example.ts.net.", HostName: "self", OS: "linux"},
+		User:           map[tailcfg.UserID]tailcfg.UserProfile{1: {ID: 1, LoginName: "alice@example.com"}},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				ID:           "n1",
+				DNSName:      "laptop.example.ts.net.",
+				HostName:     "laptop",
+				OS:           "linux",
+				UserID:       1,
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+				Online:       true,
+			},
+		},
+	}
+
+	polled := snapshotFromStatus(status)
+	watched := snapshotFromNetMap(testNetMap(testNode("n1", "laptop", true)), ipn.Running)
+
+	if events := diffSnapshots(polled, watched, testNow); len(events) != 0 {
+		t.Errorf("Expected no events between equivalent snapshots, got %+v", events)
+	}
+	if polled.Peers["n1"].User != watched.Peers["n1"].User {
+		t.Errorf("Expected matching users, got %q and %q", polled.Peers["n1"].User, watched.Peers["n1"].User)
+	}
+}
+
+func snapshotOf(state ipn.State, peers ...DeviceState) *Snapshot {
+	snap := &Snapshot{BackendState: state.String(), Peers: make(map[tailcfg.StableNodeID]DeviceState)}
+	for _, p := range peers {
+		snap.Peers[p.ID] = p
+	}
+	return snap
+}
+
+func device(id tailcfg.StableNodeID, online bool, modify ...func(*DeviceState)) DeviceState {
+	d := DeviceState{
+		ID:      id,
+		DNSName: string(id) + ".example.ts.net.",
+		OS:      "linux",
+		IPs:     []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")},
+		Tags:    []string{"tag:a", "tag:b"},
+		Online:  online,
+	}
+	for _, f := range modify {
+		f(&d)
+	}
+	return d
+}
+
+// TestDiffSnapshots tests change detection between pairs of snapshots.
+func TestDiffSnapshots(t *testing.T) {
+	running := snapshotOf(ipn.Running, device("n1", true))
+
+	cases := []struct {
+		name      string
+		prev, cur *Snapshot
+		want      string
+	}{
+		{"nil prev", nil, running, ""},
+		{"nil cur", running, nil, ""},
+		{"nil peers before", &Snapshot{BackendState: "Running"}, running, ""},
+		{"nil peers after", running, &Snapshot{BackendState: "Running"}, ""},
+		{"empty snapshots", &Snapshot{}, &Snapshot{}, ""},
+		{"unchanged", running, snapshotOf(ipn.Running, device("n1", true)), ""},
+		{"added", snapshotOf(ipn.Running), running, "added:n1"},
+		{"removed", running, snapshotOf(ipn.Running), "removed:n1"},
+		{"offline", running, snapshotOf(ipn.Running, device("n1", false)), "offline:n1"},
+		{"online", snapshotOf(ipn.Running, device("n1", false)), running, "online:n1"},
+		{"self only", running, snapshotOf(ipn.Stopped, device("n1", true)), ""},
+		{
+			"ips changed",
+			running,
+			snapshotOf(ipn.Running, device("n1", true, func(d *DeviceState) { d.IPs = d.IPs[:1] })),
+			"ips_changed:n1",
+		},
+		{
+			"ips reordered",
+			running,
+			snapshotOf(ipn.Running, device("n1", true, func(d *DeviceState) { d.IPs = []netip.Addr{d.IPs[1], d.IPs[0]} })),
+			"",
+		},
+		{
+			"peer with no ips",
+			snapshotOf(ipn.Running, device("n1", true, func(d *DeviceState) { d.IPs = nil })),
+			snapshotOf(ipn.Running, device("n1", false, func(d *DeviceState) { d.IPs = nil })),
+			"offline:n1",
+		},
+		{
+			"os changed",
+			running,
+			snapshotOf(ipn.Running, device("n1", true, func(d *DeviceState) { d.OS = "windows" })),
+			"os_changed:n1",
+		},
+		{
+			"os unknown",
+			running,
+			snapshotOf(ipn.Running, device("n1", true, func(d *DeviceState) { d.OS = "" })),
+			"",
+		},
+		{
+			"tags changed",
+			running,
+			snapshotOf(ipn.Running, device("n1", true, func(d *DeviceState) { d.Tags = []string{"tag:a"} })),
+			"tags_changed:n1",
+		},
+		{
+			"tags reordered",
+			running,
+			snapshotOf(ipn.Running, device("n1", true, func(d *DeviceState) { d.Tags = []string{"tag:b", "tag:a"} })),
+			"",
+		},
+		{
+			"several changes in order",
+			snapshotOf(ipn.Running, device("n1", true), device("n2", true), device("n4", true)),
+			snapshotOf(ipn.Running,
+				device("n1", false, func(d *DeviceState) { d.OS = "macOS"; d.Tags = nil }),
+				device("n3", true),
+				device("n4", true, func(d *DeviceState) { d.IPs = nil })),
+			"offline:n1,os_changed:n1,tags_changed:n1,added:n3,ips_changed:n4,removed:n2",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			for _, e := range diffSnapshots(c.prev, c.cur, testNow) {
+				if e.Self {
+					continue
+				}
+				got = append(got, string(e.Type)+":"+string(e.Device.ID))
+				if (e.Type == EventIPsChanged || e.Type == EventOSChanged || e.Type == EventTagsChanged) && e.Previous == nil {
+					t.Errorf("Expected previous state on %s event", e.Type)
+				}
+			}
+			if joined := strings.Join(got, ","); joined != c.want {
+				t.Errorf("Expected %q, got %q", c.want, joined)
+			}
+		})
+	}
+}
+
+// TestSnapshotFromStatus_Sparse tests that missing status fields do not panic.
+func TestSnapshotFromStatus_Sparse(t *testing.T) {
+	if snap := snapshotFromStatus(nil); snap == nil || snap.Peers != nil || snap.SelfOnline() {
+		t.Errorf("Unexpected snapshot for nil status: %+v", snap)
+	}
+
+	peers := map[key.NodePublic]*ipnstate.PeerStatus{
+		key.NewNode().Public(): {ID: "n1", HostName: "bare"},
+		key.NewNode().Public(): nil,
+	}
+	snap := snapshotFromStatus(&ipnstate.Status{BackendState: ipn.Running.String(), Peer: peers})
+	if snap.Self != nil || snap.MagicDNSSuffix != "" || len(snap.Peers) != 1 || len(snap.Peers["n1"].IPs) != 0 {
+		t.Errorf("Unexpected snapshot %+v", snap)
+	}
+
+	// Peers are unknown unless the node is Running.
+	for _, state := range []ipn.State{ipn.NeedsLogin, ipn.Stopped} {
+		if snap := snapshotFromStatus(&ipnstate.Status{BackendState: state.String(), Peer: peers}); snap.Peers != nil {
+			t.Errorf("Expected unknown peers when %s, got %+v", state, snap.Peers)
+		}
+	}
+
+	var nilSnap *Snapshot
+	if nilSnap.SelfOnline() {
+		t.Errorf("Expected a nil snapshot to be offline")
+	}
+}
+
+// TestDeviceMonitor_Sparse tests the monitor with logged-out and bare nodes.
+func TestDeviceMonitor_Sparse(t *testing.T) {
+	dm := NewDeviceMonitor(time.Second, true)
+	dm.logger = log.New(io.Discard)
+
+	bare := &tailcfg.Node{StableID: "n1", Name: "bare.example.ts.net."}
+	dm.update(nil, "poll")
+	dm.update(snapshotFromStatus(&ipnstate.Status{BackendState: ipn.NeedsLogin.String()}), "poll")
+	dm.update(snapshotFromNetMap(nil, ipn.NeedsLogin), "ipnbus")
+	dm.update(snapshotFromNetMap(&netmap.NetworkMap{Peers: []tailcfg.NodeView{bare.View()}}, ipn.Running), "ipnbus")
+
+	if snap := dm.Snapshot(); snap == nil || len(snap.Peers) != 1 {
+		t.Errorf("Unexpected snapshot %+v", snap)
+	}
+
+	// Polling across a logout neither removes nor re-adds the devices.
+	s := &sent{}
+	dm.router, _ = NewRouter(nil, nil, s.send, dm.logger)
+	dm.update(snapshotFromStatus(&ipnstate.Status{BackendState: ipn.NeedsLogin.String()}), "poll")
+	dm.update(snapshotFromStatus(&ipnstate.Status{
+		BackendState: ipn.Running.String(),
+		Peer:         map[key.NodePublic]*ipnstate.PeerStatus{key.NewNode().Public(): {ID: "n1", DNSName: "bare.example.ts.net."}},
+	}), "poll")
+	for _, call := range s.get() {
+		for _, e := range call.n.Events {
+			if e.Type == EventRemoved || e.Type == EventAdded {
+				t.Errorf("Unexpected %s event across a NeedsLogin poll", e.Type)
+			}
+		}
+	}
+}
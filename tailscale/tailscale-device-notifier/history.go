@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type historyCmd struct {
+	Since       string `name:"since" help:"Start of the range, as a duration ago (24h) or an RFC 3339 time or date" default:"24h"`
+	Until       string `name:"until" help:"End of the range, as a duration ago or an RFC 3339 time or date (default now)"`
+	Device      string `name:"device" short:"d" help:"Only show devices whose DNS name, hostname or ID contains this"`
+	Transitions bool   `name:"transitions" help:"List each transition within the range"`
+}
+
+func (c *historyCmd) Run(g *cli) error {
+	now := time.Now()
+	from, err := parseTimeArg(c.Since, now)
+	if err != nil {
+		return fmt.Errorf("--since: %w", err)
+	}
+	to := now
+	if c.Until != "" {
+		if to, err = parseTimeArg(c.Until, now); err != nil {
+			return fmt.Errorf("--until: %w", err)
+		}
+	}
+	if !to.After(from) {
+		return fmt.Errorf("--since must be before --until")
+	}
+
+	store := &Store{path: g.State}
+	history, err := store.History()
+	if err != nil {
+		return err
+	}
+	return printHistory(os.Stdout, history, from, to, c.Device, c.Transitions)
+}
+
+// parseTimeArg accepts a duration before now, an RFC 3339 time or a date.
+func parseTimeArg(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+func printHistory(w io.Writer, history []DeviceHistory, from, to time.Time, filter string, transitions bool) error {
+	slices.SortFunc(history, func(a, b DeviceHistory) int {
+		return strings.Compare(historyName(a.Record.Device), historyName(b.Record.Device))
+	})
+
+	fmt.Fprintf(w, "Availability from %s to %s\n\n", from.Format(time.DateTime), to.Format(time.DateTime))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tOS\tFIRST SEEN\tLAST SEEN\tAVAILABILITY\tCHANGES\tSTATUS")
+	for _, h := range history {
+		d := h.Record.Device
+		if filter != "" && !strings.Contains(d.DNSName, filter) && !strings.Contains(d.HostName, filter) && !strings.Contains(string(d.ID), filter) {
+			continue
+		}
+
+		online, observed := h.Availability(from, to)
+		if observed == 0 {
+			continue
+		}
+		changes := 0
+		for _, t := range h.Transitions {
+			if !t.Time.Before(from) && t.Time.Before(to) {
+				changes++
+			}
+		}
+
+		status := onlineString(d.Online)
+		if h.Record.RemovedAt != nil {
+			status = "removed " + h.Record.RemovedAt.Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.1f%%\t%d\t%s\n",
+			historyName(d),
+			d.OS,
+			h.Record.FirstSeen.Format(time.DateTime),
+			formatHistoryTime(h.Record.LastSeen),
+			100*online.Seconds()/observed.Seconds(),
+			changes,
+			status)
+
+		if transitions {
+			for _, t := range h.Transitions {
+				if t.Time.Before(from) || !t.Time.Before(to) {
+					continue
+				}
+				fmt.Fprintf(tw, "  %s\t%s\t\t\t\t\t\n", t.Time.Format(time.DateTime), t.Type)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+func historyName(d DeviceState) string {
+	if name := strings.TrimSuffix(d.DNSName, "."); name != "" {
+		return name
+	}
+	return d.HostName
+}
+
+func formatHistoryTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.DateTime)
+}
@@ -3,37 +3,107 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/alecthomas/kong"
 	"github.com/charmbracelet/log"
 	"tailscale.com/client/local"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
-	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+	"tailscale.com/types/netmap"
 )
 
+type cli struct {
+	State   string     `name:"state" help:"Path to the database holding device state and history" env:"NOTIFIER_STATE" default:"device-notifier.db"`
+	Run     runCmd     `cmd:"" default:"withargs" help:"Monitor the tailnet and report device changes (default)"`
+	History historyCmd `cmd:"" help:"Print per-device availability from the recorded history"`
+}
+
+type runCmd struct {
+	PollInterval time.Duration `name:"poll-interval" help:"Interval between LocalAPI status polls when polling" default:"5s"`
+	Poll         bool          `name:"poll" help:"Poll the LocalAPI instead of watching the IPN bus"`
+	Debug        bool          `name:"debug" help:"Log full device JSON for every event"`
+	Config       string        `name:"config" help:"Path to a HuJSON config file defining notification sinks" env:"NOTIFIER_CONFIG" type:"existingfile"`
+	NoState      bool          `name:"no-state" help:"Do not load or save device state"`
+	Socket       string        `name:"socket" help:"Path to the tailscaled LocalAPI socket, if not the platform default" env:"TS_SOCKET"`
+
+	HTTPAddr  string `name:"http-addr" help:"Address to serve /metrics and /devices on, e.g. :9100. Disabled if empty" env:"NOTIFIER_HTTP_ADDR"`
+	HTTPTsnet bool   `name:"http-tsnet" help:"Serve --http-addr only on the tailnet, from an embedded tsnet node"`
+
+	Tsnet          bool     `name:"tsnet" help:"Monitor from an embedded tsnet node instead of the local tailscaled"`
+	TsnetHostname  string   `name:"tsnet-hostname" help:"Hostname of the embedded tsnet node" default:"device-notifier"`
+	TsnetDir       string   `name:"tsnet-dir" help:"State directory of the embedded tsnet node" env:"NOTIFIER_TSNET_DIR"`
+	TsnetTags      []string `name:"tsnet-tag" help:"Tag to request for the embedded tsnet node when minting an auth key. Repeatable"`
+	TsnetEphemeral bool     `name:"tsnet-ephemeral" help:"Register the embedded tsnet node as ephemeral"`
+	AuthKey        string   `name:"auth-key" help:"Auth key for the embedded tsnet node" env:"TS_AUTHKEY"`
+
+	OAuthClientID     string `name:"oauth-client-id" help:"OAuth client ID, used to mint an auth key for the tsnet node and to read the devices API" env:"TS_API_CLIENT_ID"`
+	OAuthClientSecret string `name:"oauth-client-secret" help:"OAuth client secret" env:"TS_API_CLIENT_SECRET"`
+	APIBaseURL        string `name:"api-base-url" help:"Tailscale API base URL" default:"https://api.tailscale.com" env:"TS_API_BASE_URL"`
+
+	API           bool          `name:"api" help:"Also poll the Tailscale devices API for key expiry, authorization, update and tag changes"`
+	APIInterval   time.Duration `name:"api-interval" help:"Interval between devices API polls" default:"5m"`
+	Tailnet       string        `name:"tailnet" help:"Tailnet to query with --api" default:"-" env:"TS_TAILNET"`
+	KeyExpiryDays int           `name:"key-expiry-days" help:"Warn when a device key expires within this many days" default:"7"`
+}
+
+// watchRetryInterval is how long the monitor polls after losing the IPN bus
+// before trying to watch it again.
+const watchRetryInterval = time.Minute
+
 type DeviceMonitor struct {
-	client        *local.Client
-	lastStates    map[tailcfg.StableNodeID]bool
-	lastSelfState bool // Track self online status
-	pollInterval  time.Duration
-	logger        *log.Logger
+	client *local.Client
+
+	mu           sync.Mutex // guards lastSnapshot for HTTP readers
+	lastSnapshot *Snapshot
+
+	pollInterval time.Duration
+	pollOnly     bool
+	dispatcher   *Dispatcher
+	router       *Router
+	store        *Store
+	started      bool
+	metrics      *metrics
+	logger       *log.Logger
 }
 
-func NewDeviceMonitor() *DeviceMonitor {
+func NewDeviceMonitor(pollInterval time.Duration, pollOnly bool) *DeviceMonitor {
 	// Create a structured logger with nice formatting
 	logger := log.New(os.Stdout)
 	logger.SetLevel(log.InfoLevel)
 	logger.SetReportTimestamp(true)
 	logger.SetTimeFormat("15:04:05")
 
-	return &DeviceMonitor{
+	dm := &DeviceMonitor{
 		client:       &local.Client{},
-		lastStates:   make(map[tailcfg.StableNodeID]bool),
-		pollInterval: 5 * time.Second,
+		pollInterval: pollInterval,
+		pollOnly:     pollOnly,
 		logger:       logger,
 	}
+	dm.metrics = newMetrics(dm.Snapshot)
+	return dm
+}
+
+// Snapshot returns the monitor's current view of the tailnet, or nil before
+// the first update. It must not be modified.
+func (dm *DeviceMonitor) Snapshot() *Snapshot {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.lastSnapshot
+}
+
+func (dm *DeviceMonitor) setSnapshot(snap *Snapshot) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.lastSnapshot = snap
 }
 
 func (dm *DeviceMonitor) fetchStatus(ctx context.Context) (*ipnstate.Status, error) {
@@ -44,209 +114,422 @@ func (dm *DeviceMonitor) fetchStatus(ctx context.Context) (*ipnstate.Status, err
 	return status, nil
 }
 
-func (dm *DeviceMonitor) isNodeOnline(peer *ipnstate.PeerStatus) bool {
-	// A peer is considered online if:
-	// 1. It has been seen recently (within last 2 minutes)
-	// 2. It's currently active or has recent activity
-	// 3. It's marked as Online by the control plane
+// update compares snap with the previous snapshot and reports any
+// transitions. The first snapshot becomes the baseline unless one was loaded
+// from the store.
+func (dm *DeviceMonitor) update(snap *Snapshot, source string) {
+	if snap == nil {
+		return
+	}
+	now := time.Now()
+	prev := dm.lastSnapshot
+	if !dm.started {
+		dm.started = true
+		dm.printInitialStatus(snap)
+		if prev == nil {
+			dm.setSnapshot(snap)
+			dm.record(snap, nil, now)
+			return
+		}
+		// This node's own state across a restart says nothing about the
+		// tailnet, so only peers are compared with the saved state.
+		saved := *prev
+		saved.BackendState = snap.BackendState
+		saved.Self = snap.Self
+		prev = &saved
+		dm.logger.Info("Resuming from saved state",
+			"known_devices", len(prev.Peers))
+	}
 
-	// If the peer is explicitly marked as online, use that
-	if peer.Online {
-		return true
+	// Without a netmap the peer list is unknown rather than empty, so keep
+	// the previous view instead of reporting every device as removed.
+	if snap.Peers == nil {
+		snap.Peers = prev.Peers
 	}
 
-	// Consider online if last seen within 2 minutes
-	return time.Since(peer.LastSeen) < 2*time.Minute
+	events := diffSnapshots(prev, snap, now)
+	dm.emit(events, source)
+	if len(events) > 0 || (prev.Peers == nil && snap.Peers != nil) {
+		dm.record(snap, events, now)
+	}
+	dm.setSnapshot(snap)
 }
 
-func (dm *DeviceMonitor) getOnlineReason(peer *ipnstate.PeerStatus) string {
-	if peer.Online {
-		return "marked as online by control plane"
+// emit reports events from any source and passes them on to metrics and
+// notification routing. It is safe to call from several goroutines.
+func (dm *DeviceMonitor) emit(events []Event, source string) {
+	for i := range events {
+		events[i].Source = source
+		dm.report(events[i])
 	}
-	if time.Since(peer.LastSeen) < 2*time.Minute {
-		return "seen recently (within 2 minutes)"
+	dm.metrics.observe(events)
+	if dm.router != nil && len(events) > 0 {
+		dm.router.Handle(events)
 	}
-	return "unknown"
 }
 
-func (dm *DeviceMonitor) getOfflineReason(peer *ipnstate.PeerStatus) string {
-	if !peer.Online && time.Since(peer.LastSeen) >= 2*time.Minute {
-		return "not seen recently and marked offline"
+// record saves snap and events to the store, if there is one. Failures are
+// logged rather than interrupting monitoring.
+func (dm *DeviceMonitor) record(snap *Snapshot, events []Event, now time.Time) {
+	if dm.store == nil {
+		return
 	}
-	if !peer.Online {
-		return "marked as offline by control plane"
-	}
-	if time.Since(peer.LastSeen) >= 2*time.Minute {
-		return "not seen recently"
+	if err := dm.store.Record(snap, events, now); err != nil {
+		dm.logger.Warn("Failed to save device state",
+			"error", err)
 	}
-	return "unknown"
 }
 
-func (dm *DeviceMonitor) checkDeviceChanges(status *ipnstate.Status) {
-	currentStates := make(map[tailcfg.StableNodeID]bool)
-
-	// Check self status
-	selfOnline := status.BackendState == ipn.Running.String()
-
-	// Only log self status if it changed
-	if dm.lastSelfState != selfOnline {
-		if selfOnline {
-			dm.logger.Info("Self came ONLINE",
-				"dns_name", status.Self.DNSName)
-		} else {
-			dm.logger.Info("Self went OFFLINE",
-				"dns_name", status.Self.DNSName)
-		}
-		dm.lastSelfState = selfOnline
+func (dm *DeviceMonitor) report(event Event) {
+	d := event.Device
+
+	switch {
+	case event.Self && event.Type == EventOnline:
+		dm.logger.Info("Self came ONLINE",
+			"dns_name", d.DNSName)
+	case event.Self && event.Type == EventOffline:
+		dm.logger.Info("Self went OFFLINE",
+			"dns_name", d.DNSName)
+	case event.Type == EventAdded:
+		dm.logger.Info("New device discovered",
+			"dns_name", d.DNSName,
+			"hostname", d.HostName,
+			"os", d.OS,
+			"status", onlineString(d.Online))
+	case event.Type == EventOnline:
+		dm.logger.Info("Device came ONLINE",
+			"dns_name", d.DNSName,
+			"hostname", d.HostName,
+			"os", d.OS,
+			"ips", d.IPs)
+	case event.Type == EventOffline:
+		dm.logger.Info("Device went OFFLINE",
+			"dns_name", d.DNSName,
+			"hostname", d.HostName,
+			"os", d.OS,
+			"last_seen", formatLastSeen(d.LastSeen))
+	case event.Type == EventRemoved:
+		dm.logger.Info("Device removed from network",
+			"dns_name", d.DNSName,
+			"node_id", d.ID)
+	case event.Type == EventIPsChanged:
+		dm.logger.Info("Device addresses changed",
+			"dns_name", d.DNSName,
+			"ips", d.IPs,
+			"previous_ips", previous(event).IPs)
+	case event.Type == EventOSChanged:
+		dm.logger.Info("Device OS changed",
+			"dns_name", d.DNSName,
+			"os", d.OS,
+			"previous_os", previous(event).OS)
+	case event.Type == EventKeyExpiring:
+		dm.logger.Warn("Device key expiring",
+			"dns_name", d.DNSName,
+			"expires", d.KeyExpiry.Format(time.DateTime))
+	case event.Type == EventNeedsAuth:
+		dm.logger.Warn("Device needs authorization",
+			"dns_name", d.DNSName,
+			"hostname", d.HostName,
+			"user", d.User)
+	case event.Type == EventUpdateAvailable:
+		dm.logger.Info("Client update available",
+			"dns_name", d.DNSName,
+			"client_version", d.ClientVersion)
+	case event.Type == EventTagsChanged:
+		dm.logger.Info("Device tags changed",
+			"dns_name", d.DNSName,
+			"tags", d.Tags,
+			"previous_tags", previous(event).Tags)
 	}
 
-	// Check all peers
-	for _, peer := range status.Peer {
-		isOnline := dm.isNodeOnline(peer)
-		currentStates[peer.ID] = isOnline
-
-		// Check if this is a new device or if status changed
-		lastStatus, existed := dm.lastStates[peer.ID]
-
-		if !existed {
-			// New device discovered
-			statusStr := "offline"
-			if isOnline {
-				statusStr = "online"
-			}
-			dm.logger.Info("New device discovered",
-				"dns_name", peer.DNSName,
-				"hostname", peer.HostName,
-				"os", peer.OS,
-				"status", statusStr)
-
-			// Print full device JSON for new devices
-			if deviceJSON, err := json.MarshalIndent(peer, "", "  "); err == nil {
-				dm.logger.Info("Full device JSON",
-					"dns_name", peer.DNSName,
-					"device_json", string(deviceJSON))
-			}
-		} else if lastStatus != isOnline {
-			// Status changed
-			if isOnline {
-				reason := dm.getOnlineReason(peer)
-				dm.logger.Info("Device came ONLINE",
-					"dns_name", peer.DNSName,
-					"hostname", peer.HostName,
-					"os", peer.OS,
-					"ip", peer.TailscaleIPs[0].String(),
-					"reason", reason)
-			} else {
-				reason := dm.getOfflineReason(peer)
-				lastSeenStr := peer.LastSeen.Format("15:04:05")
-				dm.logger.Info("Device went OFFLINE",
-					"dns_name", peer.DNSName,
-					"hostname", peer.HostName,
-					"os", peer.OS,
-					"last_seen", lastSeenStr,
-					"reason", reason)
-			}
-
-			// Print full device JSON for status changes
-			if deviceJSON, err := json.MarshalIndent(peer, "", "  "); err == nil {
-				dm.logger.Info("Full device JSON",
-					"dns_name", peer.DNSName,
-					"device_json", string(deviceJSON))
-			}
-		}
+	if deviceJSON, err := json.MarshalIndent(d, "", "  "); err == nil {
+		dm.logger.Debug("Full device JSON",
+			"dns_name", d.DNSName,
+			"source", event.Source,
+			"device_json", string(deviceJSON))
 	}
+}
 
-	// Check for devices that are no longer in the peer list
-	for nodeID, wasOnline := range dm.lastStates {
-		if _, exists := currentStates[nodeID]; !exists && wasOnline {
-			dm.logger.Info("Device removed from network",
-				"node_id", nodeID)
-		}
+// previous returns the device's state before event, or a zero state if the
+// event does not carry one.
+func previous(event Event) DeviceState {
+	if event.Previous == nil {
+		return DeviceState{}
 	}
-
-	dm.lastStates = currentStates
+	return *event.Previous
 }
 
-func (dm *DeviceMonitor) printInitialStatus(status *ipnstate.Status) {
+func (dm *DeviceMonitor) printInitialStatus(snap *Snapshot) {
 	dm.logger.Info("🚀 Tailscale Status",
-		"backend_state", status.BackendState)
+		"backend_state", snap.BackendState)
 	dm.logger.Info("🏠 Tailnet Information",
-		"magic_dns_suffix", status.CurrentTailnet.MagicDNSSuffix,
-		"peer_count", len(status.Peer))
-
-	// Print self info and initialize self state
-	selfOnline := status.BackendState == ipn.Running.String()
-	dm.lastSelfState = selfOnline
-	dm.logger.Info("📱 Self Device Status",
-		"dns_name", status.Self.DNSName,
-		"hostname", status.Self.HostName,
-		"os", status.Self.OS,
-		"ip", status.Self.TailscaleIPs[0].String(),
-		"status", map[bool]string{true: "online", false: "offline"}[selfOnline])
-
-	// Initialize states without logging changes
-	for _, peer := range status.Peer {
-		isOnline := dm.isNodeOnline(peer)
-		dm.lastStates[peer.ID] = isOnline
-
-		onlineStatus := "offline"
-		if isOnline {
-			onlineStatus = "online"
-		}
-
-		lastSeenStr := peer.LastSeen.Format("15:04:05")
+		"magic_dns_suffix", snap.MagicDNSSuffix,
+		"peer_count", len(snap.Peers))
+
+	if self := snap.Self; self != nil {
+		dm.logger.Info("📱 Self Device Status",
+			"dns_name", self.DNSName,
+			"hostname", self.HostName,
+			"os", self.OS,
+			"ips", self.IPs,
+			"status", onlineString(self.Online))
+	}
 
+	for _, id := range sortedIDs(snap.Peers) {
+		peer := snap.Peers[id]
 		dm.logger.Info("Initial Peer Status",
 			"dns_name", peer.DNSName,
 			"hostname", peer.HostName,
 			"os", peer.OS,
-			"status", onlineStatus,
-			"last_seen", lastSeenStr)
+			"status", onlineString(peer.Online),
+			"last_seen", formatLastSeen(peer.LastSeen))
 	}
 }
 
 func (dm *DeviceMonitor) Start(ctx context.Context) error {
+	if dm.pollOnly {
+		dm.logger.Info("Starting Tailscale device monitor",
+			"mode", "poll",
+			"poll_interval", dm.pollInterval)
+		return dm.poll(ctx, 0)
+	}
+
 	dm.logger.Info("Starting Tailscale device monitor",
-		"poll_interval", dm.pollInterval)
+		"mode", "ipnbus")
+
+	for {
+		err := dm.watchIPNBus(ctx)
+		if ctx.Err() != nil {
+			dm.logger.Info("Stopping device monitor")
+			return ctx.Err()
+		}
+		dm.logger.Warn("IPN bus unavailable, falling back to polling",
+			"error", err,
+			"poll_interval", dm.pollInterval,
+			"retry_in", watchRetryInterval)
 
-	// Initial fetch to populate baseline
-	status, err := dm.fetchStatus(ctx)
+		if err := dm.poll(ctx, watchRetryInterval); err != nil {
+			dm.logger.Info("Stopping device monitor")
+			return err
+		}
+	}
+}
+
+// watchIPNBus reports transitions from netmap and state notifications as
+// they arrive. It returns when the bus connection fails or ctx is done.
+func (dm *DeviceMonitor) watchIPNBus(ctx context.Context) error {
+	mask := ipn.NotifyInitialState | ipn.NotifyInitialNetMap | ipn.NotifyNoPrivateKeys | ipn.NotifyRateLimit
+	watcher, err := dm.client.WatchIPNBus(ctx, mask)
 	if err != nil {
 		return err
 	}
+	defer watcher.Close()
+
+	state := ipn.NoState
+	var nm *netmap.NetworkMap
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return err
+		}
+		if n.ErrMessage != nil {
+			dm.logger.Error("Backend error", "error", *n.ErrMessage)
+		}
+		if n.State == nil && n.NetMap == nil {
+			continue
+		}
+		if n.State != nil {
+			state = *n.State
+		}
+		if n.NetMap != nil {
+			nm = n.NetMap
+		}
+		if state != ipn.Running && state != ipn.Starting {
+			// A stale netmap must not mask peers as still present.
+			nm = nil
+		}
+		dm.update(snapshotFromNetMap(nm, state), "ipnbus")
+	}
+}
 
-	dm.printInitialStatus(status)
+// poll reports transitions by fetching status every pollInterval. It runs
+// until ctx is done or, if limit is non-zero, until limit has elapsed.
+func (dm *DeviceMonitor) poll(ctx context.Context, limit time.Duration) error {
+	var deadline <-chan time.Time
+	if limit > 0 {
+		timer := time.NewTimer(limit)
+		defer timer.Stop()
+		deadline = timer.C
+	}
 
 	ticker := time.NewTicker(dm.pollInterval)
 	defer ticker.Stop()
 
 	for {
+		status, err := dm.fetchStatus(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			dm.logger.Error("Error fetching status",
+				"error", err)
+		} else {
+			dm.update(snapshotFromStatus(status), "poll")
+		}
+
 		select {
 		case <-ctx.Done():
-			dm.logger.Info("Stopping device monitor")
 			return ctx.Err()
+		case <-deadline:
+			return nil
 		case <-ticker.C:
-			status, err := dm.fetchStatus(ctx)
-			if err != nil {
-				dm.logger.Error("Error fetching status",
-					"error", err)
-				continue
-			}
-
-			dm.checkDeviceChanges(status)
 		}
 	}
 }
 
+func onlineString(online bool) string {
+	if online {
+		return "online"
+	}
+	return "offline"
+}
+
+func formatLastSeen(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format("15:04:05")
+}
+
 func main() {
-	monitor := NewDeviceMonitor()
+	var cfg cli
+	ctx := kong.Parse(&cfg,
+		kong.Name("tailscale-device-notifier"),
+		kong.Description("Report devices joining, leaving and changing state on your tailnet"),
+		kong.UsageOnError(),
+	)
+	ctx.FatalIfErrorf(ctx.Run(&cfg))
+}
+
+func (c *runCmd) Run(g *cli) error {
+	monitor := NewDeviceMonitor(c.PollInterval, c.Poll)
+	monitor.client = newLocalClient(c.Socket)
+	if c.Debug {
+		monitor.logger.SetLevel(log.DebugLevel)
+	}
+
+	if !c.NoState {
+		store, err := OpenStore(g.State)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		snap, err := store.LoadSnapshot()
+		if err != nil {
+			return fmt.Errorf("load state %s: %w", g.State, err)
+		}
+		monitor.store = store
+		monitor.lastSnapshot = snap
+	}
+
+	if c.Config != "" {
+		cfg, err := LoadConfig(c.Config)
+		if err != nil {
+			return err
+		}
+		dispatcher, err := NewDispatcher(cfg, monitor.logger)
+		if err != nil {
+			return err
+		}
+		var sinks []string
+		for _, sc := range cfg.Sinks {
+			sinks = append(sinks, sc.Name)
+		}
+		router, err := NewRouter(cfg.Rules, sinks, dispatcher.SendTo, monitor.logger)
+		if err != nil {
+			dispatcher.Close(context.Background())
+			return err
+		}
+		monitor.dispatcher = dispatcher
+		monitor.router = router
+		monitor.logger.Info("Notification sinks configured",
+			"count", len(cfg.Sinks),
+			"rules", len(cfg.Rules))
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	if err := monitor.Start(ctx); err != nil && err != context.Canceled {
-		monitor.logger.Error("Monitor failed",
-			"error", err)
-		os.Exit(1)
+	var sourceDone chan struct{}
+	defer func() {
+		// Stop the API source so that it can't emit events once the router
+		// and dispatcher are closed.
+		cancel()
+		if sourceDone != nil {
+			<-sourceDone
+		}
+		if monitor.dispatcher != nil {
+			monitor.router.Close()
+			closeCtx, closeCancel := context.WithTimeout(context.Background(), 10*time.Second)
+			monitor.dispatcher.Close(closeCtx)
+			closeCancel()
+		}
+	}()
+
+	var ts *tsnet.Server
+	if c.Tsnet || (c.HTTPAddr != "" && c.HTTPTsnet) {
+		var err error
+		ts, err = c.newTsnetServer(ctx, monitor.logger)
+		if err != nil {
+			return err
+		}
+		defer ts.Close()
+	}
+
+	if c.Tsnet {
+		monitor.logger.Info("Starting embedded tsnet node",
+			"hostname", c.TsnetHostname)
+		if _, err := ts.Up(ctx); err != nil {
+			return fmt.Errorf("start tsnet node: %w", err)
+		}
+		client, err := ts.LocalClient()
+		if err != nil {
+			return err
+		}
+		monitor.client = client
+	}
+
+	if c.API {
+		if c.OAuthClientID == "" {
+			return fmt.Errorf("--api requires --oauth-client-id and --oauth-client-secret")
+		}
+		source := NewAPISource(ctx, c.APIBaseURL, c.Tailnet, c.OAuthClientID, c.OAuthClientSecret,
+			c.APIInterval, time.Duration(c.KeyExpiryDays)*24*time.Hour, monitor.logger)
+		sourceDone = make(chan struct{})
+		go func() {
+			defer close(sourceDone)
+			source.Run(ctx, monitor.emit)
+		}()
+	}
+
+	if c.HTTPAddr != "" {
+		var (
+			ln  net.Listener
+			err error
+		)
+		if c.HTTPTsnet {
+			ln, err = ts.Listen("tcp", c.HTTPAddr)
+		} else {
+			ln, err = net.Listen("tcp", c.HTTPAddr)
+		}
+		if err != nil {
+			return fmt.Errorf("listen on %s: %w", c.HTTPAddr, err)
+		}
+		go monitor.serveHTTP(ctx, ln)
+	}
+
+	if err := monitor.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return err
 	}
+	return nil
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const metricsNamespace = "tailscale_notifier"
+
+// lastSeenBuckets spans a few minutes to a month, in seconds.
+var lastSeenBuckets = []float64{60, 300, 900, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600, 30 * 24 * 3600}
+
+var (
+	peersDesc = prometheus.NewDesc(
+		metricsNamespace+"_peers",
+		"Peers currently in the netmap by OS, tag and online state. Peers with several tags are counted once per tag; untagged peers have tag=\"\".",
+		[]string{"os", "tag", "state"}, nil)
+	lastSeenDesc = prometheus.NewDesc(
+		metricsNamespace+"_peer_last_seen_age_seconds",
+		"Time since offline peers were last seen by the control plane.",
+		nil, nil)
+	backendStateDesc = prometheus.NewDesc(
+		metricsNamespace+"_self_backend_state",
+		"The local backend state; 1 for the current state.",
+		[]string{"state"}, nil)
+	selfOnlineDesc = prometheus.NewDesc(
+		metricsNamespace+"_self_online",
+		"Whether this node is connected to the tailnet.",
+		nil, nil)
+)
+
+// metrics holds the notifier's Prometheus registry. Gauges are computed from
+// the monitor's current snapshot at scrape time so that devices that leave
+// the tailnet do not leave stale series behind.
+type metrics struct {
+	registry    *prometheus.Registry
+	transitions *prometheus.CounterVec
+}
+
+func newMetrics(snapshot func() *Snapshot) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "transitions_total",
+			Help:      "Device transitions observed, by event type.",
+		}, []string{"type"}),
+	}
+	for _, typ := range []EventType{EventAdded, EventRemoved, EventOnline, EventOffline} {
+		m.transitions.WithLabelValues(string(typ))
+	}
+	m.registry.MustRegister(
+		m.transitions,
+		snapshotCollector{snapshot: snapshot, now: time.Now},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *metrics) observe(events []Event) {
+	for _, e := range events {
+		if !e.Self {
+			m.transitions.WithLabelValues(string(e.Type)).Inc()
+		}
+	}
+}
+
+type snapshotCollector struct {
+	snapshot func() *Snapshot
+	now      func() time.Time
+}
+
+func (c snapshotCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- peersDesc
+	ch <- lastSeenDesc
+	ch <- backendStateDesc
+	ch <- selfOnlineDesc
+}
+
+func (c snapshotCollector) Collect(ch chan<- prometheus.Metric) {
+	snap := c.snapshot()
+	if snap == nil {
+		return
+	}
+
+	type peerKey struct{ os, tag, state string }
+	counts := make(map[peerKey]int)
+	buckets := make(map[float64]uint64, len(lastSeenBuckets))
+	var (
+		ageCount uint64
+		ageSum   float64
+	)
+	now := c.now()
+	for _, p := range snap.Peers {
+		state := onlineString(p.Online)
+		tags := p.Tags
+		if len(tags) == 0 {
+			tags = []string{""}
+		}
+		for _, tag := range tags {
+			counts[peerKey{p.OS, tag, state}]++
+		}
+
+		if p.Online || p.LastSeen.IsZero() {
+			continue
+		}
+		age := now.Sub(p.LastSeen).Seconds()
+		ageCount++
+		ageSum += age
+		for _, b := range lastSeenBuckets {
+			if age <= b {
+				buckets[b]++
+			}
+		}
+	}
+
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(peersDesc, prometheus.GaugeValue, float64(n), k.os, k.tag, k.state)
+	}
+	ch <- prometheus.MustNewConstHistogram(lastSeenDesc, ageCount, ageSum, buckets)
+
+	if snap.BackendState != "" {
+		ch <- prometheus.MustNewConstMetric(backendStateDesc, prometheus.GaugeValue, 1, snap.BackendState)
+	}
+	selfOnline := 0.0
+	if snap.SelfOnline() {
+		selfOnline = 1
+	}
+	ch <- prometheus.MustNewConstMetric(selfOnlineDesc, prometheus.GaugeValue, selfOnline)
+}
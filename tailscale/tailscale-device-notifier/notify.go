@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	defaultTemplate      = `{{range .Events}}{{.Summary}}{{"\n"}}{{end}}`
+	defaultTitleTemplate = `{{if eq (len .Events) 1}}{{(index .Events 0).Summary}}{{else}}{{len .Events}} Tailscale device events{{end}}`
+
+	defaultRetries      = 3
+	defaultRetryBackoff = time.Second
+	defaultSinkTimeout  = 10 * time.Second
+
+	// sinkQueueSize bounds how many notifications may wait for a slow sink
+	// before new ones go straight to the dead-letter log.
+	sinkQueueSize = 64
+)
+
+// Notification is what a Notifier delivers, and what sink templates are
+// executed against.
+type Notification struct {
+	Events []Event `json:"events"`
+}
+
+// Summary returns a one-line description of the event.
+func (e Event) Summary() string {
+	name := strings.TrimSuffix(e.Device.DNSName, ".")
+	if name == "" {
+		name = e.Device.HostName
+	}
+	if e.Self {
+		name += " (self)"
+	}
+	switch e.Type {
+	case EventAdded:
+		return fmt.Sprintf("%s joined the tailnet (%s)", name, onlineString(e.Device.Online))
+	case EventRemoved:
+		return fmt.Sprintf("%s was removed from the tailnet", name)
+	case EventOnline:
+		return fmt.Sprintf("%s came online", name)
+	case EventOffline:
+		return fmt.Sprintf("%s went offline", name)
+	case EventIPsChanged:
+		return fmt.Sprintf("%s addresses changed to %s", name, joinAddrs(e.Device.IPs))
+	case EventOSChanged:
+		return fmt.Sprintf("%s OS changed to %s", name, e.Device.OS)
+	case EventKeyExpiring:
+		return fmt.Sprintf("%s's key expires %s", name, e.Device.KeyExpiry.Format(time.DateTime))
+	case EventNeedsAuth:
+		return fmt.Sprintf("%s needs authorization", name)
+	case EventUpdateAvailable:
+		return fmt.Sprintf("%s has a client update available", name)
+	case EventTagsChanged:
+		return fmt.Sprintf("%s tags changed to [%s]", name, strings.Join(e.Device.Tags, ", "))
+	default:
+		return fmt.Sprintf("%s: %s", name, e.Type)
+	}
+}
+
+func joinAddrs(ips []netip.Addr) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// Notifier delivers notifications to one destination.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, n Notification) error
+}
+
+// messageTemplate renders notification text for a sink.
+type messageTemplate struct {
+	tmpl *template.Template
+}
+
+func newMessageTemplate(name, text, fallback string) (*messageTemplate, error) {
+	if text == "" {
+		text = fallback
+	}
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
+		"join": strings.Join,
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse template %s: %w", name, err)
+	}
+	return &messageTemplate{tmpl: tmpl}, nil
+}
+
+func (t *messageTemplate) Render(n Notification) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, n); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// DeadLetterLog records notifications that could not be delivered.
+type DeadLetterLog struct {
+	mu     sync.Mutex
+	path   string
+	logger *log.Logger
+}
+
+type deadLetter struct {
+	Time         time.Time    `json:"time"`
+	Sink         string       `json:"sink"`
+	Error        string       `json:"error"`
+	Notification Notification `json:"notification"`
+}
+
+func (d *DeadLetterLog) Add(sink string, n Notification, cause error) {
+	entry := deadLetter{Time: time.Now(), Sink: sink, Error: cause.Error(), Notification: n}
+
+	if d.path == "" {
+		d.logger.Error("Notification dropped",
+			"sink", sink,
+			"events", len(n.Events),
+			"error", cause)
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		d.logger.Error("Failed to encode dead letter", "sink", sink, "error", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		d.logger.Error("Failed to write dead letter",
+			"sink", sink,
+			"path", d.path,
+			"error", err)
+		return
+	}
+	d.logger.Warn("Notification written to dead-letter log",
+		"sink", sink,
+		"path", d.path,
+		"error", cause)
+}
+
+// sinkWorker delivers notifications to one Notifier in order, retrying with
+// exponential backoff.
+type sinkWorker struct {
+	notifier   Notifier
+	retries    int
+	backoff    time.Duration
+	timeout    time.Duration
+	queue      chan Notification
+	deadLetter *DeadLetterLog
+	logger     *log.Logger
+}
+
+func (w *sinkWorker) run(ctx context.Context) {
+	for n := range w.queue {
+		if err := w.deliver(ctx, n); err != nil {
+			w.deadLetter.Add(w.notifier.Name(), n, err)
+		}
+	}
+}
+
+func (w *sinkWorker) deliver(ctx context.Context, n Notification) error {
+	var err error
+	for attempt := 0; attempt <= w.retries; attempt++ {
+		if attempt > 0 {
+			delay := w.backoff << (attempt - 1)
+			w.logger.Debug("Retrying notification",
+				"sink", w.notifier.Name(),
+				"attempt", attempt+1,
+				"delay", delay,
+				"error", err)
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+			case <-time.After(delay):
+			}
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, w.timeout)
+		err = w.notifier.Notify(attemptCtx, n)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("after %d attempts: %w", w.retries+1, err)
+}
+
+// Dispatcher fans notifications out to every configured sink without
+// blocking the monitor on slow or failing destinations.
+type Dispatcher struct {
+	workers    []*sinkWorker
+	deadLetter *DeadLetterLog
+	wg         sync.WaitGroup
+	cancel     context.CancelFunc
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewDispatcher builds sinks from cfg and starts delivering to them.
+func NewDispatcher(cfg *Config, logger *log.Logger) (*Dispatcher, error) {
+	d := &Dispatcher{
+		deadLetter: &DeadLetterLog{path: cfg.DeadLetter, logger: logger},
+	}
+
+	for _, sc := range cfg.Sinks {
+		notifier, err := newNotifier(sc)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %w", sc.Name, err)
+		}
+		d.workers = append(d.workers, newSinkWorker(notifier, sc, d.deadLetter, logger))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	for _, w := range d.workers {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			w.run(ctx)
+		}()
+	}
+	return d, nil
+}
+
+func newSinkWorker(notifier Notifier, sc SinkConfig, deadLetter *DeadLetterLog, logger *log.Logger) *sinkWorker {
+	w := &sinkWorker{
+		notifier:   notifier,
+		retries:    defaultRetries,
+		backoff:    defaultRetryBackoff,
+		timeout:    defaultSinkTimeout,
+		queue:      make(chan Notification, sinkQueueSize),
+		deadLetter: deadLetter,
+		logger:     logger,
+	}
+	if sc.Retries != nil {
+		w.retries = max(*sc.Retries, 0)
+	}
+	if sc.RetryBackoff > 0 {
+		w.backoff = time.Duration(sc.RetryBackoff)
+	}
+	if sc.Timeout > 0 {
+		w.timeout = time.Duration(sc.Timeout)
+	}
+	return w
+}
+
+// Send queues n for every sink.
+func (d *Dispatcher) Send(n Notification) {
+	d.SendTo(nil, n)
+}
+
+// SendTo queues n for the named sinks, or for every sink if sinks is empty.
+// It does nothing once the dispatcher is closed.
+func (d *Dispatcher) SendTo(sinks []string, n Notification) {
+	if len(n.Events) == 0 {
+		return
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	for _, w := range d.workers {
+		if len(sinks) > 0 && !slices.Contains(sinks, w.notifier.Name()) {
+			continue
+		}
+		select {
+		case w.queue <- n:
+		default:
+			d.deadLetter.Add(w.notifier.Name(), n, fmt.Errorf("queue full"))
+		}
+	}
+}
+
+// Close delivers queued notifications, waiting until ctx is done at most.
+// Anything still in flight after that is abandoned.
+func (d *Dispatcher) Close(ctx context.Context) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	for _, w := range d.workers {
+		close(w.queue)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+	}
+	d.cancel()
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+func testNotification() Notification {
+	return Notification{Events: []Event{{
+		Type:   EventOffline,
+		Time:   testNow,
+		Device: DeviceState{ID: "n1", DNSName: "laptop.example.ts.net.", HostName: "laptop", OS: "linux"},
+		Source: "ipnbus",
+	}}}
+}
+
+func mustNotifier(t *testing.T, sc SinkConfig) Notifier {
+	t.Helper()
+	n, err := newNotifier(sc)
+	if err != nil {
+		t.Fatalf("newNotifier failed: %v", err)
+	}
+	return n
+}
+
+// TestWebhookNotifier tests the signed JSON webhook sink.
+func TestWebhookNotifier(t *testing.T) {
+	const secret = "s3cret"
+	var got webhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := "sha256=" + signBody([]byte(secret), body)
+		if sig := r.Header.Get(SignatureHeader); sig != want {
+			t.Errorf("Expected signature %s, got %s", want, sig)
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("Failed to decode payload: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	n := mustNotifier(t, SinkConfig{Name: "hook", Type: "webhook", URL: server.URL, Secret: secret})
+	if err := n.Notify(context.Background(), testNotification()); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	if got.Text != "laptop.example.ts.net went offline" {
+		t.Errorf("Unexpected text %q", got.Text)
+	}
+	if len(got.Events) != 1 || got.Events[0].Device.ID != "n1" {
+		t.Errorf("Unexpected events %+v", got.Events)
+	}
+}
+
+// TestSlackNotifier tests the Slack sink with a custom template.
+func TestSlackNotifier(t *testing.T) {
+	var got map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer server.Close()
+
+	n := mustNotifier(t, SinkConfig{
+		Name:     "slack",
+		Type:     "slack",
+		URL:      server.URL,
+		Template: `{{range .Events}}:red_circle: *{{.Device.HostName}}* ({{.Device.OS}}) is {{.Type}}{{end}}`,
+	})
+	if err := n.Notify(context.Background(), testNotification()); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if got["text"] != ":red_circle: *laptop* (linux) is offline" {
+		t.Errorf("Unexpected text %q", got["text"])
+	}
+}
+
+// TestNtfyNotifier tests publishing to an ntfy topic.
+func TestNtfyNotifier(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tailnet" {
+			t.Errorf("Expected path /tailnet, got %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer tk_abc" {
+			t.Errorf("Unexpected Authorization %q", got)
+		}
+		if got := r.Header.Get("Priority"); got != "4" {
+			t.Errorf("Unexpected Priority %q", got)
+		}
+		if got := r.Header.Get("Title"); got != "laptop.example.ts.net went offline" {
+			t.Errorf("Unexpected Title %q", got)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "laptop.example.ts.net went offline" {
+			t.Errorf("Unexpected body %q", body)
+		}
+	}))
+	defer server.Close()
+
+	n := mustNotifier(t, SinkConfig{Name: "ntfy", Type: "ntfy", URL: server.URL + "/tailnet", Token: "tk_abc", Priority: 4})
+	if err := n.Notify(context.Background(), testNotification()); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+}
+
+// TestGotifyNotifier tests posting to a Gotify server.
+func TestGotifyNotifier(t *testing.T) {
+	var got map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/message" {
+			t.Errorf("Expected path /message, got %s", r.URL.Path)
+		}
+		if key := r.Header.Get("X-Gotify-Key"); key != "app-token" {
+			t.Errorf("Unexpected X-Gotify-Key %q", key)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer server.Close()
+
+	n := mustNotifier(t, SinkConfig{Name: "gotify", Type: "gotify", URL: server.URL + "/", Token: "app-token", TitleTemplate: "Tailnet alert"})
+	if err := n.Notify(context.Background(), testNotification()); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if got["title"] != "Tailnet alert" || got["message"] != "laptop.example.ts.net went offline" {
+		t.Errorf("Unexpected message %+v", got)
+	}
+}
+
+// smtpStub is a minimal SMTP server that records delivered messages.
+type smtpStub struct {
+	ln   net.Listener
+	msgs chan string
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	s := &smtpStub{ln: ln, msgs: make(chan string, 10)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	reply("220 localhost ESMTP stub")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			s.msgs <- msg.String()
+			reply("250 OK queued")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// TestSMTPNotifier tests sending email through a local SMTP stand-in.
+func TestSMTPNotifier(t *testing.T) {
+	stub := newSMTPStub(t)
+	host, port, _ := net.SplitHostPort(stub.ln.Addr().String())
+
+	var sc SinkConfig
+	if err := json.Unmarshal([]byte(`{
+		"name": "email",
+		"type": "smtp",
+		"title_template": "[tailnet] {{(index .Events 0).Device.HostName}} {{(index .Events 0).Type}}",
+		"smtp": {"host": "`+host+`", "port": `+port+`, "from": "notifier@example.com", "to": ["ops@example.com"]}
+	}`), &sc); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	n := mustNotifier(t, sc)
+	if err := n.Notify(context.Background(), testNotification()); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	select {
+	case msg := <-stub.msgs:
+		if !strings.Contains(msg, "Subject: [tailnet] laptop offline\r\n") {
+			t.Errorf("Expected subject in message, got %q", msg)
+		}
+		if !strings.Contains(msg, "To: ops@example.com\r\n") {
+			t.Errorf("Expected recipient in message, got %q", msg)
+		}
+		if !strings.Contains(msg, "laptop.example.ts.net went offline") {
+			t.Errorf("Expected body in message, got %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for email")
+	}
+}
+
+// TestEncodeSubject tests that subjects can't inject headers.
+func TestEncodeSubject(t *testing.T) {
+	tests := map[string]string{
+		"[tailnet] laptop offline":     "[tailnet] laptop offline",
+		"laptop\r\nBcc: x@example.com": "laptop Bcc: x@example.com",
+		"laptop\rBcc: x@example.com":   "laptop Bcc: x@example.com",
+		"café offline":                 "=?utf-8?q?caf=C3=A9_offline?=",
+	}
+	for in, want := range tests {
+		got := encodeSubject(in)
+		if got != want {
+			t.Errorf("encodeSubject(%q) = %q, want %q", in, got, want)
+		}
+		if strings.ContainsAny(got, "\r\n") {
+			t.Errorf("encodeSubject(%q) contains a line break", in)
+		}
+	}
+}
+
+// TestSMTPNotifierTimeout tests that a hung SMTP server doesn't outlive
+// the notification's context.
+func TestSMTPNotifierTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	closed := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Never greet, and wait for the client to hang up.
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var sc SinkConfig
+	if err := json.Unmarshal([]byte(`{
+		"name": "email",
+		"type": "smtp",
+		"smtp": {"host": "`+host+`", "port": `+port+`, "from": "notifier@example.com", "to": ["ops@example.com"]}
+	}`), &sc); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := mustNotifier(t, sc).Notify(ctx, testNotification()); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to be closed once Notify returned")
+	}
+}
+
+func testDispatcher(t *testing.T, cfg *Config) *Dispatcher {
+	t.Helper()
+	d, err := NewDispatcher(cfg, log.New(io.Discard))
+	if err != nil {
+		t.Fatalf("NewDispatcher failed: %v", err)
+	}
+	return d
+}
+
+// TestDispatcher_Retry tests that transient sink failures are retried.
+func TestDispatcher_Retry(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	d := testDispatcher(t, &Config{
+		DeadLetter: deadLetter,
+		Sinks:      []SinkConfig{{Name: "hook", Type: "webhook", URL: server.URL, RetryBackoff: Duration(time.Millisecond)}},
+	})
+	d.Send(testNotification())
+	d.Close(context.Background())
+
+	if got := calls.Load(); got != 3 {
+		t.Errorf("Expected 3 attempts, got %d", got)
+	}
+	if _, err := os.Stat(deadLetter); !os.IsNotExist(err) {
+		t.Errorf("Expected no dead letters, got err=%v", err)
+	}
+}
+
+// TestDispatcher_DeadLetter tests that notifications are kept after retries are exhausted.
+func TestDispatcher_DeadLetter(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	retries := 1
+	deadLetterPath := filepath.Join(t.TempDir(), "dead.jsonl")
+	d := testDispatcher(t, &Config{
+		DeadLetter: deadLetterPath,
+		Sinks:      []SinkConfig{{Name: "slack", Type: "slack", URL: server.URL, Retries: &retries, RetryBackoff: Duration(time.Millisecond)}},
+	})
+	d.Send(testNotification())
+	d.Close(context.Background())
+
+	if got := calls.Load(); got != 2 {
+		t.Errorf("Expected 2 attempts, got %d", got)
+	}
+
+	data, err := os.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	var entry deadLetter
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("Failed to decode dead letter %q: %v", data, err)
+	}
+	if entry.Sink != "slack" || !strings.Contains(entry.Error, "500") || len(entry.Notification.Events) != 1 {
+		t.Errorf("Unexpected dead letter %+v", entry)
+	}
+}
+
+// TestDispatcher_SendAfterClose tests that sending to a closed dispatcher
+// is dropped rather than panicking.
+func TestDispatcher_SendAfterClose(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer server.Close()
+
+	d := testDispatcher(t, &Config{
+		Sinks: []SinkConfig{{Name: "hook", Type: "webhook", URL: server.URL}},
+	})
+	d.Close(context.Background())
+	d.Send(testNotification())
+	d.Close(context.Background())
+
+	if got := calls.Load(); got != 0 {
+		t.Errorf("Expected no deliveries after Close, got %d", got)
+	}
+}
+
+// TestLoadConfig tests parsing a HuJSON config file.
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifier.hujson")
+	os.WriteFile(path, []byte(`{
+		// Deliver to the on-call channel.
+		"sinks": [
+			{"name": "oncall", "type": "slack", "url": "https://hooks.example.com/x", "timeout": "5s",},
+		],
+	}`), 0o600)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if len(cfg.Sinks) != 1 || cfg.Sinks[0].Name != "oncall" || time.Duration(cfg.Sinks[0].Timeout) != 5*time.Second {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+
+	os.WriteFile(path, []byte(`{"sinks": [{"name": "a", "type": "slack"}, {"name": "a", "type": "slack"}]}`), 0o600)
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("Expected duplicate name error, got %v", err)
+	}
+}
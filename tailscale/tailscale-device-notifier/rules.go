@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"tailscale.com/tailcfg"
+)
+
+// RuleConfig selects events with an expr predicate and routes them to sinks.
+// Rules are evaluated in order and the first match wins.
+type RuleConfig struct {
+	Name string `json:"name"`
+	// When is an expr-lang expression over the fields of ruleEnv, e.g.
+	// `type == "offline" && "tag:server" in tags`. Empty matches every event.
+	When string `json:"when,omitempty"`
+	// Sinks names the sinks to deliver to. Empty means all sinks.
+	Sinks []string `json:"sinks,omitempty"`
+	// Drop discards matching events instead of delivering them.
+	Drop bool `json:"drop,omitempty"`
+	// OfflineAfter holds offline events until the device has been offline
+	// this long. If it comes back first, neither transition is reported.
+	OfflineAfter Duration `json:"offline_after,omitempty"`
+	// Digest coalesces matching events into one notification per window.
+	Digest Duration `json:"digest,omitempty"`
+}
+
+// ruleEnv is the set of fields rule expressions can refer to.
+type ruleEnv struct {
+	Type     string   `expr:"type"`
+	Self     bool     `expr:"self"`
+	ID       string   `expr:"id"`
+	DNSName  string   `expr:"dns_name"`
+	HostName string   `expr:"hostname"`
+	OS       string   `expr:"os"`
+	User     string   `expr:"user"`
+	Tags     []string `expr:"tags"`
+	IPs      []string `expr:"ips"`
+	Online   bool     `expr:"online"`
+	ExitNode bool     `expr:"exit_node"`
+	Shared   bool     `expr:"shared"`
+	Mullvad  bool     `expr:"mullvad"`
+}
+
+func newRuleEnv(e Event) ruleEnv {
+	d := e.Device
+	env := ruleEnv{
+		Type:     string(e.Type),
+		Self:     e.Self,
+		ID:       string(d.ID),
+		DNSName:  d.DNSName,
+		HostName: d.HostName,
+		OS:       d.OS,
+		User:     d.User,
+		Tags:     d.Tags,
+		Online:   d.Online,
+		ExitNode: d.ExitNodeOption,
+		Shared:   d.Shared,
+		Mullvad:  strings.HasSuffix(strings.TrimSuffix(d.DNSName, "."), ".mullvad.ts.net"),
+	}
+	if env.Tags == nil {
+		env.Tags = []string{}
+	}
+	for _, ip := range d.IPs {
+		env.IPs = append(env.IPs, ip.String())
+	}
+	return env
+}
+
+type rule struct {
+	RuleConfig
+	program *vm.Program
+}
+
+func (r *rule) matches(e Event) (bool, error) {
+	if r.program == nil {
+		return true, nil
+	}
+	out, err := expr.Run(r.program, newRuleEnv(e))
+	if err != nil {
+		return false, err
+	}
+	return out.(bool), nil
+}
+
+// heldOffline is an offline event waiting out its rule's OfflineAfter.
+type heldOffline struct {
+	timer *time.Timer
+}
+
+type digest struct {
+	events []Event
+	timer  *time.Timer
+}
+
+// Router applies rules to events, holding back flapping devices and
+// coalescing digests, and hands the result to send.
+type Router struct {
+	mu      sync.Mutex
+	rules   []*rule
+	send    func(sinks []string, n Notification)
+	held    map[tailcfg.StableNodeID]*heldOffline
+	digests map[*rule]*digest
+	logger  *log.Logger
+	// closed is set by Close, after which nothing more is sent.
+	closed bool
+}
+
+// NewRouter compiles rules. sinks lists the configured sink names, which
+// rules may refer to. With no rules, every event goes to every sink.
+func NewRouter(rules []RuleConfig, sinks []string, send func([]string, Notification), logger *log.Logger) (*Router, error) {
+	known := make(map[string]bool, len(sinks))
+	for _, name := range sinks {
+		known[name] = true
+	}
+
+	r := &Router{
+		send:    send,
+		held:    make(map[tailcfg.StableNodeID]*heldOffline),
+		digests: make(map[*rule]*digest),
+		logger:  logger,
+	}
+	for i, rc := range rules {
+		if rc.Name == "" {
+			rc.Name = fmt.Sprintf("rule-%d", i)
+		}
+		for _, s := range rc.Sinks {
+			if !known[s] {
+				return nil, fmt.Errorf("rule %q: unknown sink %q", rc.Name, s)
+			}
+		}
+		compiled := &rule{RuleConfig: rc}
+		if rc.When != "" {
+			program, err := expr.Compile(rc.When, expr.Env(ruleEnv{}), expr.AsBool())
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rc.Name, err)
+			}
+			compiled.program = program
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	if len(r.rules) == 0 {
+		r.rules = []*rule{{RuleConfig: RuleConfig{Name: "default"}}}
+	}
+	return r, nil
+}
+
+func (r *Router) match(e Event) *rule {
+	for _, rl := range r.rules {
+		ok, err := rl.matches(e)
+		if err != nil {
+			r.logger.Error("Rule evaluation failed",
+				"rule", rl.Name,
+				"error", err)
+			continue
+		}
+		if ok {
+			return rl
+		}
+	}
+	return nil
+}
+
+// Handle routes one batch of events from the monitor.
+func (r *Router) Handle(events []Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+
+	var order []*rule
+	immediate := make(map[*rule][]Event)
+
+	for _, e := range events {
+		// A device coming back or leaving cancels a held offline event. If
+		// it came back, the flap is suppressed entirely.
+		if held, ok := r.held[e.Device.ID]; ok && !e.Self && (e.Type == EventOnline || e.Type == EventRemoved) {
+			held.timer.Stop()
+			delete(r.held, e.Device.ID)
+			if e.Type == EventOnline {
+				r.logger.Debug("Suppressed flapping device",
+					"dns_name", e.Device.DNSName)
+				continue
+			}
+		}
+
+		rl := r.match(e)
+		if rl == nil || rl.Drop {
+			r.logger.Debug("Event not routed",
+				"type", e.Type,
+				"dns_name", e.Device.DNSName)
+			continue
+		}
+
+		if e.Type == EventOffline && rl.OfflineAfter > 0 && !e.Self {
+			r.hold(rl, e)
+			continue
+		}
+
+		if rl.Digest > 0 {
+			r.addToDigest(rl, e)
+			continue
+		}
+
+		if _, ok := immediate[rl]; !ok {
+			order = append(order, rl)
+		}
+		immediate[rl] = append(immediate[rl], e)
+	}
+
+	for _, rl := range order {
+		r.send(rl.Sinks, Notification{Events: immediate[rl]})
+	}
+}
+
+// hold delays e until its rule's OfflineAfter has passed. Must be called
+// with r.mu held.
+func (r *Router) hold(rl *rule, e Event) {
+	if _, ok := r.held[e.Device.ID]; ok {
+		return
+	}
+	held := &heldOffline{}
+	held.timer = time.AfterFunc(time.Duration(rl.OfflineAfter), func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.closed || r.held[e.Device.ID] != held {
+			return
+		}
+		delete(r.held, e.Device.ID)
+		if rl.Digest > 0 {
+			r.addToDigest(rl, e)
+			return
+		}
+		r.send(rl.Sinks, Notification{Events: []Event{e}})
+	})
+	r.held[e.Device.ID] = held
+}
+
+// addToDigest queues e in rl's current digest, starting a new window if
+// there is none. Must be called with r.mu held.
+func (r *Router) addToDigest(rl *rule, e Event) {
+	d, ok := r.digests[rl]
+	if !ok {
+		d = &digest{}
+		r.digests[rl] = d
+		d.timer = time.AfterFunc(time.Duration(rl.Digest), func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.closed || r.digests[rl] != d {
+				return
+			}
+			r.flushDigest(rl)
+		})
+	}
+	d.events = append(d.events, e)
+}
+
+// flushDigest sends rl's pending digest. Must be called with r.mu held.
+func (r *Router) flushDigest(rl *rule) {
+	d, ok := r.digests[rl]
+	if !ok {
+		return
+	}
+	delete(r.digests, rl)
+	r.send(rl.Sinks, Notification{Events: d.events})
+}
+
+// Close sends any open digests and drops held offline events, since those
+// devices have not been offline long enough to report. Nothing is sent
+// after Close returns.
+func (r *Router) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	for id, held := range r.held {
+		held.timer.Stop()
+		delete(r.held, id)
+	}
+	for rl, d := range r.digests {
+		d.timer.Stop()
+		r.flushDigest(rl)
+	}
+	r.closed = true
+}
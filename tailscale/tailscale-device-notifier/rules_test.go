@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"tailscale.com/tailcfg"
+)
+
+// sent records what a Router hands to the dispatcher.
+type sent struct {
+	mu    sync.Mutex
+	calls []sentCall
+}
+
+type sentCall struct {
+	sinks []string
+	n     Notification
+}
+
+func (s *sent) send(sinks []string, n Notification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, sentCall{sinks: sinks, n: n})
+}
+
+func (s *sent) get() []sentCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.calls)
+}
+
+func testRouter(t *testing.T, rules []RuleConfig) (*Router, *sent) {
+	t.Helper()
+	s := &sent{}
+	r, err := NewRouter(rules, []string{"slack", "email", "phone"}, s.send, log.New(io.Discard))
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	t.Cleanup(r.Close)
+	return r, s
+}
+
+func testEvent(typ EventType, id tailcfg.StableNodeID, dnsName string, tags ...string) Event {
+	return Event{
+		Type: typ,
+		Time: testNow,
+		Device: DeviceState{
+			ID:      id,
+			DNSName: dnsName,
+			OS:      "linux",
+			Tags:    tags,
+			IPs:     []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+		},
+	}
+}
+
+// TestNewRouter_Invalid tests that bad expressions and unknown sinks are rejected.
+func TestNewRouter_Invalid(t *testing.T) {
+	cases := []RuleConfig{
+		{Name: "syntax", When: `type ==`},
+		{Name: "not-bool", When: `hostname`},
+		{Name: "unknown-field", When: `colour == "red"`},
+		{Name: "unknown-sink", Sinks: []string{"pager"}},
+	}
+	for _, rc := range cases {
+		if _, err := NewRouter([]RuleConfig{rc}, []string{"slack"}, func([]string, Notification) {}, log.New(io.Discard)); err == nil {
+			t.Errorf("Expected error for rule %q", rc.Name)
+		}
+	}
+}
+
+// TestRouter_Routing tests first-match routing, drop rules and unmatched events.
+func TestRouter_Routing(t *testing.T) {
+	r, s := testRouter(t, []RuleConfig{
+		{Name: "noise", When: `mullvad || shared`, Drop: true},
+		{Name: "servers", When: `"tag:server" in tags`, Sinks: []string{"phone"}},
+		{Name: "linux", When: `os == "linux" && type == "added"`, Sinks: []string{"slack", "email"}},
+	})
+
+	r.Handle([]Event{
+		testEvent(EventAdded, "n1", "se-got-wg-001.mullvad.ts.net."),
+		testEvent(EventOffline, "n2", "db.example.ts.net.", "tag:server"),
+		testEvent(EventAdded, "n3", "laptop.example.ts.net."),
+		testEvent(EventAdded, "n4", "web.example.ts.net.", "tag:server"),
+		testEvent(EventOffline, "n3", "laptop.example.ts.net."),
+	})
+
+	calls := s.get()
+	if len(calls) != 2 {
+		t.Fatalf("Expected 2 notifications, got %d: %+v", len(calls), calls)
+	}
+	if !slices.Equal(calls[0].sinks, []string{"phone"}) || len(calls[0].n.Events) != 2 {
+		t.Errorf("Unexpected servers notification %+v", calls[0])
+	}
+	if !slices.Equal(calls[1].sinks, []string{"slack", "email"}) || len(calls[1].n.Events) != 1 || calls[1].n.Events[0].Device.ID != "n3" {
+		t.Errorf("Unexpected linux notification %+v", calls[1])
+	}
+}
+
+// TestRouter_NoRules tests that every event goes to every sink without rules.
+func TestRouter_NoRules(t *testing.T) {
+	r, s := testRouter(t, nil)
+	r.Handle([]Event{testEvent(EventAdded, "n1", "se-got-wg-001.mullvad.ts.net.")})
+
+	calls := s.get()
+	if len(calls) != 1 || calls[0].sinks != nil {
+		t.Errorf("Expected one notification to all sinks, got %+v", calls)
+	}
+}
+
+// TestRouter_FlapSuppression tests that short offline periods are not reported.
+func TestRouter_FlapSuppression(t *testing.T) {
+	r, s := testRouter(t, []RuleConfig{{Name: "all", OfflineAfter: Duration(50 * time.Millisecond)}})
+
+	// Offline then back within the window: nothing is sent.
+	r.Handle([]Event{testEvent(EventOffline, "n1", "laptop.example.ts.net.")})
+	r.Handle([]Event{testEvent(EventOnline, "n1", "laptop.example.ts.net.")})
+
+	// Offline for longer than the window: one offline notification.
+	r.Handle([]Event{testEvent(EventOffline, "n2", "server.example.ts.net.")})
+	time.Sleep(150 * time.Millisecond)
+
+	calls := s.get()
+	if len(calls) != 1 {
+		t.Fatalf("Expected 1 notification, got %d: %+v", len(calls), calls)
+	}
+	if e := calls[0].n.Events[0]; e.Type != EventOffline || e.Device.ID != "n2" {
+		t.Errorf("Unexpected event %+v", e)
+	}
+}
+
+// TestRouter_Digest tests that bursts of events are coalesced into one notification.
+func TestRouter_Digest(t *testing.T) {
+	r, s := testRouter(t, []RuleConfig{{Name: "all", Sinks: []string{"email"}, Digest: Duration(50 * time.Millisecond)}})
+
+	r.Handle([]Event{testEvent(EventAdded, "n1", "a.example.ts.net.")})
+	r.Handle([]Event{testEvent(EventAdded, "n2", "b.example.ts.net.")})
+	r.Handle([]Event{testEvent(EventRemoved, "n3", "c.example.ts.net.")})
+	if calls := s.get(); len(calls) != 0 {
+		t.Fatalf("Expected no notifications before the digest window ends, got %+v", calls)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	calls := s.get()
+	if len(calls) != 1 || len(calls[0].n.Events) != 3 {
+		t.Fatalf("Expected one digest of 3 events, got %+v", calls)
+	}
+
+	// Close flushes an open digest.
+	r.Handle([]Event{testEvent(EventAdded, "n4", "d.example.ts.net.")})
+	r.Close()
+	if calls := s.get(); len(calls) != 2 {
+		t.Errorf("Expected Close to flush the digest, got %+v", calls)
+	}
+}
+
+// TestRouter_Close tests that nothing is sent once the router is closed.
+func TestRouter_Close(t *testing.T) {
+	r, s := testRouter(t, []RuleConfig{
+		{Name: "offline", When: `type == "offline"`, OfflineAfter: Duration(20 * time.Millisecond), Digest: Duration(20 * time.Millisecond)},
+		{Name: "digest", Digest: Duration(20 * time.Millisecond)},
+	})
+
+	r.Handle([]Event{testEvent(EventOffline, "n1", "laptop.example.ts.net.")})
+	r.Handle([]Event{testEvent(EventAdded, "n2", "a.example.ts.net.")})
+	r.Close()
+	if calls := s.get(); len(calls) != 1 {
+		t.Fatalf("Expected Close to flush the digest, got %+v", calls)
+	}
+
+	r.Handle([]Event{testEvent(EventAdded, "n3", "b.example.ts.net.")})
+	time.Sleep(100 * time.Millisecond)
+	if calls := s.get(); len(calls) != 1 {
+		t.Errorf("Expected nothing sent after Close, got %+v", calls)
+	}
+}
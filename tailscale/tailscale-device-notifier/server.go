@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// devicesResponse is the body of GET /devices.
+type devicesResponse struct {
+	BackendState   string        `json:"backend_state"`
+	MagicDNSSuffix string        `json:"magic_dns_suffix,omitempty"`
+	Self           *DeviceState  `json:"self,omitempty"`
+	Peers          []DeviceState `json:"peers"`
+}
+
+// Handler serves /metrics and /devices.
+func (dm *DeviceMonitor) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(dm.metrics.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /devices", dm.serveDevices)
+	return mux
+}
+
+func (dm *DeviceMonitor) serveDevices(w http.ResponseWriter, r *http.Request) {
+	snap := dm.Snapshot()
+	if snap == nil {
+		http.Error(w, "no device state yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	resp := devicesResponse{
+		BackendState:   snap.BackendState,
+		MagicDNSSuffix: snap.MagicDNSSuffix,
+		Self:           snap.Self,
+		Peers:          make([]DeviceState, 0, len(snap.Peers)),
+	}
+	for _, id := range sortedIDs(snap.Peers) {
+		resp.Peers = append(resp.Peers, snap.Peers[id])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(resp)
+}
+
+// serveHTTP serves the monitor's handler on ln until ctx is done.
+func (dm *DeviceMonitor) serveHTTP(ctx context.Context, ln net.Listener) {
+	srv := &http.Server{
+		Handler:           dm.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	dm.logger.Info("Serving metrics and device status",
+		"addr", ln.Addr())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		dm.logger.Error("HTTP server failed",
+			"error", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"tailscale.com/ipn"
+)
+
+func testHTTPMonitor(t *testing.T) *DeviceMonitor {
+	t.Helper()
+	dm := NewDeviceMonitor(time.Second, true)
+	dm.logger = log.New(io.Discard)
+
+	server := testNode("n2", "server", false)
+	server.Tags = []string{"tag:server", "tag:prod"}
+	dm.update(snapshotFromNetMap(testNetMap(testNode("n1", "laptop", true), testNode("n2", "server", true)), ipn.Running), "ipnbus")
+	dm.update(snapshotFromNetMap(testNetMap(testNode("n1", "laptop", true), server), ipn.Running), "ipnbus")
+	return dm
+}
+
+func get(t *testing.T, h http.Handler, path string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: expected 200, got %d: %s", path, rec.Code, rec.Body)
+	}
+	return rec.Body.String()
+}
+
+// TestHandler_Devices tests the /devices JSON view.
+func TestHandler_Devices(t *testing.T) {
+	dm := testHTTPMonitor(t)
+
+	var got devicesResponse
+	if err := json.Unmarshal([]byte(get(t, dm.Handler(), "/devices")), &got); err != nil {
+		t.Fatalf("Failed to decode /devices: %v", err)
+	}
+	if got.BackendState != "Running" || got.Self == nil {
+		t.Errorf("Unexpected self state %+v", got)
+	}
+	if len(got.Peers) != 2 || got.Peers[0].ID != "n1" || got.Peers[1].Online {
+		t.Errorf("Unexpected peers %+v", got.Peers)
+	}
+}
+
+// TestHandler_DevicesEmpty tests /devices before the first update.
+func TestHandler_DevicesEmpty(t *testing.T) {
+	dm := NewDeviceMonitor(time.Second, true)
+	rec := httptest.NewRecorder()
+	dm.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/devices", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", rec.Code)
+	}
+}
+
+// TestHandler_Metrics tests the Prometheus metrics derived from the snapshot.
+func TestHandler_Metrics(t *testing.T) {
+	dm := testHTTPMonitor(t)
+	body := get(t, dm.Handler(), "/metrics")
+
+	for _, want := range []string{
+		`tailscale_notifier_peers{os="linux",state="online",tag=""} 1`,
+		`tailscale_notifier_peers{os="linux",state="offline",tag="tag:server"} 1`,
+		`tailscale_notifier_peers{os="linux",state="offline",tag="tag:prod"} 1`,
+		`tailscale_notifier_transitions_total{type="offline"} 1`,
+		`tailscale_notifier_transitions_total{type="added"} 0`,
+		`tailscale_notifier_self_backend_state{state="Running"} 1`,
+		`tailscale_notifier_self_online 1`,
+		`tailscale_notifier_peer_last_seen_age_seconds_count 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in metrics", want)
+		}
+	}
+}
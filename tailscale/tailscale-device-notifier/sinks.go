@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the hex HMAC-SHA256 of the webhook body,
+	// keyed with the sink's secret, as "sha256=<hex>".
+	SignatureHeader = "X-Notifier-Signature-256"
+	userAgent       = "tailscale-device-notifier"
+)
+
+func newNotifier(sc SinkConfig) (Notifier, error) {
+	body, err := newMessageTemplate(sc.Name, sc.Template, defaultTemplate)
+	if err != nil {
+		return nil, err
+	}
+	title, err := newMessageTemplate(sc.Name+"-title", sc.TitleTemplate, defaultTitleTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	requireURL := func() error {
+		if sc.URL == "" {
+			return fmt.Errorf("%s sink requires url", sc.Type)
+		}
+		return nil
+	}
+
+	switch sc.Type {
+	case "webhook":
+		if err := requireURL(); err != nil {
+			return nil, err
+		}
+		return &WebhookNotifier{name: sc.Name, url: sc.URL, secret: []byte(sc.Secret), headers: sc.Headers, body: body, client: http.DefaultClient}, nil
+	case "slack":
+		if err := requireURL(); err != nil {
+			return nil, err
+		}
+		return &SlackNotifier{name: sc.Name, url: sc.URL, body: body, client: http.DefaultClient}, nil
+	case "ntfy":
+		if err := requireURL(); err != nil {
+			return nil, err
+		}
+		return &NtfyNotifier{name: sc.Name, url: sc.URL, token: sc.Token, priority: sc.Priority, body: body, title: title, client: http.DefaultClient}, nil
+	case "gotify":
+		if err := requireURL(); err != nil {
+			return nil, err
+		}
+		return &GotifyNotifier{name: sc.Name, url: strings.TrimSuffix(sc.URL, "/"), token: sc.Token, priority: sc.Priority, body: body, title: title, client: http.DefaultClient}, nil
+	case "smtp":
+		if sc.SMTP == nil || sc.SMTP.Host == "" || sc.SMTP.From == "" || len(sc.SMTP.To) == 0 {
+			return nil, fmt.Errorf("smtp sink requires smtp.host, smtp.from and smtp.to")
+		}
+		return &SMTPNotifier{name: sc.Name, cfg: *sc.SMTP, body: body, subject: title}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", sc.Type)
+	}
+}
+
+// postJSON sends v as a JSON POST to url and fails on any non-2xx response.
+func postJSON(ctx context.Context, client *http.Client, url string, v any, headers map[string]string) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return doRequest(client, req)
+}
+
+func doRequest(client *http.Client, req *http.Request) error {
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// WebhookNotifier POSTs the notification as JSON, with the rendered message
+// in "text", signed with HMAC-SHA256 when a secret is configured.
+type WebhookNotifier struct {
+	name    string
+	url     string
+	secret  []byte
+	headers map[string]string
+	body    *messageTemplate
+	client  *http.Client
+}
+
+type webhookPayload struct {
+	Text   string  `json:"text"`
+	Events []Event `json:"events"`
+}
+
+func (w *WebhookNotifier) Name() string { return w.name }
+
+func (w *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	text, err := w.body.Render(n)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(webhookPayload{Text: text, Events: n.Events})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	if len(w.secret) > 0 {
+		req.Header.Set(SignatureHeader, "sha256="+signBody(w.secret, body))
+	}
+	return doRequest(w.client, req)
+}
+
+func signBody(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SlackNotifier posts to a Slack-compatible incoming webhook.
+type SlackNotifier struct {
+	name   string
+	url    string
+	body   *messageTemplate
+	client *http.Client
+}
+
+func (s *SlackNotifier) Name() string { return s.name }
+
+func (s *SlackNotifier) Notify(ctx context.Context, n Notification) error {
+	text, err := s.body.Render(n)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.client, s.url, map[string]string{"text": text}, nil)
+}
+
+// NtfyNotifier publishes to an ntfy topic URL, e.g. https://ntfy.sh/my-topic.
+type NtfyNotifier struct {
+	name     string
+	url      string
+	token    string
+	priority int
+	body     *messageTemplate
+	title    *messageTemplate
+	client   *http.Client
+}
+
+func (s *NtfyNotifier) Name() string { return s.name }
+
+func (s *NtfyNotifier) Notify(ctx context.Context, n Notification) error {
+	text, err := s.body.Render(n)
+	if err != nil {
+		return err
+	}
+	title, err := s.title.Render(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, strings.NewReader(text))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", title)
+	req.Header.Set("Tags", "tailscale")
+	if s.priority > 0 {
+		req.Header.Set("Priority", strconv.Itoa(s.priority))
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	return doRequest(s.client, req)
+}
+
+// GotifyNotifier posts to a Gotify server's /message endpoint.
+type GotifyNotifier struct {
+	name     string
+	url      string
+	token    string
+	priority int
+	body     *messageTemplate
+	title    *messageTemplate
+	client   *http.Client
+}
+
+func (s *GotifyNotifier) Name() string { return s.name }
+
+func (s *GotifyNotifier) Notify(ctx context.Context, n Notification) error {
+	text, err := s.body.Render(n)
+	if err != nil {
+		return err
+	}
+	title, err := s.title.Render(n)
+	if err != nil {
+		return err
+	}
+	msg := map[string]any{"title": title, "message": text}
+	if s.priority > 0 {
+		msg["priority"] = s.priority
+	}
+	return postJSON(ctx, s.client, s.url+"/message", msg, map[string]string{"X-Gotify-Key": s.token})
+}
+
+// SMTPNotifier sends the notification as a plain text email. STARTTLS is
+// used whenever the server offers it.
+type SMTPNotifier struct {
+	name    string
+	cfg     SMTPConfig
+	body    *messageTemplate
+	subject *messageTemplate
+}
+
+func (s *SMTPNotifier) Name() string { return s.name }
+
+func (s *SMTPNotifier) Notify(ctx context.Context, n Notification) error {
+	text, err := s.body.Render(n)
+	if err != nil {
+		return err
+	}
+	subject, err := s.subject.Render(n)
+	if err != nil {
+		return err
+	}
+
+	port := s.cfg.Port
+	if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(port))
+
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", encodeSubject(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	if err := sendMail(ctx, addr, s.cfg.Host, auth, s.cfg.From, s.cfg.To, msg.Bytes()); err != nil {
+		// The connection's deadline is ctx's, so it can time out just
+		// before ctx reports being done.
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// encodeSubject folds subject onto one line and Q-encodes anything that
+// isn't printable ASCII, so that device names can't inject headers.
+func encodeSubject(subject string) string {
+	subject = strings.Join(strings.FieldsFunc(subject, func(r rune) bool { return r == '\r' || r == '\n' }), " ")
+	return mime.QEncoding.Encode("utf-8", subject)
+}
+
+// sendMail is smtp.SendMail bounded by ctx. net/smtp has no context
+// support, so the connection is dialled here and given ctx's deadline, and
+// is unblocked if ctx is cancelled first.
+func sendMail(ctx context.Context, addr, host string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"tailscale.com/tailcfg"
+)
+
+var (
+	metaBucket        = []byte("meta")
+	devicesBucket     = []byte("devices")
+	transitionsBucket = []byte("transitions")
+
+	snapshotKey = []byte("snapshot")
+)
+
+// storeLockTimeout is how long to wait for another process (usually the
+// monitor while `history` runs, or the reverse) to release the database.
+const storeLockTimeout = 5 * time.Second
+
+// Store persists device state and transitions in a bbolt database so that
+// restarts do not re-announce known devices and history survives them.
+//
+// bbolt allows a single process to hold the file open, so Store opens it for
+// each transaction rather than for the life of the monitor. That keeps the
+// history command usable while the monitor is running.
+type Store struct {
+	path string
+
+	mu     sync.Mutex // serializes writes with Close
+	closed bool
+}
+
+// errStoreClosed is returned by writes after Close.
+var errStoreClosed = errors.New("state store closed")
+
+// DeviceRecord is what the store knows about one device.
+type DeviceRecord struct {
+	Device    DeviceState `json:"device"`
+	FirstSeen time.Time   `json:"first_seen"`
+	// LastSeen is the last time the device was observed online.
+	LastSeen  time.Time  `json:"last_seen,omitzero"`
+	RemovedAt *time.Time `json:"removed_at,omitempty"`
+}
+
+// Transition is one recorded change in a device's availability. Online is
+// the device's state after the transition.
+type Transition struct {
+	Time   time.Time `json:"time"`
+	Type   EventType `json:"type"`
+	Online bool      `json:"online"`
+}
+
+// OpenStore creates the database at path if needed.
+func OpenStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	err := s.update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metaBucket, devicesBucket, transitionsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open state %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *Store) open(readOnly bool) (*bolt.DB, error) {
+	if readOnly {
+		if _, err := os.Stat(s.path); err != nil {
+			return nil, err
+		}
+	}
+	return bolt.Open(s.path, 0o600, &bolt.Options{Timeout: storeLockTimeout, ReadOnly: readOnly})
+}
+
+func (s *Store) update(fn func(*bolt.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStoreClosed
+	}
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// Close waits for a write in progress and refuses any more, so that
+// nothing is written once the monitor has shut down. Reads still work.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *Store) view(fn func(*bolt.Tx) error) error {
+	db, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// LoadSnapshot returns the last snapshot that was recorded, or nil if there
+// is none.
+func (s *Store) LoadSnapshot() (*Snapshot, error) {
+	var snap *Snapshot
+	err := s.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(metaBucket).Get(snapshotKey)
+		if data == nil {
+			return nil
+		}
+		snap = new(Snapshot)
+		return json.Unmarshal(data, snap)
+	})
+	return snap, err
+}
+
+// Record saves snap as the latest snapshot along with the events that led
+// to it. Devices the store has not seen before are recorded as added.
+func (s *Store) Record(snap *Snapshot, events []Event, now time.Time) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(metaBucket).Put(snapshotKey, data); err != nil {
+			return err
+		}
+
+		devices := tx.Bucket(devicesBucket)
+		var added []Event
+		for id, device := range snap.Peers {
+			rec, err := getRecord(devices, id)
+			if err != nil {
+				return err
+			}
+			if rec == nil {
+				rec = &DeviceRecord{FirstSeen: now}
+				added = append(added, Event{Type: EventAdded, Time: now, Device: device})
+			}
+			rec.Device = device
+			rec.RemovedAt = nil
+			if device.Online {
+				rec.LastSeen = now
+			}
+			if device.LastSeen.After(rec.LastSeen) {
+				rec.LastSeen = device.LastSeen
+			}
+			if err := putJSON(devices, []byte(id), rec); err != nil {
+				return err
+			}
+		}
+
+		for _, e := range events {
+			switch {
+			case e.Self:
+				continue
+			case e.Type == EventAdded && slices.ContainsFunc(added, func(a Event) bool { return a.Device.ID == e.Device.ID }):
+				// Already recorded as first seen above.
+				continue
+			case e.Type == EventRemoved:
+				rec, err := getRecord(devices, e.Device.ID)
+				if err != nil {
+					return err
+				}
+				if rec != nil {
+					removed := e.Time
+					rec.RemovedAt = &removed
+					if err := putJSON(devices, []byte(e.Device.ID), rec); err != nil {
+						return err
+					}
+				}
+			}
+			if err := addTransition(tx, e); err != nil {
+				return err
+			}
+		}
+		for _, e := range added {
+			if err := addTransition(tx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func addTransition(tx *bolt.Tx, e Event) error {
+	b, err := tx.Bucket(transitionsBucket).CreateBucketIfNotExists([]byte(e.Device.ID))
+	if err != nil {
+		return err
+	}
+	t := Transition{Time: e.Time, Type: e.Type, Online: e.Device.Online && e.Type != EventRemoved}
+	return putJSON(b, transitionKey(b, e.Time), t)
+}
+
+// transitionKey orders transitions by time, nudging the key forward if
+// another transition was recorded at the same instant.
+func transitionKey(b *bolt.Bucket, t time.Time) []byte {
+	key := make([]byte, 8)
+	for n := t.UnixNano(); ; n++ {
+		binary.BigEndian.PutUint64(key, uint64(n))
+		if b.Get(key) == nil {
+			return key
+		}
+	}
+}
+
+func getRecord(b *bolt.Bucket, id tailcfg.StableNodeID) (*DeviceRecord, error) {
+	data := b.Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+	var rec DeviceRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("device %s: %w", id, err)
+	}
+	return &rec, nil
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// DeviceHistory is a device's record and every transition recorded for it,
+// oldest first.
+type DeviceHistory struct {
+	Record      DeviceRecord
+	Transitions []Transition
+}
+
+// History returns every device the store has seen.
+func (s *Store) History() ([]DeviceHistory, error) {
+	var out []DeviceHistory
+	err := s.view(func(tx *bolt.Tx) error {
+		transitions := tx.Bucket(transitionsBucket)
+		return tx.Bucket(devicesBucket).ForEach(func(k, v []byte) error {
+			var h DeviceHistory
+			if err := json.Unmarshal(v, &h.Record); err != nil {
+				return fmt.Errorf("device %s: %w", k, err)
+			}
+			if b := transitions.Bucket(k); b != nil {
+				err := b.ForEach(func(_, v []byte) error {
+					var t Transition
+					if err := json.Unmarshal(v, &t); err != nil {
+						return err
+					}
+					h.Transitions = append(h.Transitions, t)
+					return nil
+				})
+				if err != nil {
+					return fmt.Errorf("device %s: %w", k, err)
+				}
+			}
+			out = append(out, h)
+			return nil
+		})
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no state at %s: %w", s.path, err)
+	}
+	return out, err
+}
+
+// Availability returns how long the device was online and how long it was
+// known to the tailnet within [from, to).
+func (h DeviceHistory) Availability(from, to time.Time) (online, observed time.Duration) {
+	known, up := false, false
+	cursor := from
+
+	advance := func(until time.Time) {
+		if until.After(to) {
+			until = to
+		}
+		if !until.After(cursor) {
+			return
+		}
+		if known {
+			observed += until.Sub(cursor)
+			if up {
+				online += until.Sub(cursor)
+			}
+		}
+		cursor = until
+	}
+
+	for _, t := range h.Transitions {
+		advance(t.Time)
+		known = t.Type != EventRemoved
+		up = t.Online
+	}
+	advance(to)
+	return online, observed
+}
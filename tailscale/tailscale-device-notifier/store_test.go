@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"tailscale.com/ipn"
+)
+
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := OpenStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	return s
+}
+
+// testMonitor returns a monitor backed by store that records routed events.
+func testMonitor(t *testing.T, store *Store) (*DeviceMonitor, *sent) {
+	t.Helper()
+	dm := NewDeviceMonitor(time.Second, true)
+	dm.logger = log.New(io.Discard)
+	dm.store = store
+	snap, err := store.LoadSnapshot()
+	if err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	dm.lastSnapshot = snap
+
+	s := &sent{}
+	router, err := NewRouter(nil, nil, s.send, dm.logger)
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	dm.router = router
+	return dm, s
+}
+
+// TestStore_RestartSuppressesAdded tests that a restarted monitor does not
+// re-announce devices it already knew about.
+func TestStore_RestartSuppressesAdded(t *testing.T) {
+	store := testStore(t)
+
+	dm, s := testMonitor(t, store)
+	dm.update(snapshotFromNetMap(testNetMap(testNode("n1", "laptop", true), testNode("n2", "server", true)), ipn.Running), "ipnbus")
+	dm.update(snapshotFromNetMap(testNetMap(testNode("n1", "laptop", true), testNode("n2", "server", false)), ipn.Running), "ipnbus")
+	if calls := s.get(); len(calls) != 1 {
+		t.Fatalf("Expected 1 notification before restart, got %+v", calls)
+	}
+
+	// After a restart, n1 is unchanged, n2 came back while we were down and
+	// n3 is genuinely new.
+	dm, s = testMonitor(t, store)
+	dm.update(snapshotFromNetMap(testNetMap(testNode("n1", "laptop", true), testNode("n2", "server", true), testNode("n3", "phone", true)), ipn.Running), "ipnbus")
+
+	calls := s.get()
+	if len(calls) != 1 {
+		t.Fatalf("Expected 1 notification after restart, got %+v", calls)
+	}
+	var got []string
+	for _, e := range calls[0].n.Events {
+		got = append(got, string(e.Device.ID)+":"+string(e.Type))
+	}
+	if strings.Join(got, ",") != "n2:online,n3:added" {
+		t.Errorf("Unexpected events after restart: %v", got)
+	}
+}
+
+// TestStore_History tests that transitions are recorded per device.
+func TestStore_History(t *testing.T) {
+	store := testStore(t)
+	dm, _ := testMonitor(t, store)
+	dm.update(snapshotFromNetMap(testNetMap(testNode("n1", "laptop", true)), ipn.Running), "ipnbus")
+	dm.update(snapshotFromNetMap(testNetMap(testNode("n1", "laptop", false)), ipn.Running), "ipnbus")
+	dm.update(snapshotFromNetMap(testNetMap(), ipn.Running), "ipnbus")
+
+	history, err := store.History()
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("Expected 1 device, got %d", len(history))
+	}
+	h := history[0]
+	var types []string
+	for _, tr := range h.Transitions {
+		types = append(types, string(tr.Type))
+	}
+	if strings.Join(types, ",") != "added,offline,removed" {
+		t.Errorf("Unexpected transitions %v", types)
+	}
+	if h.Record.RemovedAt == nil {
+		t.Errorf("Expected device to be marked removed")
+	}
+}
+
+// TestStore_Close tests that a closed store refuses writes but can still
+// be read.
+func TestStore_Close(t *testing.T) {
+	store := testStore(t)
+	snap := snapshotFromNetMap(testNetMap(testNode("n1", "laptop", true)), ipn.Running)
+	if err := store.Record(snap, nil, testNow); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := store.Record(snap, nil, testNow); !errors.Is(err, errStoreClosed) {
+		t.Errorf("Expected %v after Close, got %v", errStoreClosed, err)
+	}
+	if got, err := store.LoadSnapshot(); err != nil || got == nil {
+		t.Errorf("Expected the saved snapshot after Close, got %v, %v", got, err)
+	}
+}
+
+// TestAvailability tests availability over a range that starts mid-history.
+func TestAvailability(t *testing.T) {
+	h := DeviceHistory{Transitions: []Transition{
+		{Time: testNow, Type: EventAdded, Online: true},
+		{Time: testNow.Add(2 * time.Hour), Type: EventOffline},
+		{Time: testNow.Add(3 * time.Hour), Type: EventOnline, Online: true},
+		{Time: testNow.Add(5 * time.Hour), Type: EventRemoved},
+	}}
+
+	cases := []struct {
+		from, to         time.Duration
+		online, observed time.Duration
+	}{
+		{0, 6 * time.Hour, 4 * time.Hour, 5 * time.Hour},
+		{time.Hour, 4 * time.Hour, 2 * time.Hour, 3 * time.Hour},
+		{-time.Hour, time.Hour, time.Hour, time.Hour},
+		{6 * time.Hour, 7 * time.Hour, 0, 0},
+	}
+	for _, c := range cases {
+		online, observed := h.Availability(testNow.Add(c.from), testNow.Add(c.to))
+		if online != c.online || observed != c.observed {
+			t.Errorf("Range %v-%v: expected %v/%v, got %v/%v", c.from, c.to, c.online, c.observed, online, observed)
+		}
+	}
+}
+
+// TestPrintHistory tests the history table.
+func TestPrintHistory(t *testing.T) {
+	history := []DeviceHistory{{
+		Record: DeviceRecord{
+			Device:    DeviceState{ID: "n1", DNSName: "laptop.example.ts.net.", OS: "linux", Online: true},
+			FirstSeen: testNow,
+			LastSeen:  testNow.Add(4 * time.Hour),
+		},
+		Transitions: []Transition{
+			{Time: testNow, Type: EventAdded, Online: true},
+			{Time: testNow.Add(time.Hour), Type: EventOffline},
+			{Time: testNow.Add(2 * time.Hour), Type: EventOnline, Online: true},
+		},
+	}}
+
+	var buf bytes.Buffer
+	if err := printHistory(&buf, history, testNow, testNow.Add(4*time.Hour), "laptop", true); err != nil {
+		t.Fatalf("printHistory failed: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{"laptop.example.ts.net", "75.0%", "offline", "online"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in output:\n%s", want, out)
+		}
+	}
+
+	buf.Reset()
+	printHistory(&buf, history, testNow, testNow.Add(4*time.Hour), "server", false)
+	if strings.Contains(buf.String(), "laptop") {
+		t.Errorf("Expected filter to exclude laptop:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/oauth2/clientcredentials"
+	"tailscale.com/client/local"
+	"tailscale.com/tsnet"
+)
+
+// authKeyExpiry is how long minted auth keys stay valid. They are only used
+// for the first login, so this can be short.
+const authKeyExpiry = time.Hour
+
+// newLocalClient returns a LocalAPI client for the host's tailscaled, using
+// socket instead of the platform default if it is set.
+func newLocalClient(socket string) *local.Client {
+	if socket == "" {
+		return &local.Client{}
+	}
+	return &local.Client{Socket: socket, UseSocketOnly: true}
+}
+
+// newTsnetServer returns a tsnet node configured from the run flags. If no
+// auth key is given but an OAuth client is, a tagged auth key is minted for
+// the node's first login. The node is started lazily by its first Listen or
+// Up.
+func (c *runCmd) newTsnetServer(ctx context.Context, logger *log.Logger) (*tsnet.Server, error) {
+	ts := &tsnet.Server{
+		Hostname:  c.TsnetHostname,
+		Dir:       c.TsnetDir,
+		AuthKey:   c.AuthKey,
+		Ephemeral: c.TsnetEphemeral,
+		Logf:      logger.Debugf,
+		UserLogf:  logger.Infof,
+	}
+
+	if ts.AuthKey == "" && c.OAuthClientID != "" && !tsnetLoggedIn(c.TsnetDir) {
+		if len(c.TsnetTags) == 0 {
+			return nil, errors.New("--tsnet-tag is required to mint an auth key with an OAuth client")
+		}
+		key, err := mintAuthKey(ctx, c.APIBaseURL, c.OAuthClientID, c.OAuthClientSecret, c.TsnetTags, c.TsnetEphemeral)
+		if err != nil {
+			return nil, fmt.Errorf("mint auth key: %w", err)
+		}
+		logger.Info("Minted auth key for tsnet node",
+			"tags", c.TsnetTags)
+		ts.AuthKey = key
+	}
+	return ts, nil
+}
+
+// tsnetLoggedIn reports whether the tsnet state dir, dir or tsnet's default
+// if dir is unset, already holds node state, in which case no auth key is
+// needed.
+func tsnetLoggedIn(dir string) bool {
+	dir, err := tsnetStateDir(dir)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(dir, "tailscaled.state"))
+	return err == nil
+}
+
+// tsnetStateDir returns dir, or the directory tsnet.Server uses when Dir is
+// unset: tsnet-<program name> under the user's config directory.
+func tsnetStateDir(dir string) (string, error) {
+	if dir != "" {
+		return dir, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	confDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	prog := strings.TrimSuffix(strings.ToLower(filepath.Base(exe)), ".exe")
+	return filepath.Join(confDir, "tsnet-"+prog), nil
+}
+
+type authKeyRequest struct {
+	Capabilities struct {
+		Devices struct {
+			Create struct {
+				Reusable      bool     `json:"reusable"`
+				Ephemeral     bool     `json:"ephemeral"`
+				Preauthorized bool     `json:"preauthorized"`
+				Tags          []string `json:"tags"`
+			} `json:"create"`
+		} `json:"devices"`
+	} `json:"capabilities"`
+	ExpirySeconds int    `json:"expirySeconds"`
+	Description   string `json:"description"`
+}
+
+// mintAuthKey creates a single-use, preauthorized auth key for tags using
+// an OAuth client with the auth_keys scope.
+func mintAuthKey(ctx context.Context, baseURL, clientID, clientSecret string, tags []string, ephemeral bool) (string, error) {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	oauth := clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     baseURL + "/api/v2/oauth/token",
+	}
+
+	var body authKeyRequest
+	create := &body.Capabilities.Devices.Create
+	create.Ephemeral = ephemeral
+	create.Preauthorized = true
+	create.Tags = tags
+	body.ExpirySeconds = int(authKeyExpiry.Seconds())
+	body.Description = "tailscale-device-notifier"
+
+	buf, err := json.Marshal(&body)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/api/v2/tailnet/-/keys", bytes.NewReader(buf))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := oauth.Client(ctx).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var out struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	if out.Key == "" {
+		return "", errors.New("empty key in response")
+	}
+	return out.Key, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/log"
+)
+
+// fakeKeysAPI stands in for the OAuth token and auth key endpoints.
+func fakeKeysAPI(t *testing.T, got *authKeyRequest) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/oauth/token":
+			id, secret, _ := r.BasicAuth()
+			if id != "client-id" || secret != "client-secret" {
+				http.Error(w, "bad client", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"access_token": "access", "token_type": "Bearer", "expires_in": 3600}`)
+		case "/api/v2/tailnet/-/keys":
+			if auth := r.Header.Get("Authorization"); auth != "Bearer access" {
+				t.Errorf("Expected Bearer access, got %q", auth)
+			}
+			if err := json.NewDecoder(r.Body).Decode(got); err != nil {
+				t.Errorf("Failed to decode request: %v", err)
+			}
+			io.WriteString(w, `{"key": "tskey-auth-minted"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestMintAuthKey tests creating a tagged auth key with an OAuth client.
+func TestMintAuthKey(t *testing.T) {
+	var got authKeyRequest
+	server := fakeKeysAPI(t, &got)
+
+	key, err := mintAuthKey(context.Background(), server.URL+"/", "client-id", "client-secret", []string{"tag:notifier"}, true)
+	if err != nil {
+		t.Fatalf("mintAuthKey failed: %v", err)
+	}
+	if key != "tskey-auth-minted" {
+		t.Errorf("Expected minted key, got %q", key)
+	}
+
+	create := got.Capabilities.Devices.Create
+	if !create.Ephemeral || !create.Preauthorized || create.Reusable || !slices.Equal(create.Tags, []string{"tag:notifier"}) {
+		t.Errorf("Unexpected key capabilities %+v", create)
+	}
+
+	if _, err := mintAuthKey(context.Background(), server.URL, "client-id", "wrong", []string{"tag:notifier"}, false); err == nil {
+		t.Errorf("Expected error with a bad client secret")
+	}
+}
+
+// TestNewTsnetServer tests when an auth key is minted for the tsnet node.
+func TestNewTsnetServer(t *testing.T) {
+	var got authKeyRequest
+	server := fakeKeysAPI(t, &got)
+	logger := log.New(io.Discard)
+
+	c := &runCmd{
+		TsnetHostname:     "notifier",
+		TsnetDir:          t.TempDir(),
+		TsnetTags:         []string{"tag:notifier"},
+		OAuthClientID:     "client-id",
+		OAuthClientSecret: "client-secret",
+		APIBaseURL:        server.URL,
+	}
+	ts, err := c.newTsnetServer(context.Background(), logger)
+	if err != nil {
+		t.Fatalf("newTsnetServer failed: %v", err)
+	}
+	if ts.AuthKey != "tskey-auth-minted" {
+		t.Errorf("Expected a minted auth key, got %q", ts.AuthKey)
+	}
+
+	// A node that has already logged in does not need a new key.
+	os.WriteFile(filepath.Join(c.TsnetDir, "tailscaled.state"), []byte("{}"), 0o600)
+	ts, err = c.newTsnetServer(context.Background(), logger)
+	if err != nil {
+		t.Fatalf("newTsnetServer failed: %v", err)
+	}
+	if ts.AuthKey != "" {
+		t.Errorf("Expected no auth key for a logged in node, got %q", ts.AuthKey)
+	}
+
+	// With no --tsnet-dir, tsnet's default state dir is checked.
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	c.TsnetDir = ""
+	dir, err := tsnetStateDir("")
+	if err != nil {
+		t.Fatalf("tsnetStateDir failed: %v", err)
+	}
+	os.MkdirAll(dir, 0o700)
+	os.WriteFile(filepath.Join(dir, "tailscaled.state"), []byte("{}"), 0o600)
+	ts, err = c.newTsnetServer(context.Background(), logger)
+	if err != nil {
+		t.Fatalf("newTsnetServer failed: %v", err)
+	}
+	if ts.AuthKey != "" {
+		t.Errorf("Expected no auth key for a node logged in to the default dir, got %q", ts.AuthKey)
+	}
+	os.Remove(filepath.Join(dir, "tailscaled.state"))
+
+	c.TsnetTags = nil
+	if _, err := c.newTsnetServer(context.Background(), logger); err == nil || !strings.Contains(err.Error(), "--tsnet-tag") {
+		t.Errorf("Expected missing tag error, got %v", err)
+	}
+}
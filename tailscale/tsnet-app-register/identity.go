@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"slices"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// version is stamped at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3"
+//
+// and otherwise comes from the module's build info.
+var version string
+
+// appVersion returns the version to report in Hostinfo: the stamped
+// version, the module version when built with go install, or the VCS
+// revision of a development build.
+func appVersion() string {
+	if version != "" {
+		return version
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	return versionFromBuildInfo(bi)
+}
+
+func versionFromBuildInfo(bi *debug.BuildInfo) string {
+	if v := bi.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var rev string
+	var dirty bool
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if rev == "" {
+		return "devel"
+	}
+	if len(rev) > 12 {
+		rev = rev[:12]
+	}
+	if dirty {
+		rev += "-dirty"
+	}
+	return "devel-" + rev
+}
+
+// identity is what the node should be reporting to the tailnet. An empty
+// DeviceModel is not checked.
+type identity struct {
+	Hostname    string
+	App         string
+	DeviceModel string
+	Tags        []string
+}
+
+// identityClient is the part of the LocalClient that verifyIdentity uses.
+type identityClient interface {
+	StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error)
+	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+}
+
+// verifyIdentity checks that the node's Hostinfo, as the tailnet sees it
+// in the netmap, carries want, so that the node can be found in the admin
+// console. The netmap can lag a Hostinfo update, so it retries every
+// interval until ctx is done, returning the last mismatch.
+func verifyIdentity(ctx context.Context, lc identityClient, want identity, interval time.Duration) error {
+	for {
+		err := checkIdentity(ctx, lc, want)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+	}
+}
+
+func checkIdentity(ctx context.Context, lc identityClient, want identity) error {
+	st, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		return err
+	}
+	if st.Self == nil || len(st.Self.TailscaleIPs) == 0 {
+		return fmt.Errorf("node has no Tailscale IPs")
+	}
+	if st.Self.HostName != want.Hostname {
+		return fmt.Errorf("node reports hostname %q, want %q", st.Self.HostName, want.Hostname)
+	}
+	var tags []string
+	if st.Self.Tags != nil {
+		tags = st.Self.Tags.AsSlice()
+	}
+	for _, tag := range want.Tags {
+		if !slices.Contains(tags, tag) {
+			return fmt.Errorf("node has tags %v, want %v", tags, want.Tags)
+		}
+	}
+
+	who, err := lc.WhoIs(ctx, st.Self.TailscaleIPs[0].String())
+	if err != nil {
+		return fmt.Errorf("whois self: %w", err)
+	}
+	if who.Node == nil || !who.Node.Hostinfo.Valid() {
+		return fmt.Errorf("no Hostinfo for self in netmap")
+	}
+	hi := who.Node.Hostinfo
+	if hi.App() != want.App {
+		return fmt.Errorf("node reports app %q, want %q", hi.App(), want.App)
+	}
+	if want.DeviceModel != "" && hi.DeviceModel() != want.DeviceModel {
+		return fmt.Errorf("node reports device model %q, want %q", hi.DeviceModel(), want.DeviceModel)
+	}
+	return nil
+}
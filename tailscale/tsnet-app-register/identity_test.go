@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/views"
+)
+
+// TestVersionFromBuildInfo tests picking a version from build info.
+func TestVersionFromBuildInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		bi   debug.BuildInfo
+		want string
+	}{
+		{"module version", debug.BuildInfo{Main: debug.Module{Version: "v1.2.3"}}, "v1.2.3"},
+		{"no vcs", debug.BuildInfo{Main: debug.Module{Version: "(devel)"}}, "devel"},
+		{"vcs", debug.BuildInfo{
+			Main:     debug.Module{Version: "(devel)"},
+			Settings: []debug.BuildSetting{{Key: "vcs.revision", Value: "8eac5271f00dbeefcafe"}, {Key: "vcs.modified", Value: "false"}},
+		}, "devel-8eac5271f00d"},
+		{"dirty vcs", debug.BuildInfo{
+			Settings: []debug.BuildSetting{{Key: "vcs.revision", Value: "8eac527"}, {Key: "vcs.modified", Value: "true"}},
+		}, "devel-8eac527-dirty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := versionFromBuildInfo(&tt.bi); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	version = "v9.9.9"
+	defer func() { version = "" }()
+	if got := appVersion(); got != "v9.9.9" {
+		t.Errorf("Expected the stamped version, got %q", got)
+	}
+}
+
+// fakeIdentityClient reports a node whose Hostinfo tests can change.
+type fakeIdentityClient struct {
+	mu       sync.Mutex
+	hostname string
+	tags     []string
+	hostinfo tailcfg.Hostinfo
+}
+
+func (c *fakeIdentityClient) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tags := views.SliceOf(c.tags)
+	return &ipnstate.Status{Self: &ipnstate.PeerStatus{
+		HostName:     c.hostname,
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+		Tags:         &tags,
+	}}, nil
+}
+
+func (c *fakeIdentityClient) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hi := c.hostinfo
+	return &apitype.WhoIsResponse{Node: &tailcfg.Node{Hostinfo: hi.View()}}, nil
+}
+
+func (c *fakeIdentityClient) setApp(app string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hostinfo.App = app
+}
+
+// TestVerifyIdentity tests checking the identity the tailnet sees.
+func TestVerifyIdentity(t *testing.T) {
+	want := identity{Hostname: "kiosk", App: "an-example-tsnet-app/v1.2.3", DeviceModel: "my-model", Tags: []string{"tag:kiosk"}}
+	newClient := func() *fakeIdentityClient {
+		return &fakeIdentityClient{
+			hostname: "kiosk",
+			tags:     []string{"tag:kiosk"},
+			hostinfo: tailcfg.Hostinfo{App: "an-example-tsnet-app/v1.2.3", DeviceModel: "my-model"},
+		}
+	}
+	lc := newClient()
+	ctx := context.Background()
+	if err := checkIdentity(ctx, lc, want); err != nil {
+		t.Fatalf("checkIdentity failed: %v", err)
+	}
+
+	mismatches := []struct {
+		name string
+		edit func(*fakeIdentityClient)
+		want string
+	}{
+		{"hostname", func(c *fakeIdentityClient) { c.hostname = "example" }, "hostname"},
+		{"tags", func(c *fakeIdentityClient) { c.tags = nil }, "tags"},
+		{"app", func(c *fakeIdentityClient) { c.hostinfo.App = "" }, "app"},
+		{"device model", func(c *fakeIdentityClient) { c.hostinfo.DeviceModel = "other" }, "device model"},
+	}
+	for _, tt := range mismatches {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newClient()
+			tt.edit(c)
+			if err := checkIdentity(ctx, c, want); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected a %s mismatch, got %v", tt.want, err)
+			}
+		})
+	}
+
+	// The netmap catching up is waited for, within the deadline.
+	lc.setApp("")
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		lc.setApp(want.App)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := verifyIdentity(ctx, lc, want, 10*time.Millisecond); err != nil {
+		t.Errorf("Expected the identity to be verified once reported, got %v", err)
+	}
+
+	lc.setApp("")
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := verifyIdentity(ctx, lc, want, 10*time.Millisecond); err == nil || !strings.Contains(err.Error(), "app") {
+		t.Errorf("Expected the app mismatch after the deadline, got %v", err)
+	}
+}
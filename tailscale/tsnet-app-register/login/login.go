@@ -0,0 +1,173 @@
+// Package login brings a tsnet server up on the tailnet, driving interactive
+// login from the IPN bus and showing login URLs through pluggable
+// presenters: a log line, a QR code in the terminal, a local web page, a
+// callback or a webhook.
+package login
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+)
+
+// ErrTimeout is returned when login does not complete within
+// Options.Timeout.
+var ErrTimeout = errors.New("timed out waiting for login")
+
+// Watcher is a stream of IPN bus notifications. *local.IPNBusWatcher
+// implements it.
+type Watcher interface {
+	Next() (ipn.Notify, error)
+	Close() error
+}
+
+// Client is the part of the LocalClient that the login flow uses. Wrap a
+// *local.Client with Local.
+type Client interface {
+	WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (Watcher, error)
+	StartLoginInteractive(ctx context.Context) error
+}
+
+// Local adapts lc to Client.
+func Local(lc *local.Client) Client {
+	return localClient{lc}
+}
+
+type localClient struct {
+	lc *local.Client
+}
+
+func (c localClient) WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (Watcher, error) {
+	w, err := c.lc.WatchIPNBus(ctx, mask)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (c localClient) StartLoginInteractive(ctx context.Context) error {
+	return c.lc.StartLoginInteractive(ctx)
+}
+
+// Options configure the login flow.
+type Options struct {
+	// Presenter shows login URLs and progress. If nil, they are logged.
+	Presenter Presenter
+	// Timeout, if positive, bounds how long to wait for the node to be
+	// running, including any time spent waiting for a user to log in.
+	Timeout time.Duration
+	// Logf logs presenter errors. If nil, log.Printf is used.
+	Logf func(format string, args ...any)
+	// AuthKey reports that the node logs in with an auth key, so Wait
+	// only waits for that login and never starts an interactive one. Up
+	// sets it when the server has an auth key.
+	AuthKey bool
+}
+
+// Up starts s and waits until it is running on the tailnet, starting an
+// interactive login if it needs one and has no auth key.
+func Up(ctx context.Context, s *tsnet.Server, opts Options) (*ipnstate.Status, error) {
+	if hasAuthKey(s) {
+		opts.AuthKey = true
+	}
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	lc, err := s.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	if err := Wait(ctx, Local(lc), opts); err != nil {
+		return nil, err
+	}
+	// The node is running, so this only waits for its addresses.
+	return s.Up(ctx)
+}
+
+// hasAuthKey reports whether s logs in with an auth key, given directly or
+// through the environment variables tsnet reads.
+func hasAuthKey(s *tsnet.Server) bool {
+	return s.AuthKey != "" || os.Getenv("TS_AUTHKEY") != "" || os.Getenv("TS_AUTH_KEY") != ""
+}
+
+// Wait watches the IPN bus until the backend is running. The first time
+// the backend needs a login it starts an interactive one, unless
+// opts.AuthKey is set, and each new login URL is passed to the presenter,
+// as is a need for an admin to approve the machine. Wait returns
+// ErrTimeout if opts.Timeout elapses, and ctx's error if it is done first.
+func Wait(ctx context.Context, c Client, opts Options) error {
+	p := opts.Presenter
+	if p == nil {
+		p = Log{}
+	}
+	logf := opts.Logf
+	if logf == nil {
+		logf = log.Printf
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.Timeout, ErrTimeout)
+		defer cancel()
+	}
+
+	w, err := c.WatchIPNBus(ctx, ipn.NotifyInitialState)
+	if err != nil {
+		return fmt.Errorf("watch ipn bus: %w", err)
+	}
+	defer w.Close()
+
+	var (
+		loginStarted     bool
+		lastURL          string
+		machineAuthShown bool
+	)
+	for {
+		n, err := w.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return fmt.Errorf("watch ipn bus: %w", err)
+		}
+		if n.ErrMessage != nil {
+			return fmt.Errorf("login: %s", *n.ErrMessage)
+		}
+		if n.State != nil {
+			switch *n.State {
+			case ipn.Running:
+				if err := p.Running(ctx); err != nil {
+					logf("login: presenter: %v", err)
+				}
+				return nil
+			case ipn.NeedsLogin:
+				if !loginStarted && !opts.AuthKey {
+					if err := c.StartLoginInteractive(ctx); err != nil {
+						return fmt.Errorf("start login: %w", err)
+					}
+					loginStarted = true
+				}
+			case ipn.NeedsMachineAuth:
+				if !machineAuthShown {
+					if err := p.MachineAuthRequired(ctx); err != nil {
+						logf("login: presenter: %v", err)
+					}
+					machineAuthShown = true
+				}
+			}
+		}
+		if n.BrowseToURL != nil && *n.BrowseToURL != "" && *n.BrowseToURL != lastURL {
+			lastURL = *n.BrowseToURL
+			if err := p.LoginURL(ctx, lastURL); err != nil {
+				logf("login: presenter: %v", err)
+			}
+		}
+	}
+}
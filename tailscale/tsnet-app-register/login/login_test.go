@@ -0,0 +1,335 @@
+package login
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tsnet"
+	"tailscale.com/util/qrcodes"
+)
+
+// fakeClient is a Client whose IPN bus replays the notifications tests
+// send on bus.
+type fakeClient struct {
+	bus chan ipn.Notify
+
+	mu           sync.Mutex
+	logins       int
+	watchOptions ipn.NotifyWatchOpt
+	closed       bool
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{bus: make(chan ipn.Notify, 16)}
+}
+
+func (c *fakeClient) WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (Watcher, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.watchOptions = mask
+	return &fakeWatcher{ctx: ctx, c: c}, nil
+}
+
+func (c *fakeClient) StartLoginInteractive(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logins++
+	return nil
+}
+
+func (c *fakeClient) send(notifies ...ipn.Notify) {
+	for _, n := range notifies {
+		c.bus <- n
+	}
+}
+
+type fakeWatcher struct {
+	ctx context.Context
+	c   *fakeClient
+}
+
+func (w *fakeWatcher) Next() (ipn.Notify, error) {
+	select {
+	case n := <-w.c.bus:
+		return n, nil
+	case <-w.ctx.Done():
+		return ipn.Notify{}, w.ctx.Err()
+	}
+}
+
+func (w *fakeWatcher) Close() error {
+	w.c.mu.Lock()
+	defer w.c.mu.Unlock()
+	w.c.closed = true
+	return nil
+}
+
+func state(s ipn.State) ipn.Notify {
+	return ipn.Notify{State: &s}
+}
+
+func browseTo(url string) ipn.Notify {
+	return ipn.Notify{BrowseToURL: &url}
+}
+
+// recorder is a Presenter that records the steps it is shown.
+type recorder struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+func (r *recorder) add(step string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps = append(r.steps, step)
+	return nil
+}
+
+func (r *recorder) LoginURL(ctx context.Context, url string) error {
+	return r.add("url " + url)
+}
+
+func (r *recorder) MachineAuthRequired(ctx context.Context) error {
+	return r.add("machine auth")
+}
+
+func (r *recorder) Running(ctx context.Context) error {
+	return r.add("running")
+}
+
+// TestWait tests the login state machine.
+func TestWait(t *testing.T) {
+	c := newFakeClient()
+	c.send(
+		state(ipn.NeedsLogin),
+		browseTo("https://login.example.com/a"),
+		state(ipn.NeedsLogin),
+		browseTo("https://login.example.com/a"),
+		browseTo("https://login.example.com/b"),
+		state(ipn.NeedsMachineAuth),
+		state(ipn.NeedsMachineAuth),
+		state(ipn.Starting),
+		state(ipn.Running),
+	)
+	p := &recorder{}
+	if err := Wait(context.Background(), c, Options{Presenter: p}); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+
+	want := []string{"url https://login.example.com/a", "url https://login.example.com/b", "machine auth", "running"}
+	if strings.Join(p.steps, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected steps %q, got %q", want, p.steps)
+	}
+	if c.logins != 1 {
+		t.Errorf("Expected one interactive login, got %d", c.logins)
+	}
+	if c.watchOptions&ipn.NotifyInitialState == 0 {
+		t.Error("Expected to watch with the initial state")
+	}
+	if !c.closed {
+		t.Error("Expected the watcher to be closed")
+	}
+}
+
+// TestWait_AlreadyRunning tests that a logged in node doesn't start a login.
+func TestWait_AlreadyRunning(t *testing.T) {
+	c := newFakeClient()
+	c.send(state(ipn.Running))
+	if err := Wait(context.Background(), c, Options{Presenter: &recorder{}}); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if c.logins != 0 {
+		t.Errorf("Expected no interactive login, got %d", c.logins)
+	}
+}
+
+// TestWait_AuthKey tests that a node logging in with an auth key doesn't
+// start an interactive login while its key is being used.
+func TestWait_AuthKey(t *testing.T) {
+	c := newFakeClient()
+	c.send(state(ipn.NoState), state(ipn.NeedsLogin), state(ipn.Starting), state(ipn.Running))
+	p := &recorder{}
+	if err := Wait(context.Background(), c, Options{Presenter: p, AuthKey: true}); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if c.logins != 0 {
+		t.Errorf("Expected no interactive login, got %d", c.logins)
+	}
+	if strings.Join(p.steps, ",") != "running" {
+		t.Errorf("Expected only running, got %q", p.steps)
+	}
+}
+
+// TestHasAuthKey tests finding an auth key on the server or in the
+// environment.
+func TestHasAuthKey(t *testing.T) {
+	t.Setenv("TS_AUTHKEY", "")
+	t.Setenv("TS_AUTH_KEY", "")
+	if hasAuthKey(&tsnet.Server{}) {
+		t.Error("Expected no auth key")
+	}
+	if !hasAuthKey(&tsnet.Server{AuthKey: "tskey-auth-1"}) {
+		t.Error("Expected the server's auth key")
+	}
+	t.Setenv("TS_AUTH_KEY", "tskey-auth-2")
+	if !hasAuthKey(&tsnet.Server{}) {
+		t.Error("Expected the auth key from the environment")
+	}
+}
+
+// TestWait_Timeout tests giving up when nobody logs in.
+func TestWait_Timeout(t *testing.T) {
+	c := newFakeClient()
+	c.send(state(ipn.NeedsLogin), browseTo("https://login.example.com/a"))
+	err := Wait(context.Background(), c, Options{Presenter: &recorder{}, Timeout: 50 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+}
+
+// TestWait_Cancel tests stopping when the context is canceled.
+func TestWait_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newFakeClient()
+	p := Callbacks{OnLoginURL: func(context.Context, string) error {
+		cancel()
+		return nil
+	}}
+	c.send(state(ipn.NeedsLogin), browseTo("https://login.example.com/a"))
+	if err := Wait(ctx, c, Options{Presenter: p, Timeout: time.Minute}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+// TestWait_Errors tests backend errors and presenter errors.
+func TestWait_Errors(t *testing.T) {
+	c := newFakeClient()
+	msg := "invalid key: unable to validate API key"
+	c.send(ipn.Notify{ErrMessage: &msg})
+	if err := Wait(context.Background(), c, Options{}); err == nil || !strings.Contains(err.Error(), msg) {
+		t.Errorf("Expected the backend error, got %v", err)
+	}
+
+	// A failing presenter is logged and doesn't stop the login.
+	c = newFakeClient()
+	c.send(state(ipn.NeedsLogin), browseTo("https://login.example.com/a"), state(ipn.Running))
+	var logs []string
+	p := Callbacks{OnLoginURL: func(context.Context, string) error { return errors.New("no route to pager") }}
+	logf := func(format string, args ...any) { logs = append(logs, format) }
+	if err := Wait(context.Background(), c, Options{Presenter: p, Logf: logf}); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if len(logs) != 1 {
+		t.Errorf("Expected the presenter error to be logged, got %q", logs)
+	}
+}
+
+// TestQR tests writing the login URL with a QR code.
+func TestQR(t *testing.T) {
+	var buf bytes.Buffer
+	q := QR{W: &buf, Format: qrcodes.FormatASCII}
+	if err := q.LoginURL(context.Background(), "https://login.example.com/a"); err != nil {
+		t.Fatalf("LoginURL failed: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "https://login.example.com/a") {
+		t.Errorf("Expected the URL, got:\n%s", out)
+	}
+	if strings.Count(out, "\n") < 20 {
+		t.Errorf("Expected a QR code, got:\n%s", out)
+	}
+}
+
+// TestPage tests the local login page.
+func TestPage(t *testing.T) {
+	ctx := context.Background()
+	p := &Page{}
+	get := func() string {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Body.String()
+	}
+
+	if body := get(); !strings.Contains(body, "Waiting for a login URL") {
+		t.Errorf("Expected a waiting page, got:\n%s", body)
+	}
+	p.LoginURL(ctx, "https://login.example.com/a?x=1&y=2")
+	if body := get(); !strings.Contains(body, `href="https://login.example.com/a?x=1&amp;y=2"`) {
+		t.Errorf("Expected an escaped login link, got:\n%s", body)
+	}
+	p.MachineAuthRequired(ctx)
+	if body := get(); !strings.Contains(body, "approve") {
+		t.Errorf("Expected a machine approval page, got:\n%s", body)
+	}
+	p.Running(ctx)
+	if body := get(); !strings.Contains(body, "Logged in") || strings.Contains(body, "refresh") {
+		t.Errorf("Expected a final logged in page, got:\n%s", body)
+	}
+}
+
+// TestWebhook tests posting login steps to a webhook.
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var events []WebhookEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad content type", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var ev WebhookEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	h := Webhook{URL: server.URL, Node: "kiosk-1"}
+	if err := h.LoginURL(ctx, "https://login.example.com/a"); err != nil {
+		t.Fatalf("LoginURL failed: %v", err)
+	}
+	if err := h.Running(ctx); err != nil {
+		t.Fatalf("Running failed: %v", err)
+	}
+	if len(events) != 2 || events[0] != (WebhookEvent{Event: "login_url", Node: "kiosk-1", URL: "https://login.example.com/a"}) || events[1].Event != "running" {
+		t.Errorf("Unexpected events %+v", events)
+	}
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	})
+	if err := h.MachineAuthRequired(ctx); err == nil || !strings.Contains(err.Error(), "410") {
+		t.Errorf("Expected an error for a failing webhook, got %v", err)
+	}
+}
+
+// TestMulti tests passing steps to several presenters.
+func TestMulti(t *testing.T) {
+	a, b := &recorder{}, &recorder{}
+	failing := Callbacks{OnRunning: func(context.Context) error { return errors.New("failed") }}
+	m := Multi{a, failing, b}
+	if err := m.LoginURL(context.Background(), "https://login.example.com/a"); err != nil {
+		t.Errorf("LoginURL failed: %v", err)
+	}
+	if err := m.Running(context.Background()); err == nil {
+		t.Error("Expected the failing presenter's error")
+	}
+	if len(a.steps) != 2 || len(b.steps) != 2 {
+		t.Errorf("Expected every presenter to see every step, got %q and %q", a.steps, b.steps)
+	}
+}
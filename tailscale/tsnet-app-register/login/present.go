@@ -0,0 +1,263 @@
+package login
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"tailscale.com/util/qrcodes"
+)
+
+// Presenter shows the progress of a login to whoever has to act on it.
+type Presenter interface {
+	// LoginURL is called with each new URL the user should visit.
+	LoginURL(ctx context.Context, url string) error
+	// MachineAuthRequired is called once if the node is waiting for an
+	// admin to approve it.
+	MachineAuthRequired(ctx context.Context) error
+	// Running is called once the node is running on the tailnet.
+	Running(ctx context.Context) error
+}
+
+// Log is a Presenter that logs each step.
+type Log struct {
+	// Logf logs. If nil, log.Printf is used.
+	Logf func(format string, args ...any)
+}
+
+func (l Log) logf(format string, args ...any) {
+	if l.Logf != nil {
+		l.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (l Log) LoginURL(ctx context.Context, url string) error {
+	l.logf("log in at: %s", url)
+	return nil
+}
+
+func (l Log) MachineAuthRequired(ctx context.Context) error {
+	l.logf("machine approval required in the Tailscale admin console")
+	return nil
+}
+
+func (l Log) Running(ctx context.Context) error {
+	return nil
+}
+
+// QR is a Presenter that writes login URLs to a terminal along with a QR
+// code, for logging in from a phone.
+type QR struct {
+	W io.Writer
+	// Format is how the QR code is drawn. The zero value picks one to
+	// suit W.
+	Format qrcodes.Format
+}
+
+func (q QR) LoginURL(ctx context.Context, url string) error {
+	fmt.Fprintf(q.W, "\nTo log in, visit:\n\n\t%s\n\n", url)
+	format := q.Format
+	if format == "" {
+		format = qrcodes.FormatAuto
+	}
+	_, err := qrcodes.Fprintln(q.W, format, url)
+	return err
+}
+
+func (q QR) MachineAuthRequired(ctx context.Context) error {
+	_, err := fmt.Fprintln(q.W, "Waiting for an admin to approve this machine in the Tailscale admin console.")
+	return err
+}
+
+func (q QR) Running(ctx context.Context) error {
+	return nil
+}
+
+// Callbacks is a Presenter that calls the functions that are set.
+type Callbacks struct {
+	OnLoginURL            func(ctx context.Context, url string) error
+	OnMachineAuthRequired func(ctx context.Context) error
+	OnRunning             func(ctx context.Context) error
+}
+
+func (c Callbacks) LoginURL(ctx context.Context, url string) error {
+	if c.OnLoginURL == nil {
+		return nil
+	}
+	return c.OnLoginURL(ctx, url)
+}
+
+func (c Callbacks) MachineAuthRequired(ctx context.Context) error {
+	if c.OnMachineAuthRequired == nil {
+		return nil
+	}
+	return c.OnMachineAuthRequired(ctx)
+}
+
+func (c Callbacks) Running(ctx context.Context) error {
+	if c.OnRunning == nil {
+		return nil
+	}
+	return c.OnRunning(ctx)
+}
+
+// Page is a Presenter that is also an http.Handler serving a page with the
+// current login URL, for devices whose logs nobody reads. Serve it on a
+// local address only: anyone who can load it can add the device to their
+// tailnet.
+type Page struct {
+	// Logf logs errors rendering the page. If nil, log.Printf is used.
+	Logf func(format string, args ...any)
+
+	mu          sync.Mutex
+	url         string
+	machineAuth bool
+	running     bool
+}
+
+var pageTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Tailscale login</title>
+{{if not .Running}}<meta http-equiv="refresh" content="5">{{end}}
+</head>
+<body>
+{{if .Running}}<p>Logged in to Tailscale.</p>
+{{else if .MachineAuth}}<p>Waiting for an admin to approve this machine in the Tailscale admin console.</p>
+{{else if .URL}}<p><a href="{{.URL}}">Log in to Tailscale</a></p>
+{{else}}<p>Waiting for a login URL&hellip;</p>
+{{end}}</body>
+</html>
+`))
+
+func (p *Page) LoginURL(ctx context.Context, url string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.url = url
+	return nil
+}
+
+func (p *Page) MachineAuthRequired(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.machineAuth = true
+	return nil
+}
+
+func (p *Page) Running(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running = true
+	return nil
+}
+
+func (p *Page) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	data := struct {
+		URL                  string
+		MachineAuth, Running bool
+	}{p.url, p.machineAuth, p.running}
+	p.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := pageTemplate.Execute(&buf, data); err != nil {
+		Log{Logf: p.Logf}.logf("login: page: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// WebhookEvent is the JSON body a Webhook posts.
+type WebhookEvent struct {
+	// Event is "login_url", "machine_auth_required" or "running".
+	Event string `json:"event"`
+	// Node identifies the node logging in, if Webhook.Node is set.
+	Node string `json:"node,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// Webhook is a Presenter that posts each step to a URL as a WebhookEvent,
+// for example to a chat channel's incoming webhook relay.
+type Webhook struct {
+	URL  string
+	Node string
+	// HTTPClient is used for requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+func (h Webhook) post(ctx context.Context, ev WebhookEvent) error {
+	ev.Node = h.Node
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := h.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+func (h Webhook) LoginURL(ctx context.Context, url string) error {
+	return h.post(ctx, WebhookEvent{Event: "login_url", URL: url})
+}
+
+func (h Webhook) MachineAuthRequired(ctx context.Context) error {
+	return h.post(ctx, WebhookEvent{Event: "machine_auth_required"})
+}
+
+func (h Webhook) Running(ctx context.Context) error {
+	return h.post(ctx, WebhookEvent{Event: "running"})
+}
+
+// Multi is a Presenter that passes each step to all of its presenters,
+// returning their errors joined.
+type Multi []Presenter
+
+func (m Multi) LoginURL(ctx context.Context, url string) error {
+	var errs []error
+	for _, p := range m {
+		errs = append(errs, p.LoginURL(ctx, url))
+	}
+	return errors.Join(errs...)
+}
+
+func (m Multi) MachineAuthRequired(ctx context.Context) error {
+	var errs []error
+	for _, p := range m {
+		errs = append(errs, p.MachineAuthRequired(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+func (m Multi) Running(ctx context.Context) error {
+	var errs []error
+	for _, p := range m {
+		errs = append(errs, p.Running(ctx))
+	}
+	return errors.Join(errs...)
+}
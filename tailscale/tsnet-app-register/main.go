@@ -2,87 +2,199 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/alecthomas/kong"
+	"github.com/jaxxstorm/tailscale-examples/tailscale/tsnet-app-register/login"
 	"tailscale.com/hostinfo"
-	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tsnet"
 )
 
+// appLibrary names this app in the default Hostinfo app string.
+const appLibrary = "an-example-tsnet-app"
+
 const (
-	appLibrary = "an-example-tsnet-app"
-	appVersion = "v0.1.0"
+	// verifyTimeout bounds waiting for the netmap to show the node's
+	// Hostinfo.
+	verifyTimeout = 30 * time.Second
+	// shutdownTimeout bounds draining requests on SIGTERM, and then
+	// waiting for the command to exit before it is killed.
+	shutdownTimeout = 10 * time.Second
 )
 
+var CLI struct {
+	Hostname    string   `name:"hostname" help:"Tailscale hostname" default:"example" env:"TS_HOSTNAME"`
+	App         string   `name:"app" help:"App string reported in Hostinfo (default: an-example-tsnet-app/<version>)" env:"TS_APP"`
+	DeviceModel string   `name:"device-model" help:"Device model reported in Hostinfo" default:"my-model" env:"TS_DEVICE_MODEL"`
+	StateDir    string   `name:"state-dir" help:"Directory for the node's state (default: a per-user config directory)" env:"TS_STATE_DIR"`
+	Tags        []string `name:"tags" help:"ACL tags to advertise, e.g. tag:kiosk" env:"TS_TAGS"`
+	AuthKey     string   `name:"auth-key" help:"Tailscale authentication key (optional)" env:"TS_AUTHKEY"`
+
+	Upstream string   `name:"upstream" help:"URL of a local app to serve over the tailnet, e.g. http://127.0.0.1:8080"`
+	Command  []string `arg:"" name:"command" help:"Command to run and serve; unless --upstream is set, it is given a PORT to listen on" optional:"" passthrough:""`
+	Port     int      `name:"port" help:"Tailnet port to serve HTTPS on" default:"443"`
+	Funnel   bool     `name:"funnel" help:"Also serve the app publicly with Tailscale Funnel (port 443, 8443 or 10000)"`
+
+	Version kong.VersionFlag `name:"version" help:"Print the version and exit"`
+}
+
 func main() {
+	kong.Parse(&CLI,
+		kong.Name("tsnet-app-register"),
+		kong.Description("Register an embedded app on a tailnet with its own identity"),
+		kong.UsageOnError(),
+		kong.Vars{"version": appVersion()},
+	)
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run registers the node and serves the app until it is interrupted, the
+// server fails or the command exits. A command it started is stopped on
+// every return.
+func run() error {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	app := CLI.App
+	if app == "" {
+		app = fmt.Sprintf("%s/%s", appLibrary, appVersion())
+	}
+
 	// tsnet reports Package=tsnet on Start; App is the custom identifier for
 	// the embedding application, so set it before the server is started.
-	hostinfo.SetApp(fmt.Sprintf("%s/%s", appLibrary, appVersion))
-	hostinfo.SetDeviceModel("my-model")
+	hostinfo.SetApp(app)
+	if CLI.DeviceModel != "" {
+		hostinfo.SetDeviceModel(CLI.DeviceModel)
+	}
 
 	srv := &tsnet.Server{
-		Hostname: "example",
+		Hostname:      CLI.Hostname,
+		Dir:           CLI.StateDir,
+		AuthKey:       CLI.AuthKey,
+		AdvertiseTags: CLI.Tags,
 	}
 	defer srv.Close()
 
-	status, err := upWithLoginPrompt(ctx, srv)
+	status, err := login.Up(ctx, srv, login.Options{Presenter: login.Log{}})
 	if err != nil {
-		log.Fatalf("starting tsnet server: %v", err)
-	}
-
-	log.Printf("tailnet node is up: %s", status.Self.DNSName)
-	<-ctx.Done()
-}
-
-func upWithLoginPrompt(ctx context.Context, srv *tsnet.Server) (*ipnstate.Status, error) {
-	if err := srv.Start(); err != nil {
-		return nil, err
+		return fmt.Errorf("starting tsnet server: %w", err)
 	}
 
 	lc, err := srv.LocalClient()
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("local client: %w", err)
+	}
+	verifyCtx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+	want := identity{Hostname: CLI.Hostname, App: app, DeviceModel: CLI.DeviceModel, Tags: CLI.Tags}
+	if err := verifyIdentity(verifyCtx, lc, want, time.Second); err != nil {
+		return fmt.Errorf("verifying identity: %w", err)
 	}
 
-	loginStarted := false
-	printedAuthURL := ""
-	machineAuthShown := false
+	log.Printf("tailnet node is up: %s (app %s)", status.Self.DNSName, app)
 
-	for {
-		st, err := lc.StatusWithoutPeers(ctx)
-		if err != nil {
-			return nil, err
+	var upstream *url.URL
+	if CLI.Upstream != "" {
+		if upstream, err = parseUpstream(CLI.Upstream); err != nil {
+			return err
 		}
+	}
 
-		switch st.BackendState {
-		case "Running":
-			return st, nil
-		case "NeedsLogin":
-			if !loginStarted {
-				if err := lc.StartLoginInteractive(ctx); err != nil {
-					return nil, err
-				}
-				loginStarted = true
-			}
-			if st.AuthURL != "" && st.AuthURL != printedAuthURL {
-				log.Printf("log in at: %s", st.AuthURL)
-				printedAuthURL = st.AuthURL
+	// The command is stopped after requests have drained, so it gets a
+	// context of its own.
+	cmdCtx, stopCmd := context.WithCancel(context.Background())
+	defer stopCmd()
+	var (
+		cmdDone chan struct{} // closed once the command has exited
+		cmdErr  error
+	)
+	if len(CLI.Command) > 0 {
+		var port int
+		if upstream == nil {
+			if port, err = freePort(); err != nil {
+				return fmt.Errorf("finding a port for the command: %w", err)
 			}
-		case "NeedsMachineAuth":
-			if !machineAuthShown {
-				log.Printf("machine approval required in the Tailscale admin console")
-				machineAuthShown = true
+			upstream = &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", port)}
+		}
+		cmd, err := startCommand(cmdCtx, CLI.Command, port)
+		if err != nil {
+			return fmt.Errorf("starting command: %w", err)
+		}
+		log.Printf("started %s for %s", strings.Join(CLI.Command, " "), upstream)
+		cmdDone = make(chan struct{})
+		go func() {
+			cmdErr = cmd.Wait()
+			close(cmdDone)
+		}()
+		defer func() {
+			stopCmd()
+			select {
+			case <-cmdDone:
+			case <-time.After(2 * shutdownTimeout):
 			}
+		}()
+	}
+
+	if upstream == nil {
+		// Nothing to serve; just stay registered.
+		<-ctx.Done()
+		return nil
+	}
+
+	addr := fmt.Sprintf(":%d", CLI.Port)
+	var ln net.Listener
+	if CLI.Funnel {
+		ln, err = srv.ListenFunnel("tcp", addr)
+	} else {
+		ln, err = srv.ListenTLS("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	server := &http.Server{
+		Handler:     newProxy(upstream, lc.WhoIs),
+		ConnContext: connContext,
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(ln) }()
+
+	where := "the tailnet"
+	if CLI.Funnel {
+		where = "the tailnet and the internet"
+	}
+	log.Printf("serving %s on %s at https://%s:%d", upstream, where, strings.TrimSuffix(status.Self.DNSName, "."), CLI.Port)
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down")
+	case err := <-errc:
+		runErr = fmt.Errorf("serve: %w", err)
+	case <-cmdDone:
+		if cmdErr != nil {
+			runErr = fmt.Errorf("command exited: %w", cmdErr)
+		} else {
+			log.Println("command exited")
 		}
+	}
 
-		time.Sleep(time.Second)
+	// The command, if any, is stopped once requests have drained.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("shutdown: %v", err)
 	}
+	return runErr
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+)
+
+// identityHeaders are set from the connecting node's identity, using the
+// same names as tailscale serve plus Tailscale-Node-Name. They are always
+// removed from incoming requests so that clients can't forge them.
+var identityHeaders = []string{
+	"Tailscale-User-Login",
+	"Tailscale-User-Name",
+	"Tailscale-User-Profile-Pic",
+	"Tailscale-Node-Name",
+	"Tailscale-Funnel-Request",
+}
+
+// whoIsFunc looks up the tailnet node and user behind a remote address.
+// (*local.Client).WhoIs implements it.
+type whoIsFunc func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+// parseUpstream parses the URL of the app to proxy to.
+func parseUpstream(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %v", s, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream %q: must be an http or https URL", s)
+	}
+	return u, nil
+}
+
+// newProxy returns a reverse proxy to upstream that tells it who is
+// calling. Requests from tailnet nodes carry the node's name and, for
+// nodes owned by a user rather than tagged, the user's login and name.
+// Requests over Funnel come from the internet and only carry
+// Tailscale-Funnel-Request.
+func newProxy(upstream *url.URL, whois whoIsFunc) http.Handler {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(upstream)
+			pr.SetXForwarded()
+			for _, h := range identityHeaders {
+				pr.Out.Header.Del(h)
+			}
+
+			if isFunnel(pr.In.Context()) {
+				pr.Out.Header.Set("Tailscale-Funnel-Request", "?1")
+				return
+			}
+			who, err := whois(pr.In.Context(), pr.In.RemoteAddr)
+			if err != nil || who.Node == nil {
+				return
+			}
+			pr.Out.Header.Set("Tailscale-Node-Name", encHeaderValue(strings.TrimSuffix(who.Node.Name, ".")))
+			if who.Node.IsTagged() || who.UserProfile == nil {
+				return
+			}
+			pr.Out.Header.Set("Tailscale-User-Login", encHeaderValue(who.UserProfile.LoginName))
+			pr.Out.Header.Set("Tailscale-User-Name", encHeaderValue(who.UserProfile.DisplayName))
+			pr.Out.Header.Set("Tailscale-User-Profile-Pic", who.UserProfile.ProfilePicURL)
+		},
+	}
+}
+
+// encHeaderValue makes v safe for a header value, Q-encoding any non-ASCII
+// characters as tailscale serve does. Invalid UTF-8 is dropped.
+func encHeaderValue(v string) string {
+	if !utf8.ValidString(v) {
+		return ""
+	}
+	return mime.QEncoding.Encode("utf-8", v)
+}
+
+type funnelKey struct{}
+
+// connContext records in each connection's context whether it arrived
+// over Funnel, for use as an http.Server's ConnContext.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	_, funnel := c.(*ipn.FunnelConn)
+	return context.WithValue(ctx, funnelKey{}, funnel)
+}
+
+func isFunnel(ctx context.Context) bool {
+	funnel, _ := ctx.Value(funnelKey{}).(bool)
+	return funnel
+}
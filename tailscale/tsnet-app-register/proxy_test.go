@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// TestParseUpstream tests validating the upstream URL.
+func TestParseUpstream(t *testing.T) {
+	if _, err := parseUpstream("http://127.0.0.1:8080"); err != nil {
+		t.Errorf("Expected a valid upstream, got %v", err)
+	}
+	for _, s := range []string{"127.0.0.1:8080", "ftp://127.0.0.1", "http://", "://"} {
+		if _, err := parseUpstream(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+// TestProxy tests passing tailnet identity to the upstream.
+func TestProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range identityHeaders {
+			w.Header().Set("Got-"+h, r.Header.Get(h))
+		}
+		w.Header().Set("Got-Path", r.URL.Path)
+		w.Header().Set("Got-X-Forwarded-Proto", r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer upstream.Close()
+	u, err := parseUpstream(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	whois := func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		switch remoteAddr {
+		case "100.64.0.2:1234":
+			return &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Name: "laptop.tail1234.ts.net."},
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice Ünal", ProfilePicURL: "https://example.com/alice.png"},
+			}, nil
+		case "100.64.0.3:1234":
+			return &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Name: "ci-runner.tail1234.ts.net.", Tags: []string{"tag:ci"}},
+				UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+			}, nil
+		}
+		return nil, errors.New("no match for IP:port")
+	}
+	proxy := newProxy(u, whois)
+
+	serve := func(remoteAddr string, funnel bool) http.Header {
+		req := httptest.NewRequest("GET", "https://app.tail1234.ts.net/status", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Tailscale-User-Login", "mallory@example.com")
+		req = req.WithContext(context.WithValue(req.Context(), funnelKey{}, funnel))
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		return rec.Header()
+	}
+
+	h := serve("100.64.0.2:1234", false)
+	if h.Get("Got-Path") != "/status" || h.Get("Got-X-Forwarded-Proto") != "https" {
+		t.Errorf("Unexpected proxied request: path %q, proto %q", h.Get("Got-Path"), h.Get("Got-X-Forwarded-Proto"))
+	}
+	if got := h.Get("Got-Tailscale-User-Login"); got != "alice@example.com" {
+		t.Errorf("Expected the user's login, got %q", got)
+	}
+	if got := h.Get("Got-Tailscale-User-Name"); got != "=?utf-8?q?Alice_=C3=9Cnal?=" {
+		t.Errorf("Expected a Q-encoded name, got %q", got)
+	}
+	if got := h.Get("Got-Tailscale-Node-Name"); got != "laptop.tail1234.ts.net" {
+		t.Errorf("Expected the node name, got %q", got)
+	}
+
+	h = serve("100.64.0.3:1234", false)
+	if h.Get("Got-Tailscale-User-Login") != "" || h.Get("Got-Tailscale-Node-Name") != "ci-runner.tail1234.ts.net" {
+		t.Errorf("Expected only the node name for a tagged node, got login %q, node %q", h.Get("Got-Tailscale-User-Login"), h.Get("Got-Tailscale-Node-Name"))
+	}
+
+	h = serve("100.64.0.9:1234", false)
+	if h.Get("Got-Tailscale-User-Login") != "" || h.Get("Got-Tailscale-Node-Name") != "" {
+		t.Error("Expected forged identity headers to be removed")
+	}
+
+	h = serve("203.0.113.1:1234", true)
+	if h.Get("Got-Tailscale-Funnel-Request") != "?1" || h.Get("Got-Tailscale-User-Login") != "" {
+		t.Errorf("Expected a funnel request without identity, got %v", h)
+	}
+}
+
+// TestStartCommand tests running the served command with a port, and
+// stopping it.
+func TestStartCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "port")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd, err := startCommand(ctx, []string{"sh", "-c", `echo $PORT > "$0"; exec sleep 30`, out}, port)
+	if err != nil {
+		t.Fatalf("startCommand failed: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := os.ReadFile(out)
+		if strings.TrimSpace(string(b)) == strconv.Itoa(port) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the command to see PORT=%d, got %q", port, b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the command to stop on SIGTERM")
+	}
+}
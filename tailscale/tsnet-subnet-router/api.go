@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// routesRequest is the body of POST, PUT and DELETE /routes.
+type routesRequest struct {
+	Routes []string `json:"routes"`
+}
+
+// routesResponse lists the configured subnet routes.
+type routesResponse struct {
+	Routes []netip.Prefix `json:"routes"`
+	// Withdrawn lists routes that are configured but not advertised
+	// because they are failing health checks.
+	Withdrawn []netip.Prefix `json:"withdrawn,omitempty"`
+	// DomainRoutes lists the routes learned for app connector domains.
+	DomainRoutes []netip.Prefix `json:"domain_routes,omitempty"`
+	ExitNode     bool           `json:"exit_node"`
+}
+
+// apiHandler serves the local route management API:
+//
+//	GET    /routes  list the advertised subnet routes
+//	PUT    /routes  replace them
+//	POST   /routes  add to them
+//	DELETE /routes  remove from them
+//	GET    /counters  forwarded traffic per source peer
+//
+// Changes apply to the routes set by flags and the API. Routes from
+// --routes-file stay advertised alongside them and are changed by editing
+// the file.
+func apiHandler(m *RouteManager, counters *Counters) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /counters", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(counters.Snapshot())
+	})
+	mux.HandleFunc("GET /routes", func(w http.ResponseWriter, r *http.Request) {
+		writeRoutes(w, m)
+	})
+	change := func(apply func(*http.Request, []netip.Prefix) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var req routesRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			routes, err := parseRoutes(req.Routes)
+			if err == nil {
+				err = apply(r, routes)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeRoutes(w, m)
+		}
+	}
+	mux.HandleFunc("PUT /routes", change(func(r *http.Request, routes []netip.Prefix) error {
+		return m.Set(r.Context(), routes)
+	}))
+	mux.HandleFunc("POST /routes", change(func(r *http.Request, routes []netip.Prefix) error {
+		return m.Add(r.Context(), routes...)
+	}))
+	mux.HandleFunc("DELETE /routes", change(func(r *http.Request, routes []netip.Prefix) error {
+		return m.Remove(r.Context(), routes...)
+	}))
+	return mux
+}
+
+func writeRoutes(w http.ResponseWriter, m *RouteManager) {
+	routes := m.Routes()
+	if routes == nil {
+		routes = []netip.Prefix{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routesResponse{
+		Routes:       routes,
+		Withdrawn:    m.Withdrawn(),
+		DomainRoutes: m.DomainRoutes(),
+		ExitNode:     m.exitNode,
+	})
+}
+
+// listenAPI listens on addr, which is either a host:port or, with a unix:
+// prefix, the path of a Unix socket.
+func listenAPI(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		os.Remove(path)
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", localAddr(addr))
+}
+
+// localAddr binds addr to loopback if it has no host, since the local
+// servers are unauthenticated. ":8081" would otherwise listen on every
+// interface; pass "0.0.0.0:8081" to mean that.
+func localAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
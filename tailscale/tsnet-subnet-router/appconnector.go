@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/net/tsaddr"
+)
+
+// dnsExchangeTimeout bounds a single query to the upstream resolver.
+const dnsExchangeTimeout = 5 * time.Second
+
+// Resolver looks up the addresses of a host. *net.Resolver implements it.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// parseDomains normalizes app connector domains. A domain starting with
+// "*." matches any of its subdomains, but not the domain itself.
+func parseDomains(domains []string) ([]string, error) {
+	var out []string
+	for _, d := range domains {
+		name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+		labels := strings.Split(strings.TrimPrefix(name, "*."), ".")
+		if len(labels) < 2 || slices.Contains(labels, "") || strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+			return nil, fmt.Errorf("invalid domain %q", d)
+		}
+		out = append(out, name)
+	}
+	slices.Sort(out)
+	return slices.Compact(out), nil
+}
+
+// matchDomain reports whether name is covered by the domain pattern.
+func matchDomain(pattern, name string) bool {
+	if base, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(name, "."+base)
+	}
+	return name == pattern
+}
+
+// domainAddr records which name an address was learned for, and when it
+// was last seen in an answer.
+type domainAddr struct {
+	name string
+	seen time.Time
+}
+
+// AppConnector advertises /32 and /128 routes for the addresses that a set
+// of domains resolve to, for SaaS endpoints whose addresses change too
+// often to configure as subnets. Names are re-resolved periodically and
+// addresses that have not been seen for maxAge are withdrawn.
+//
+// Wildcard domains can't be resolved directly, so the connector also
+// serves DNS on the node's Tailscale IPs, passing queries to the upstream
+// resolver and learning from the answers for matching names. Point split
+// DNS for the domains at the router to use it.
+type AppConnector struct {
+	domains  []string
+	upstream netip.AddrPort
+	maxAge   time.Duration
+	routes   *RouteManager
+
+	resolver Resolver
+	dialer   net.Dialer
+	now      func() time.Time
+
+	mu sync.Mutex
+	// names are resolved on each refresh. Configured domains map to the
+	// zero time; names discovered through DNS map to when they were last
+	// queried, and are forgotten after maxAge.
+	names map[string]time.Time
+	addrs map[netip.Addr]domainAddr
+}
+
+// NewAppConnector returns a connector for domains, which must have been
+// normalized by parseDomains, that resolves them through upstream and
+// advertises the results through routes.
+func NewAppConnector(domains []string, upstream netip.AddrPort, maxAge time.Duration, routes *RouteManager) *AppConnector {
+	a := &AppConnector{
+		domains:  domains,
+		upstream: upstream,
+		maxAge:   maxAge,
+		routes:   routes,
+		dialer:   net.Dialer{Timeout: dnsExchangeTimeout},
+		now:      time.Now,
+		names:    make(map[string]time.Time),
+		addrs:    make(map[netip.Addr]domainAddr),
+	}
+	a.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return a.dialer.DialContext(ctx, network, upstream.String())
+		},
+	}
+	for _, d := range domains {
+		if !strings.HasPrefix(d, "*.") {
+			a.names[d] = time.Time{}
+		}
+	}
+	return a
+}
+
+// matches reports whether name is covered by any of the domains.
+func (a *AppConnector) matches(name string) bool {
+	return slices.ContainsFunc(a.domains, func(d string) bool { return matchDomain(d, name) })
+}
+
+// Run refreshes the domain routes every interval until ctx is done.
+func (a *AppConnector) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := a.Refresh(ctx); err != nil {
+			log.Printf("app connector: %v", err)
+		}
+	}
+}
+
+// Refresh resolves every known name, ages out names and addresses that have not
+// been seen recently and advertises the result. Names that fail to resolve
+// keep their addresses until they age out.
+func (a *AppConnector) Refresh(ctx context.Context) error {
+	a.mu.Lock()
+	now := a.now()
+	names := make([]string, 0, len(a.names))
+	for name, seen := range a.names {
+		if !seen.IsZero() && now.Sub(seen) > a.maxAge {
+			log.Printf("app connector: forgetting %s", name)
+			delete(a.names, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	a.mu.Unlock()
+	slices.Sort(names)
+
+	for _, name := range names {
+		ctx, cancel := context.WithTimeout(ctx, dnsExchangeTimeout)
+		addrs, err := a.resolver.LookupNetIP(ctx, "ip", name)
+		cancel()
+		if err != nil {
+			log.Printf("app connector: resolve %s: %v", name, err)
+			continue
+		}
+		a.learn(name, addrs, false)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.publishLocked(ctx)
+}
+
+// learn records addrs as current answers for name. Discovered names are
+// added to those resolved on each refresh.
+func (a *AppConnector) learn(name string, addrs []netip.Addr, discovered bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	if discovered {
+		if _, ok := a.names[name]; !ok {
+			log.Printf("app connector: discovered %s", name)
+		}
+		if seen, ok := a.names[name]; !ok || !seen.IsZero() {
+			a.names[name] = now
+		}
+	}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if !publicAddr(addr) {
+			log.Printf("app connector: ignoring %s for %s: not a public address", addr, name)
+			continue
+		}
+		a.addrs[addr] = domainAddr{name: name, seen: now}
+	}
+}
+
+// publicAddr reports whether addr may be advertised as a domain route.
+// Domain routes are forwarded as subnet routes, without the checks that
+// keep exit node users off the router's own network, so an answer that
+// points at a private, loopback, link-local, CGNAT or Tailscale address
+// must not open a route there.
+func publicAddr(addr netip.Addr) bool {
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() &&
+		!tsaddr.CGNATRange().Contains(addr) && !tsaddr.IsTailscaleIP(addr) &&
+		!slices.Contains(metadataAddrs, addr)
+}
+
+// publishLocked forgets stale addresses and advertises a route for each
+// remaining one. It holds a.mu while advertising so that concurrent updates
+// are applied in order.
+func (a *AppConnector) publishLocked(ctx context.Context) error {
+	now := a.now()
+	var routes []netip.Prefix
+	for addr, da := range a.addrs {
+		if now.Sub(da.seen) > a.maxAge {
+			log.Printf("app connector: %s for %s expired", addr, da.name)
+			delete(a.addrs, addr)
+			continue
+		}
+		routes = append(routes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return a.routes.SetDomainRoutes(ctx, routes)
+}
+
+// ServeDNS answers DNS queries on c, a flow from a client over network
+// ("udp" or "tcp"), by passing them to the upstream resolver. Answers for
+// matching names are advertised before they are returned, so the client's
+// first connection is already routed.
+func (a *AppConnector) ServeDNS(c net.Conn, network string) {
+	defer c.Close()
+	for {
+		c.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+		query, err := readDNS(c, network)
+		if err != nil {
+			return
+		}
+		resp, err := a.exchange(network, query)
+		if err != nil {
+			log.Printf("app connector: dns %s %s: %v", network, a.upstream, err)
+			return
+		}
+		a.observe(resp)
+		if err := writeDNS(c, network, resp); err != nil {
+			return
+		}
+	}
+}
+
+// exchange sends query to the upstream resolver and returns its response.
+func (a *AppConnector) exchange(network string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsExchangeTimeout)
+	defer cancel()
+	conn, err := a.dialer.DialContext(ctx, network, a.upstream.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsExchangeTimeout))
+	if err := writeDNS(conn, network, query); err != nil {
+		return nil, err
+	}
+	return readDNS(conn, network)
+}
+
+// observe learns the addresses in a response to a query for a matching
+// name. Addresses reached through CNAMEs are attributed to the queried
+// name.
+func (a *AppConnector) observe(resp []byte) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil || !h.Response || h.RCode != dnsmessage.RCodeSuccess {
+		return
+	}
+	q, err := p.Question()
+	if err != nil {
+		return
+	}
+	name := strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")
+	if !a.matches(name) {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	var addrs []netip.Addr
+	for {
+		rh, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return
+			}
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return
+			}
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return
+			}
+		}
+	}
+	a.learn(name, addrs, true)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.publishLocked(context.Background()); err != nil {
+		log.Printf("app connector: %v", err)
+	}
+}
+
+// readDNS reads one DNS message from c. Over TCP, messages are prefixed
+// with their length.
+func readDNS(c net.Conn, network string) ([]byte, error) {
+	if network == "tcp" {
+		var n uint16
+		if err := binary.Read(c, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		msg := make([]byte, n)
+		_, err := io.ReadFull(c, msg)
+		return msg, err
+	}
+	buf := make([]byte, 64<<10)
+	n, err := c.Read(buf)
+	return buf[:n], err
+}
+
+// writeDNS writes one DNS message to c.
+func writeDNS(c net.Conn, network string, msg []byte) error {
+	if network == "tcp" {
+		msg = append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)
+	}
+	_, err := c.Write(msg)
+	return err
+}
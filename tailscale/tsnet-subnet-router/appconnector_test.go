@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testResolver is an in-process DNS server answering A and AAAA queries
+// over UDP and TCP from a table that tests can change.
+type testResolver struct {
+	addr netip.AddrPort
+
+	mu      sync.Mutex
+	answers map[string][]netip.Addr
+}
+
+func newTestResolver(t *testing.T, answers map[string][]string) *testResolver {
+	t.Helper()
+	r := &testResolver{answers: make(map[string][]netip.Addr)}
+	for name, addrs := range answers {
+		r.set(name, addrs...)
+	}
+
+	// Listen for UDP and TCP on the same port.
+	var pc net.PacketConn
+	var ln net.Listener
+	for range 10 {
+		var err error
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if ln, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+		pc = nil
+	}
+	if pc == nil {
+		t.Fatal("no free port for UDP and TCP")
+	}
+	t.Cleanup(func() { pc.Close(); ln.Close() })
+	r.addr = netip.MustParseAddrPort(pc.LocalAddr().String())
+
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(r.answer(buf[:n]), from)
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					query, err := readDNS(c, "tcp")
+					if err != nil {
+						return
+					}
+					writeDNS(c, "tcp", r.answer(query))
+				}
+			}()
+		}
+	}()
+	return r
+}
+
+func (r *testResolver) set(name string, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.answers[name] = nil
+	for _, a := range addrs {
+		r.answers[name] = append(r.answers[name], netip.MustParseAddr(a))
+	}
+}
+
+func (r *testResolver) answer(query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	r.mu.Lock()
+	addrs, ok := r.answers[strings.TrimSuffix(q.Name.String(), ".")]
+	r.mu.Unlock()
+
+	rcode := dnsmessage.RCodeSuccess
+	if !ok {
+		rcode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RecursionDesired: h.RecursionDesired, RecursionAvailable: true, RCode: rcode})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	for _, a := range addrs {
+		switch {
+		case q.Type == dnsmessage.TypeA && a.Is4():
+			b.AResource(rh, dnsmessage.AResource{A: a.As4()})
+		case q.Type == dnsmessage.TypeAAAA && a.Is6():
+			b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: a.As16()})
+		}
+	}
+	msg, _ := b.Finish()
+	return msg
+}
+
+// testClock is a settable clock for aging out routes.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestAppConnector(t *testing.T, r *testResolver, domains ...string) (*AppConnector, *fakePrefs, *testClock) {
+	t.Helper()
+	domains, err := parseDomains(domains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs := &fakePrefs{}
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a := NewAppConnector(domains, r.addr, time.Hour, NewRouteManager(prefs, false))
+	a.now = clock.Now
+	return a, prefs, clock
+}
+
+// query sends a DNS query for name over c and returns the addresses in
+// the response.
+func query(t *testing.T, c net.Conn, network, name string) []netip.Addr {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name + "."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	msg, _ := b.Finish()
+	if err := writeDNS(c, network, msg); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := readDNS(c, network)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+
+	var p dnsmessage.Parser
+	if _, err := p.Start(resp); err != nil {
+		t.Fatalf("parse response: %v", err)
+	}
+	p.SkipAllQuestions()
+	answers, err := p.AllAnswers()
+	if err != nil {
+		t.Fatalf("parse answers: %v", err)
+	}
+	var addrs []netip.Addr
+	for _, a := range answers {
+		if r, ok := a.Body.(*dnsmessage.AResource); ok {
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+		}
+	}
+	return addrs
+}
+
+// TestParseDomains tests normalizing app connector domains.
+func TestParseDomains(t *testing.T) {
+	got, err := parseDomains([]string{"Example.COM.", "*.example.net", "example.com"})
+	if err != nil {
+		t.Fatalf("parseDomains failed: %v", err)
+	}
+	if strings.Join(got, " ") != "*.example.net example.com" {
+		t.Errorf("Unexpected domains %q", got)
+	}
+
+	for _, d := range []string{"", "com", "*.com", "a..example.com", "foo.*.example.com", "*"} {
+		if _, err := parseDomains([]string{d}); err == nil {
+			t.Errorf("Expected %q to be rejected", d)
+		}
+	}
+
+	if !matchDomain("*.example.net", "a.b.example.net") || matchDomain("*.example.net", "example.net") || matchDomain("*.example.net", "badexample.net") {
+		t.Error("Unexpected wildcard matching")
+	}
+}
+
+// TestAppConnector_Refresh tests that resolved addresses are advertised
+// and aged out once they stop appearing in answers.
+func TestAppConnector_Refresh(t *testing.T) {
+	ctx := context.Background()
+	r := newTestResolver(t, map[string][]string{
+		"app.example.com": {"192.0.2.1", "2001:db8::1"},
+	})
+	a, prefs, clock := newTestAppConnector(t, r, "app.example.com")
+
+	if err := a.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got, _ := prefs.get(); got != "192.0.2.1/32, 2001:db8::1/128" {
+		t.Errorf("Expected routes for app.example.com, got %s", got)
+	}
+
+	// A new address is added straight away, but the old one is kept in
+	// case clients still have it cached.
+	r.set("app.example.com", "192.0.2.2", "2001:db8::1")
+	clock.Advance(10 * time.Minute)
+	if err := a.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got, _ := prefs.get(); got != "192.0.2.1/32, 192.0.2.2/32, 2001:db8::1/128" {
+		t.Errorf("Expected old and new routes, got %s", got)
+	}
+
+	clock.Advance(55 * time.Minute)
+	if err := a.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got, _ := prefs.get(); got != "192.0.2.2/32, 2001:db8::1/128" {
+		t.Errorf("Expected the old route to age out, got %s", got)
+	}
+
+	// Resolution failures keep the routes until they age out.
+	r.set("app.example.com")
+	clock.Advance(30 * time.Minute)
+	if err := a.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got, _ := prefs.get(); got != "192.0.2.2/32, 2001:db8::1/128" {
+		t.Errorf("Expected routes to be kept, got %s", got)
+	}
+	clock.Advance(31 * time.Minute)
+	if err := a.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got, _ := prefs.get(); got != "" {
+		t.Errorf("Expected all routes to age out, got %s", got)
+	}
+}
+
+// TestAppConnector_DNSProxy tests discovering wildcard names through the
+// DNS proxy.
+func TestAppConnector_DNSProxy(t *testing.T) {
+	r := newTestResolver(t, map[string][]string{
+		"foo.example.net": {"198.51.100.7"},
+		"bar.example.net": {"198.51.100.8"},
+		"example.org":     {"203.0.113.1"},
+	})
+	a, prefs, clock := newTestAppConnector(t, r, "*.example.net")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go a.ServeDNS(server, "udp")
+
+	if got := query(t, client, "udp", "foo.example.net"); len(got) != 1 || got[0] != netip.MustParseAddr("198.51.100.7") {
+		t.Errorf("Expected the upstream answer, got %v", got)
+	}
+	// The route is advertised before the answer is returned.
+	if got, _ := prefs.get(); got != "198.51.100.7/32" {
+		t.Errorf("Expected a route for foo.example.net, got %s", got)
+	}
+
+	if got := query(t, client, "udp", "example.org"); len(got) != 1 {
+		t.Errorf("Expected the upstream answer, got %v", got)
+	}
+	if got, _ := prefs.get(); got != "198.51.100.7/32" {
+		t.Errorf("Expected no route for example.org, got %s", got)
+	}
+
+	tcpClient, tcpServer := net.Pipe()
+	defer tcpClient.Close()
+	go a.ServeDNS(tcpServer, "tcp")
+	query(t, tcpClient, "tcp", "bar.example.net")
+	if got, _ := prefs.get(); got != "198.51.100.7/32, 198.51.100.8/32" {
+		t.Errorf("Expected a route for bar.example.net, got %s", got)
+	}
+
+	// Discovered names are re-resolved on refresh.
+	r.set("foo.example.net", "198.51.100.9")
+	clock.Advance(2 * time.Hour)
+	if err := a.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got, _ := prefs.get(); got != "" {
+		t.Errorf("Expected names not queried for over an hour to be forgotten, got %s", got)
+	}
+
+	query(t, client, "udp", "foo.example.net")
+	r.set("foo.example.net", "198.51.100.10")
+	clock.Advance(10 * time.Minute)
+	if err := a.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got, _ := prefs.get(); got != "198.51.100.9/32, 198.51.100.10/32" {
+		t.Errorf("Expected the discovered name to be refreshed, got %s", got)
+	}
+}
+
+// TestAppConnector_NonPublicAnswers tests that answers pointing at private,
+// loopback or Tailscale addresses are passed on to the client but never
+// advertised.
+func TestAppConnector_NonPublicAnswers(t *testing.T) {
+	r := newTestResolver(t, map[string][]string{
+		"app.example.com":      {"10.0.0.5", "192.0.2.1"},
+		"local.example.com":    {"127.0.0.1"},
+		"tailnet.example.com":  {"100.101.102.103", "fd7a:115c:a1e0::1"},
+		"metadata.example.com": {"169.254.169.254", "::1", "fd00::1"},
+	})
+	a, prefs, _ := newTestAppConnector(t, r, "*.example.com")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go a.ServeDNS(server, "udp")
+
+	if got := query(t, client, "udp", "local.example.com"); len(got) != 1 || got[0] != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("Expected the upstream answer, got %v", got)
+	}
+	if got, _ := prefs.get(); got != "" {
+		t.Errorf("Expected no route for a loopback answer, got %s", got)
+	}
+	query(t, client, "udp", "app.example.com")
+	if got, _ := prefs.get(); got != "192.0.2.1/32" {
+		t.Errorf("Expected a route only for the public answer, got %s", got)
+	}
+
+	a.learn("tailnet.example.com", mustAddrs(t, "100.101.102.103", "fd7a:115c:a1e0::1"), true)
+	a.learn("metadata.example.com", mustAddrs(t, "169.254.169.254", "::1", "fd00::1", "::ffff:10.0.0.5"), true)
+	if err := a.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if got, _ := prefs.get(); got != "192.0.2.1/32" {
+		t.Errorf("Expected no routes for non-public answers, got %s", got)
+	}
+}
+
+func mustAddrs(t *testing.T, addrs ...string) []netip.Addr {
+	t.Helper()
+	var out []netip.Addr
+	for _, s := range addrs {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, addr)
+	}
+	return out
+}
+
+// TestRouteManager_DomainRoutes tests that domain routes are advertised
+// alongside, and independently of, configured routes.
+func TestRouteManager_DomainRoutes(t *testing.T) {
+	ctx := context.Background()
+	prefs := &fakePrefs{}
+	m := NewRouteManager(prefs, false)
+
+	if err := m.SetDomainRoutes(ctx, mustRoutes(t, "192.0.2.1/32")); err != nil {
+		t.Fatalf("SetDomainRoutes failed: %v", err)
+	}
+	if err := m.Set(ctx, nil); err != nil {
+		t.Errorf("Expected an app connector without subnets to be allowed, got %v", err)
+	}
+	if err := m.Set(ctx, mustRoutes(t, "10.0.0.0/24")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if got, _ := prefs.get(); got != "10.0.0.0/24, 192.0.2.1/32" {
+		t.Errorf("Expected subnet and domain routes, got %s", got)
+	}
+	if got := joinPrefixes(m.Routes()); got != "10.0.0.0/24" {
+		t.Errorf("Expected domain routes to be kept apart, got %s", got)
+	}
+	if err := m.SetDomainRoutes(ctx, nil); err != nil {
+		t.Fatalf("SetDomainRoutes failed: %v", err)
+	}
+	if got, _ := prefs.get(); got != "10.0.0.0/24" {
+		t.Errorf("Expected only the subnet route, got %s", got)
+	}
+}
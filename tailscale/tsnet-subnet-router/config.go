@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/tailscale/hujson"
+)
+
+// Config holds the router's settings. Each one can also be set in the
+// HuJSON file given by --config, keyed by its flag name with dashes
+// replaced by underscores; flags and environment variables take
+// precedence over the file.
+type Config struct {
+	Config kong.ConfigFlag `name:"config" placeholder:"FILE" help:"HuJSON file of settings keyed by flag name, e.g. {\"state_dir\": \"/var/lib/router\", \"routes\": [\"10.0.0.0/24\"]}"`
+
+	Subnets  []string `arg:"" name:"subnets" help:"Subnets to advertise (e.g., 192.168.1.0/24)" optional:""`
+	Routes   []string `name:"routes" help:"Subnets to advertise, in addition to the positional ones"`
+	ExitNode bool     `name:"exit-node" help:"Advertise as an exit node (routes all traffic)" default:"false"`
+	Hostname string   `name:"hostname" help:"Tailscale hostname" default:"tsnet-subnet-router"`
+	AuthKey  string   `name:"auth-key" help:"Tailscale authentication key (optional)" env:"TS_AUTHKEY"`
+
+	StateDir         string   `name:"state-dir" help:"Directory for the node's state (default: a per-user config directory)"`
+	ControlURL       string   `name:"control-url" help:"Coordination server URL (default: Tailscale's)"`
+	Tags             []string `name:"tags" help:"ACL tags to request for the node, e.g. tag:subnet-router"`
+	Ephemeral        bool     `name:"ephemeral" help:"Register as an ephemeral node, removed from the tailnet when it goes offline" negatable:""`
+	SNATSubnetRoutes bool     `name:"snat-subnet-routes" help:"Source NAT traffic to advertised routes" default:"true" negatable:""`
+
+	RoutesFile string `name:"routes-file" help:"File of subnets to advertise, one per line, re-read when it changes"`
+	APIAddr    string `name:"api-addr" help:"Local address for the route API, on loopback unless a host is given, or unix:/path for a Unix socket (empty to disable)" default:"127.0.0.1:9080"`
+	HealthAddr string `name:"health-addr" help:"Local address serving /healthz and /metrics, on loopback unless a host is given (empty to disable)" default:"127.0.0.1:8081"`
+
+	EgressPolicy string `name:"egress-policy" help:"HuJSON file of rules allowing or denying forwarded destinations by CIDR and port"`
+	DNSUpstream  string `name:"dns-upstream" help:"Resolver (ip:port) for DNS sent to the exit node's own address (default: first nameserver in /etc/resolv.conf)"`
+	HealthChecks string `name:"health-checks" help:"HuJSON file of per-route health checks; failing routes are withdrawn until they recover"`
+
+	Domains           []string      `name:"domain" help:"Act as an app connector for a domain, advertising routes to the addresses it resolves to; *.example.com matches its subdomains as they are queried through this node's DNS (repeatable)"`
+	DomainRefresh     time.Duration `name:"domain-refresh" help:"How often app connector domains are re-resolved" default:"5m"`
+	DomainRouteMaxAge time.Duration `name:"domain-route-max-age" help:"Withdraw app connector routes that have not been seen in DNS answers for this long" default:"1h"`
+}
+
+// Validate checks settings that kong can't.
+func (c *Config) Validate() error {
+	for _, tag := range c.Tags {
+		if !strings.HasPrefix(tag, "tag:") {
+			return fmt.Errorf("invalid tag %q: tags must start with tag:", tag)
+		}
+	}
+	return nil
+}
+
+// newParser returns the command line parser for cfg.
+func newParser(cfg *Config) (*kong.Kong, error) {
+	return kong.New(cfg,
+		kong.Name("tsnet-subnet-router"),
+		kong.Description("A Tailscale subnet router using tsnet"),
+		kong.UsageOnError(),
+		kong.Configuration(hujsonResolver),
+	)
+}
+
+// hujsonResolver is a kong configuration loader for JSON files that may
+// contain comments and trailing commas.
+func hujsonResolver(r io.Reader) (kong.Resolver, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = hujson.Standardize(data); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	return kong.JSON(bytes.NewReader(data))
+}
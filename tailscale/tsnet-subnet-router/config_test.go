@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseConfig(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	var cfg Config
+	parser, err := newParser(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parser.Parse(args)
+	return &cfg, err
+}
+
+// TestConfigFile tests loading settings from a HuJSON config file.
+func TestConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.hujson")
+	os.WriteFile(path, []byte(`{
+		// Keys are flag names.
+		"hostname": "office-router",
+		"state_dir": "/var/lib/router",
+		"control_url": "https://headscale.example.com",
+		"tags": ["tag:router", "tag:office"],
+		"ephemeral": true,
+		"routes": ["10.0.0.0/24", "10.0.1.0/24"],
+		"snat_subnet_routes": false,
+		"domain_refresh": "1m",
+	}`), 0o644)
+
+	cfg, err := parseConfig(t, "--config", path)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if cfg.Hostname != "office-router" || cfg.StateDir != "/var/lib/router" || cfg.ControlURL != "https://headscale.example.com" {
+		t.Errorf("Unexpected settings %+v", cfg)
+	}
+	if strings.Join(cfg.Tags, " ") != "tag:router tag:office" || strings.Join(cfg.Routes, " ") != "10.0.0.0/24 10.0.1.0/24" {
+		t.Errorf("Unexpected tags %q or routes %q", cfg.Tags, cfg.Routes)
+	}
+	if !cfg.Ephemeral || cfg.SNATSubnetRoutes || cfg.DomainRefresh != time.Minute {
+		t.Errorf("Unexpected settings %+v", cfg)
+	}
+
+	// Flags override the file.
+	cfg, err = parseConfig(t, "--config", path, "--hostname", "lab-router", "--snat-subnet-routes", "10.2.0.0/24")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if cfg.Hostname != "lab-router" || !cfg.SNATSubnetRoutes || cfg.Subnets[0] != "10.2.0.0/24" || len(cfg.Routes) != 2 {
+		t.Errorf("Expected flags to take precedence, got %+v", cfg)
+	}
+}
+
+// TestConfigDefaults tests the settings used without a config file.
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := parseConfig(t)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if cfg.Ephemeral || !cfg.SNATSubnetRoutes || cfg.HealthAddr != "127.0.0.1:8081" {
+		t.Errorf("Unexpected defaults %+v", cfg)
+	}
+}
+
+// TestConfigValidate tests rejecting invalid settings.
+func TestConfigValidate(t *testing.T) {
+	if _, err := parseConfig(t, "--tags", "router"); err == nil || !strings.Contains(err.Error(), "tag:") {
+		t.Errorf("Expected an error for a tag without the tag: prefix, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "router.hujson")
+	os.WriteFile(path, []byte(`{"hostname": }`), 0o644)
+	if _, err := parseConfig(t, "--config", path); err == nil {
+		t.Error("Expected an error for an invalid config file")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"maps"
+	"net/netip"
+	"sync"
+)
+
+// PeerCounters are the forwarding totals for one tailnet peer.
+type PeerCounters struct {
+	// Sent is bytes from the peer to destinations behind the router.
+	Sent uint64 `json:"bytes_sent"`
+	// Received is bytes from those destinations back to the peer.
+	Received uint64 `json:"bytes_received"`
+	Flows    uint64 `json:"flows"`
+	Denied   uint64 `json:"denied"`
+}
+
+// Counters tracks forwarded traffic per source peer, for auditing what
+// each peer sends through the router.
+type Counters struct {
+	mu    sync.Mutex
+	peers map[netip.Addr]*PeerCounters
+}
+
+// NewCounters returns empty counters.
+func NewCounters() *Counters {
+	return &Counters{peers: make(map[netip.Addr]*PeerCounters)}
+}
+
+func (c *Counters) update(peer netip.Addr, f func(*PeerCounters)) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pc, ok := c.peers[peer]
+	if !ok {
+		pc = &PeerCounters{}
+		c.peers[peer] = pc
+	}
+	f(pc)
+}
+
+// Snapshot returns a copy of the counters.
+func (c *Counters) Snapshot() map[netip.Addr]PeerCounters {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[netip.Addr]PeerCounters, len(c.peers))
+	for peer, pc := range maps.All(c.peers) {
+		out[peer] = *pc
+	}
+	return out
+}
+
+// countingWriter adds the bytes written through it to a peer's counters.
+type countingWriter struct {
+	w        interface{ Write([]byte) (int, error) }
+	counters *Counters
+	peer     netip.Addr
+	sent     bool
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.counters.update(cw.peer, func(pc *PeerCounters) {
+		if cw.sent {
+			pc.Sent += uint64(n)
+		} else {
+			pc.Received += uint64(n)
+		}
+	})
+	return n, err
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tsnet"
+	"tailscale.com/types/nettype"
+	"tailscale.com/wgengine/netstack"
+)
+
+const (
+	// forwardDialTimeout bounds connecting to a host behind the router.
+	forwardDialTimeout = 10 * time.Second
+	// udpIdleTimeout closes a forwarded UDP flow after this long without
+	// traffic in either direction.
+	udpIdleTimeout = 2 * time.Minute
+	// dnsIdleTimeout is the shorter idle timeout for flows to port 53.
+	dnsIdleTimeout = 30 * time.Second
+)
+
+// ForwarderOptions configure which flows a Forwarder handles.
+type ForwarderOptions struct {
+	// Routes returns the subnets currently being advertised.
+	Routes func() []netip.Prefix
+	// ExitNode forwards flows to any non-tailnet destination.
+	ExitNode bool
+	// Policy limits the destinations flows may reach. Nil allows all.
+	Policy *EgressPolicy
+	// Counters, if set, records traffic per source peer.
+	Counters *Counters
+	// DNSUpstream, if valid, receives DNS sent to the router's own
+	// Tailscale IPs, which SelfIPs returns.
+	DNSUpstream netip.AddrPort
+	SelfIPs     func() (ip4, ip6 netip.Addr)
+	// DNSHandler, if set, serves DNS sent to the router's own Tailscale
+	// IPs instead of DNSUpstream. network is "tcp" or "udp".
+	DNSHandler func(c net.Conn, network string)
+}
+
+// Forwarder proxies TCP and UDP flows that arrive on the tsnet netstack for
+// advertised subnets, or anywhere off the tailnet when acting as an exit
+// node, to the real hosts, dialing them from the router's own network
+// stack. This is what makes a tsnet node a working subnet router or exit
+// node without a TUN device or any privileges.
+type Forwarder struct {
+	opts ForwarderOptions
+
+	dialer         net.Dialer
+	udpIdleTimeout time.Duration
+}
+
+// NewForwarder returns a forwarder configured by opts.
+func NewForwarder(opts ForwarderOptions) *Forwarder {
+	return &Forwarder{
+		opts:           opts,
+		dialer:         net.Dialer{Timeout: forwardDialTimeout},
+		udpIdleTimeout: udpIdleTimeout,
+	}
+}
+
+// Install registers f on s's netstack. s must have been started.
+func (f *Forwarder) Install(s *tsnet.Server) error {
+	s.RegisterFallbackTCPHandler(f.TCPHandler)
+
+	// tsnet has no fallback hook for UDP and drops any UDP flow without a
+	// listener, so wrap its handler. This runs before any routes are
+	// advertised, so no flows are in progress.
+	ns, ok := s.Sys().Netstack.Get().(*netstack.Impl)
+	if !ok {
+		return errors.New("tsnet is not using netstack")
+	}
+	next := ns.GetUDPHandlerForFlow
+	ns.GetUDPHandlerForFlow = func(src, dst netip.AddrPort) (func(nettype.ConnPacketConn), bool) {
+		if h, ok := f.UDPHandler(src, dst); ok {
+			return h, true
+		}
+		return next(src, dst)
+	}
+	return nil
+}
+
+// metadataAddrs are cloud instance metadata services, which hand out
+// credentials to anything that can reach them.
+var metadataAddrs = []netip.Addr{
+	netip.MustParseAddr("169.254.169.254"), // AWS, GCP, Azure and most others
+	netip.MustParseAddr("fd00:ec2::254"),   // AWS over IPv6
+	netip.MustParseAddr("100.100.100.200"), // Alibaba Cloud
+}
+
+// routed reports whether dst is inside an advertised subnet or, for an
+// exit node, outside the tailnet, and in the first case sets subnet.
+func (f *Forwarder) routed(dst netip.Addr) (ok, subnet bool) {
+	dst = dst.Unmap()
+	for _, r := range f.opts.Routes() {
+		if r.Contains(dst) {
+			return true, true
+		}
+	}
+	return f.opts.ExitNode && !tsaddr.IsTailscaleIP(dst) && !dst.IsLoopback() && !dst.IsUnspecified(), false
+}
+
+// allowed reports whether a proto flow to dst may be forwarded. Link-local
+// and metadata addresses are never reachable. Flows through the exit node
+// may only reach private (RFC 1918 and ULA) addresses on the router's own
+// network if a policy rule allows them by destination, since otherwise
+// every peer that can use the exit node could reach that network.
+func (f *Forwarder) allowed(proto string, dst netip.AddrPort, subnet bool) bool {
+	addr := dst.Addr().Unmap()
+	if addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || slices.Contains(metadataAddrs, addr) {
+		return false
+	}
+	if !subnet && addr.IsPrivate() && !f.opts.Policy.allowsByDst(proto, dst) {
+		return false
+	}
+	return f.opts.Policy.Allow(proto, dst)
+}
+
+func (f *Forwarder) isSelf(ip netip.Addr) bool {
+	if f.opts.SelfIPs == nil {
+		return false
+	}
+	ip4, ip6 := f.opts.SelfIPs()
+	ip = ip.Unmap()
+	return ip == ip4 || ip == ip6
+}
+
+// servesDNS reports whether flows to dst go to the DNSHandler.
+func (f *Forwarder) servesDNS(dst netip.AddrPort) bool {
+	return f.opts.DNSHandler != nil && dst.Port() == 53 && f.isSelf(dst.Addr())
+}
+
+// target returns where a proto flow from src to dst should be sent, and
+// whether the forwarder handles it at all. A handled flow with an invalid
+// target has been denied by the egress policy.
+func (f *Forwarder) target(proto string, src, dst netip.AddrPort) (netip.AddrPort, bool) {
+	if dst.Port() == 53 && f.opts.DNSUpstream.IsValid() && f.isSelf(dst.Addr()) {
+		return f.opts.DNSUpstream, true
+	}
+	ok, subnet := f.routed(dst.Addr())
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	if !f.allowed(proto, dst, subnet) {
+		log.Printf("egress denied: %s %s -> %s", proto, src, dst)
+		f.opts.Counters.update(src.Addr(), func(pc *PeerCounters) { pc.Denied++ })
+		return netip.AddrPort{}, true
+	}
+	return dst, true
+}
+
+// TCPHandler is a tsnet.FallbackTCPHandler for flows the router forwards.
+// Denied flows are reset.
+func (f *Forwarder) TCPHandler(src, dst netip.AddrPort) (func(net.Conn), bool) {
+	if f.servesDNS(dst) {
+		return func(c net.Conn) { f.opts.DNSHandler(c, "tcp") }, true
+	}
+	to, ok := f.target("tcp", src, dst)
+	if !ok || !to.IsValid() {
+		return nil, ok
+	}
+	return func(c net.Conn) { f.forwardTCP(c, src, to) }, true
+}
+
+// UDPHandler handles UDP flows the router forwards. Denied flows are
+// dropped.
+func (f *Forwarder) UDPHandler(src, dst netip.AddrPort) (func(nettype.ConnPacketConn), bool) {
+	if f.servesDNS(dst) {
+		return func(c nettype.ConnPacketConn) { f.opts.DNSHandler(c, "udp") }, true
+	}
+	to, ok := f.target("udp", src, dst)
+	if !ok || !to.IsValid() {
+		return nil, ok
+	}
+	return func(c nettype.ConnPacketConn) { f.forwardUDP(c, src, to) }, true
+}
+
+func (f *Forwarder) forwardTCP(c net.Conn, src, dst netip.AddrPort) {
+	defer c.Close()
+
+	upstream, err := f.dialer.Dial("tcp", dst.String())
+	if err != nil {
+		log.Printf("forward tcp %s -> %s: %v", src, dst, err)
+		return
+	}
+	defer upstream.Close()
+	f.opts.Counters.update(src.Addr(), func(pc *PeerCounters) { pc.Flows++ })
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(countingWriter{upstream, f.opts.Counters, src.Addr(), true}, c)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(countingWriter{c, f.opts.Counters, src.Addr(), false}, upstream)
+		closeWrite(c)
+	}()
+	wg.Wait()
+}
+
+// closeWrite half-closes c if it supports it, so the other side sees EOF
+// while replies can still flow back.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
+
+func (f *Forwarder) forwardUDP(c nettype.ConnPacketConn, src, dst netip.AddrPort) {
+	defer c.Close()
+
+	upstream, err := f.dialer.Dial("udp", dst.String())
+	if err != nil {
+		log.Printf("forward udp %s -> %s: %v", src, dst, err)
+		return
+	}
+	defer upstream.Close()
+	f.opts.Counters.update(src.Addr(), func(pc *PeerCounters) { pc.Flows++ })
+
+	idle := f.udpIdleTimeout
+	if dst.Port() == 53 && idle > dnsIdleTimeout {
+		idle = dnsIdleTimeout
+	}
+
+	// Each direction extends the shared deadline; the flow ends when
+	// neither side has sent anything for idle.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	activity := make(chan struct{}, 1)
+	copyPackets := func(dst io.Writer, src net.Conn) {
+		defer cancel()
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+		}
+	}
+	go copyPackets(countingWriter{upstream, f.opts.Counters, src.Addr(), true}, c)
+	go copyPackets(countingWriter{c, f.opts.Counters, src.Addr(), false}, upstream)
+
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-activity:
+			timer.Reset(idle)
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// systemResolver returns the first nameserver in /etc/resolv.conf.
+func systemResolver() (netip.AddrPort, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip, err := netip.ParseAddr(fields[1]); err == nil {
+			return netip.AddrPortFrom(ip, 53), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPort{}, errors.New("no nameserver in /etc/resolv.conf")
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpEcho starts a TCP server on loopback that echoes each line back.
+func tcpEcho(t *testing.T) netip.AddrPort {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).AddrPort()
+}
+
+// udpEcho starts a UDP server on loopback that echoes each packet back.
+func udpEcho(t *testing.T) netip.AddrPort {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func loopbackForwarder(t *testing.T) *Forwarder {
+	return NewForwarder(ForwarderOptions{
+		Routes: func() []netip.Prefix { return mustRoutes(t, "127.0.0.0/8") },
+	})
+}
+
+var testSrc = netip.MustParseAddrPort("100.64.0.1:41000")
+
+// TestForwarder_Routed tests which destinations the forwarder claims.
+func TestForwarder_Routed(t *testing.T) {
+	f := loopbackForwarder(t)
+	if _, ok := f.TCPHandler(testSrc, netip.MustParseAddrPort("127.0.0.1:80")); !ok {
+		t.Error("Expected TCP to an advertised subnet to be handled")
+	}
+	if _, ok := f.UDPHandler(testSrc, netip.MustParseAddrPort("[::ffff:127.0.0.1]:53")); !ok {
+		t.Error("Expected a 4in6 address in an advertised subnet to be handled")
+	}
+	if _, ok := f.TCPHandler(testSrc, netip.MustParseAddrPort("192.0.2.1:80")); ok {
+		t.Error("Expected TCP outside the advertised subnets to be left to tsnet")
+	}
+	if _, ok := f.UDPHandler(testSrc, netip.MustParseAddrPort("100.64.0.2:53")); ok {
+		t.Error("Expected UDP outside the advertised subnets to be left to tsnet")
+	}
+}
+
+// TestForwarder_TCP tests proxying a TCP flow to a host in a loopback
+// subnet, including half-close.
+func TestForwarder_TCP(t *testing.T) {
+	dst := tcpEcho(t)
+	handler, ok := loopbackForwarder(t).TCPHandler(testSrc, dst)
+	if !ok {
+		t.Fatal("Expected flow to be handled")
+	}
+
+	// One end stands in for the tailnet client, the other for the netstack
+	// connection handed to the forwarder.
+	client, tailnet := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handler(tailnet)
+		close(done)
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(client, "hello subnet\n"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil || line != "hello subnet\n" {
+		t.Errorf("Expected echo, got %q (%v)", line, err)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected forwarding to stop once the client closed")
+	}
+}
+
+// TestForwarder_TCPUnreachable tests that a refused upstream closes the
+// tailnet side.
+func TestForwarder_TCPUnreachable(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	dst := ln.Addr().(*net.TCPAddr).AddrPort()
+	ln.Close()
+
+	handler, _ := loopbackForwarder(t).TCPHandler(testSrc, dst)
+	client, tailnet := net.Pipe()
+	go handler(tailnet)
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF && !strings.Contains(err.Error(), "closed") {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+// TestForwarder_UDP tests proxying UDP packets to a host in a loopback
+// subnet and closing the flow once idle.
+func TestForwarder_UDP(t *testing.T) {
+	dst := udpEcho(t)
+	f := loopbackForwarder(t)
+	f.udpIdleTimeout = 200 * time.Millisecond
+	handler, ok := f.UDPHandler(testSrc, dst)
+	if !ok {
+		t.Fatal("Expected flow to be handled")
+	}
+
+	// A connected UDP socket pair stands in for the netstack flow.
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	tailnet, err := net.DialUDP("udp", nil, client.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		handler(tailnet)
+		close(done)
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"one", "two"} {
+		if _, err := client.WriteTo([]byte(msg), tailnet.LocalAddr()); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		buf := make([]byte, 64)
+		n, _, err := client.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Errorf("Expected echo %q, got %q (%v)", msg, buf[:n], err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the idle flow to be closed")
+	}
+}
+
+// TestForwarder_ExitNode tests that an exit node forwards anything off the
+// tailnet, subject to the egress policy.
+func TestForwarder_ExitNode(t *testing.T) {
+	policy, _ := parseEgressPolicy([]byte(`{"default": "allow", "rules": [{"action": "deny", "ports": ["25"]}]}`))
+	counters := NewCounters()
+	f := NewForwarder(ForwarderOptions{
+		Routes:   func() []netip.Prefix { return nil },
+		ExitNode: true,
+		Policy:   policy,
+		Counters: counters,
+	})
+
+	if _, ok := f.TCPHandler(testSrc, netip.MustParseAddrPort("198.51.100.1:443")); !ok {
+		t.Error("Expected an internet destination to be handled")
+	}
+	if _, ok := f.UDPHandler(testSrc, netip.MustParseAddrPort("[2001:db8::1]:443")); !ok {
+		t.Error("Expected an IPv6 internet destination to be handled")
+	}
+	if _, ok := f.TCPHandler(testSrc, netip.MustParseAddrPort("100.64.0.2:443")); ok {
+		t.Error("Expected a tailnet destination to be left to tsnet")
+	}
+
+	h, ok := f.TCPHandler(testSrc, netip.MustParseAddrPort("198.51.100.1:25"))
+	if !ok || h != nil {
+		t.Error("Expected a denied flow to be intercepted with no handler")
+	}
+	if got := counters.Snapshot()[testSrc.Addr()].Denied; got != 1 {
+		t.Errorf("Expected 1 denied flow, got %d", got)
+	}
+}
+
+// TestForwarder_ExitNodeLocal tests that an exit node keeps link-local and
+// metadata addresses out of reach, and private addresses unless routed or
+// allowed by a policy rule.
+func TestForwarder_ExitNodeLocal(t *testing.T) {
+	newForwarder := func(policy *EgressPolicy) *Forwarder {
+		return NewForwarder(ForwarderOptions{
+			Routes:   func() []netip.Prefix { return mustRoutes(t, "192.168.10.0/24", "169.254.0.0/16") },
+			ExitNode: true,
+			Policy:   policy,
+		})
+	}
+	denied := func(f *Forwarder, dst string) bool {
+		h, ok := f.TCPHandler(testSrc, netip.MustParseAddrPort(dst))
+		return ok && h == nil
+	}
+
+	f := newForwarder(nil)
+	for _, dst := range []string{
+		"169.254.169.254:80",
+		"169.254.1.1:80",
+		"[fe80::1]:80",
+		"[fd00:ec2::254]:80",
+		"[::ffff:169.254.169.254]:80",
+		"10.0.0.1:22",
+		"172.16.5.5:443",
+		"192.168.1.1:80",
+		"[fd12:3456::1]:80",
+	} {
+		if !denied(f, dst) {
+			t.Errorf("Expected %s to be denied with no policy", dst)
+		}
+	}
+	if denied(f, "192.168.10.5:80") {
+		t.Error("Expected an advertised private subnet to be reachable")
+	}
+	if denied(f, "198.51.100.1:443") {
+		t.Error("Expected an internet destination to be reachable")
+	}
+
+	policy, err := parseEgressPolicy([]byte(`{
+		"default": "allow",
+		"rules": [
+			{"action": "allow", "dst": ["10.1.0.0/16", "169.254.0.0/16"]},
+			{"action": "allow", "ports": ["22"]},
+		],
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = newForwarder(policy)
+	if denied(f, "10.1.2.3:80") {
+		t.Error("Expected a private destination allowed by a policy rule to be reachable")
+	}
+	if !denied(f, "10.2.0.1:22") {
+		t.Error("Expected a rule for any destination not to open up private addresses")
+	}
+	if !denied(f, "10.2.0.1:80") {
+		t.Error("Expected the default action not to open up private addresses")
+	}
+	if !denied(f, "169.254.169.254:80") {
+		t.Error("Expected the metadata service to be denied even when allowed by policy")
+	}
+}
+
+// TestForwarder_DNS tests that DNS sent to the router's own address is
+// forwarded to the upstream resolver and counted.
+func TestForwarder_DNS(t *testing.T) {
+	resolver := udpEcho(t)
+	self := netip.MustParseAddr("100.64.0.5")
+	counters := NewCounters()
+	f := NewForwarder(ForwarderOptions{
+		Routes:      func() []netip.Prefix { return nil },
+		ExitNode:    true,
+		Counters:    counters,
+		DNSUpstream: resolver,
+		SelfIPs:     func() (netip.Addr, netip.Addr) { return self, netip.Addr{} },
+	})
+	f.udpIdleTimeout = 200 * time.Millisecond
+
+	if _, ok := f.UDPHandler(testSrc, netip.AddrPortFrom(self, 80)); ok {
+		t.Error("Expected non-DNS traffic to the router to be left to tsnet")
+	}
+	handler, ok := f.UDPHandler(testSrc, netip.AddrPortFrom(self, 53))
+	if !ok {
+		t.Fatal("Expected DNS to the router to be handled")
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	tailnet, err := net.DialUDP("udp", nil, client.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go handler(tailnet)
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.WriteTo([]byte("query"), tailnet.LocalAddr())
+	buf := make([]byte, 64)
+	if n, _, err := client.ReadFrom(buf); err != nil || string(buf[:n]) != "query" {
+		t.Fatalf("Expected the resolver's answer, got %q (%v)", buf[:n], err)
+	}
+
+	// The reply is counted just after it is delivered.
+	waitFor(t, func() bool {
+		got := counters.Snapshot()[testSrc.Addr()]
+		return got.Flows == 1 && got.Sent == 5 && got.Received == 5
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/hujson"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 3 * time.Second
+	defaultCheckFailures = 3
+)
+
+// Duration is a time.Duration written as a string such as "10s" in config
+// files.
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// HealthCheck probes something behind a route. After Failures consecutive
+// failed probes the route is withdrawn, and it is advertised again after
+// the next successful one, so that an HA peer advertising the same route
+// takes over in the meantime.
+type HealthCheck struct {
+	Route netip.Prefix `json:"route"`
+	// Type is "tcp", "icmp" or "http".
+	Type string `json:"type"`
+	// Target is a host:port for tcp, an IP for icmp, or a URL for http.
+	Target   string   `json:"target"`
+	Interval Duration `json:"interval,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+	Failures int      `json:"failures,omitempty"`
+}
+
+// loadHealthChecks reads a HuJSON list of health checks.
+func loadHealthChecks(path string) ([]HealthCheck, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = hujson.Standardize(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse health checks: %w", err)
+	}
+	var checks []HealthCheck
+	if err := json.Unmarshal(data, &checks); err != nil {
+		return nil, fmt.Errorf("parse health checks: %w", err)
+	}
+	for i := range checks {
+		if err := checks[i].validate(); err != nil {
+			return nil, fmt.Errorf("health check %d: %w", i, err)
+		}
+	}
+	return checks, nil
+}
+
+// validate checks c and fills in defaults.
+func (c *HealthCheck) validate() error {
+	if !c.Route.IsValid() {
+		return errors.New("route is required")
+	}
+	if _, err := c.probe(); err != nil {
+		return err
+	}
+	if c.Interval <= 0 {
+		c.Interval = Duration(defaultCheckInterval)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = Duration(defaultCheckTimeout)
+	}
+	if c.Failures <= 0 {
+		c.Failures = defaultCheckFailures
+	}
+	return nil
+}
+
+// probe returns the function that runs one probe of c.
+func (c *HealthCheck) probe() (func(context.Context) error, error) {
+	switch c.Type {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(c.Target); err != nil {
+			return nil, fmt.Errorf("tcp target %q: %w", c.Target, err)
+		}
+		return func(ctx context.Context) error { return probeTCP(ctx, c.Target) }, nil
+	case "icmp":
+		ip, err := netip.ParseAddr(c.Target)
+		if err != nil {
+			return nil, fmt.Errorf("icmp target %q: %w", c.Target, err)
+		}
+		return func(ctx context.Context) error { return probeICMP(ctx, ip) }, nil
+	case "http":
+		if _, err := http.NewRequest(http.MethodGet, c.Target, nil); err != nil {
+			return nil, fmt.Errorf("http target %q: %w", c.Target, err)
+		}
+		return func(ctx context.Context) error { return probeHTTP(ctx, c.Target) }, nil
+	default:
+		return nil, fmt.Errorf("type must be tcp, icmp or http, got %q", c.Type)
+	}
+}
+
+func probeTCP(ctx context.Context, target string) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+func probeHTTP(ctx context.Context, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("http status %s", resp.Status)
+	}
+	return nil
+}
+
+var icmpSeq atomic.Uint32
+
+// probeICMP sends an echo request from an unprivileged ICMP socket, which
+// needs the process's group to be in net.ipv4.ping_group_range on Linux.
+func probeICMP(ctx context.Context, ip netip.Addr) error {
+	network, proto := "udp4", 1
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if ip.Is6() {
+		network, proto = "udp6", 58
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+
+	c, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	msg := icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{
+			ID:   os.Getpid() & 0xffff,
+			Seq:  int(icmpSeq.Add(1) & 0xffff),
+			Data: []byte("tsnet-subnet-router"),
+		},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := c.WriteTo(b, &net.UDPAddr{IP: ip.AsSlice(), Zone: ip.Zone()}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		if reply.Type == ipv4.ICMPTypeEchoReply || reply.Type == ipv6.ICMPTypeEchoReply {
+			return nil
+		}
+	}
+}
+
+// runHealthCheck probes c on its interval until ctx is done, withdrawing
+// and restoring its route in m.
+func runHealthCheck(ctx context.Context, m *RouteManager, c HealthCheck) {
+	probe, err := c.probe()
+	if err != nil {
+		log.Printf("health check %s: %v", c.Route, err)
+		return
+	}
+
+	failures := 0
+	ticker := time.NewTicker(time.Duration(c.Interval))
+	defer ticker.Stop()
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, time.Duration(c.Timeout))
+		err := probe(probeCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			failures++
+			log.Printf("health check %s (%s %s) failed %d/%d: %v", c.Route, c.Type, c.Target, failures, c.Failures, err)
+			if failures >= c.Failures {
+				if err := m.Withdraw(ctx, c.Route); err != nil {
+					log.Printf("health check %s: withdraw: %v", c.Route, err)
+				}
+			}
+		} else if failures >= c.Failures {
+			// Keep the failure count until the restore succeeds, so it is
+			// retried on the next probe.
+			if err := m.Restore(ctx, c.Route); err != nil {
+				log.Printf("health check %s: restore: %v", c.Route, err)
+			} else {
+				failures = 0
+			}
+		} else {
+			failures = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
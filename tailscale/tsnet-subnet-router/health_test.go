@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestLoadHealthChecks tests parsing health checks and their defaults.
+func TestLoadHealthChecks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checks.hujson")
+	os.WriteFile(path, []byte(`[
+		// The lab's gateway answers pings.
+		{"route": "10.0.0.0/24", "type": "icmp", "target": "10.0.0.1"},
+		{"route": "10.0.1.0/24", "type": "tcp", "target": "10.0.1.10:22", "interval": "30s", "failures": 5},
+		{"route": "10.0.2.0/24", "type": "http", "target": "http://10.0.2.10/healthz", "timeout": "1s"},
+	]`), 0o644)
+
+	checks, err := loadHealthChecks(path)
+	if err != nil {
+		t.Fatalf("loadHealthChecks failed: %v", err)
+	}
+	if len(checks) != 3 {
+		t.Fatalf("Expected 3 checks, got %d", len(checks))
+	}
+	if c := checks[0]; time.Duration(c.Interval) != defaultCheckInterval || time.Duration(c.Timeout) != defaultCheckTimeout || c.Failures != defaultCheckFailures {
+		t.Errorf("Expected defaults, got %+v", c)
+	}
+	if c := checks[1]; time.Duration(c.Interval) != 30*time.Second || c.Failures != 5 {
+		t.Errorf("Unexpected check %+v", c)
+	}
+
+	tests := []struct {
+		name  string
+		check string
+		want  string
+	}{
+		{"no route", `{"type": "tcp", "target": "10.0.0.1:22"}`, "route is required"},
+		{"bad type", `{"route": "10.0.0.0/24", "type": "udp", "target": "10.0.0.1:53"}`, "type must be"},
+		{"tcp without port", `{"route": "10.0.0.0/24", "type": "tcp", "target": "10.0.0.1"}`, "tcp target"},
+		{"icmp hostname", `{"route": "10.0.0.0/24", "type": "icmp", "target": "gateway"}`, "icmp target"},
+		{"bad interval", `{"route": "10.0.0.0/24", "type": "icmp", "target": "10.0.0.1", "interval": "often"}`, "parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.WriteFile(path, []byte("["+tt.check+"]"), 0o644)
+			if _, err := loadHealthChecks(path); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+// TestProbeTCP tests the TCP connect probe.
+func TestProbeTCP(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	if err := probeTCP(ctx, addr); err != nil {
+		t.Errorf("Expected probe to succeed, got %v", err)
+	}
+	ln.Close()
+	if err := probeTCP(ctx, addr); err == nil {
+		t.Error("Expected probe of a closed port to fail")
+	}
+}
+
+// TestProbeICMP tests pinging loopback from an unprivileged ICMP socket.
+func TestProbeICMP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := probeICMP(ctx, netip.MustParseAddr("127.0.0.1"))
+	if err != nil && (os.IsPermission(err) || strings.Contains(err.Error(), "not permitted")) {
+		t.Skipf("unprivileged ICMP sockets are not allowed here: %v", err)
+	}
+	if err != nil {
+		t.Errorf("Expected ping of loopback to succeed, got %v", err)
+	}
+}
+
+// TestRunHealthCheck tests that a route is withdrawn after repeated failures
+// and restored once its check passes again.
+func TestRunHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	prefs := &fakePrefs{}
+	m := NewRouteManager(prefs, false)
+	m.Set(ctx, mustRoutes(t, "10.0.0.0/24", "10.0.1.0/24"))
+
+	check := HealthCheck{
+		Route:    netip.MustParsePrefix("10.0.0.0/24"),
+		Type:     "http",
+		Target:   server.URL,
+		Interval: Duration(10 * time.Millisecond),
+		Failures: 3,
+	}
+	if err := check.validate(); err != nil {
+		t.Fatal(err)
+	}
+	go runHealthCheck(ctx, m, check)
+
+	time.Sleep(50 * time.Millisecond)
+	if got, _ := prefs.get(); got != "10.0.0.0/24, 10.0.1.0/24" {
+		t.Fatalf("Expected both routes while healthy, got %s", got)
+	}
+
+	healthy.Store(false)
+	waitFor(t, func() bool { got, _ := prefs.get(); return got == "10.0.1.0/24" })
+	if got := joinPrefixes(m.Withdrawn()); got != "10.0.0.0/24" {
+		t.Errorf("Expected 10.0.0.0/24 to be withdrawn, got %s", got)
+	}
+	if got := joinPrefixes(m.Routes()); got != "10.0.0.0/24, 10.0.1.0/24" {
+		t.Errorf("Expected the withdrawn route to stay configured, got %s", got)
+	}
+
+	healthy.Store(true)
+	waitFor(t, func() bool { got, _ := prefs.get(); return got == "10.0.0.0/24, 10.0.1.0/24" })
+	if len(m.Withdrawn()) != 0 {
+		t.Errorf("Expected no withdrawn routes, got %s", joinPrefixes(m.Withdrawn()))
+	}
+}
@@ -2,98 +2,261 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/alecthomas/kong"
+	"tailscale.com/client/local"
 	"tailscale.com/ipn"
 	"tailscale.com/tsnet"
 )
 
-var CLI struct {
-	Subnets  []string `arg:"" name:"subnets" help:"Subnets to advertise (e.g., 192.168.1.0/24)" optional:""`
-	ExitNode bool     `name:"exit-node" help:"Advertise as an exit node (routes all traffic)" default:"false"`
-	Hostname string   `name:"hostname" help:"Tailscale hostname" default:"tsnet-subnet-router"`
-	AuthKey  string   `name:"auth-key" help:"Tailscale authentication key (optional)" env:"TS_AUTHKEY"`
-}
+var CLI Config
+
+const (
+	// routesFilePollInterval is how often --routes-file is checked for
+	// changes.
+	routesFilePollInterval = 5 * time.Second
+	// shutdownTimeout bounds draining the local servers and logging out on
+	// SIGTERM.
+	shutdownTimeout = 10 * time.Second
+)
 
 func main() {
-	kong.Parse(&CLI,
-		kong.Name("tsnet-subnet-router"),
-		kong.Description("A Tailscale subnet router using tsnet"),
-		kong.UsageOnError(),
-	)
+	parser, err := newParser(&CLI)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	_, err = parser.Parse(os.Args[1:])
+	parser.FatalIfErrorf(err)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = run(ctx)
+	stop()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+}
 
+// run runs the router until ctx is done. Once the node has started, every
+// return goes through shutdown, so an ephemeral node always logs out.
+func run(ctx context.Context) error {
 	s := &tsnet.Server{
-		Hostname: CLI.Hostname,
-		AuthKey:  CLI.AuthKey,
+		Hostname:   CLI.Hostname,
+		AuthKey:    CLI.AuthKey,
+		Dir:        CLI.StateDir,
+		ControlURL: CLI.ControlURL,
+		Ephemeral:  CLI.Ephemeral,
 	}
 	defer s.Close()
 
 	if err := s.Start(); err != nil {
-		log.Fatalf("tsnet start: %v", err)
+		return fmt.Errorf("tsnet start: %w", err)
 	}
 
 	lc, _ := s.LocalClient()
+	var servers []*http.Server
+	defer func() { shutdown(lc, servers) }()
+
+	// Tags are requested when the node registers, so an existing node keeps
+	// the tags it registered with until its state is removed.
+	mp := &ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			AdvertiseTags: CLI.Tags,
+			NoSNAT:        !CLI.SNATSubnetRoutes,
+		},
+		AdvertiseTagsSet: len(CLI.Tags) > 0,
+		NoSNATSet:        true,
+	}
+	if _, err := lc.EditPrefs(ctx, mp); err != nil {
+		return fmt.Errorf("edit prefs: %w", err)
+	}
+	if !CLI.SNATSubnetRoutes {
+		log.Println("snat disabled in prefs; forwarded connections are still made from this host's own address")
+	}
 
 	// Parse subnet prefixes
-	var routes []netip.Prefix
-	for _, subnet := range CLI.Subnets {
-		prefix, err := netip.ParsePrefix(subnet)
-		if err != nil {
-			log.Fatalf("invalid subnet %q: %v", subnet, err)
+	base, err := parseRoutes(append(slices.Clone(CLI.Subnets), CLI.Routes...))
+	if err != nil {
+		return err
+	}
+	var fileRoutes []netip.Prefix
+	if CLI.RoutesFile != "" {
+		if fileRoutes, err = readRoutesFile(CLI.RoutesFile); err != nil {
+			return fmt.Errorf("routes file: %w", err)
 		}
-		routes = append(routes, prefix)
 	}
 
-	// Add default routes if exit node is requested
 	if CLI.ExitNode {
 		log.Println("Advertising as exit node")
-		routes = append(routes,
-			netip.MustParsePrefix("0.0.0.0/0"),
-			netip.MustParsePrefix("::/0"),
-		)
 	}
 
-	if len(routes) == 0 {
-		log.Fatalf("no routes to advertise: specify subnets or use --exit-node")
+	routeManager := NewRouteManager(lc, CLI.ExitNode)
+
+	domains, err := parseDomains(CLI.Domains)
+	if err != nil {
+		return err
+	}
+	if len(domains) > 0 && CLI.DomainRouteMaxAge <= CLI.DomainRefresh {
+		return errors.New("--domain-route-max-age must be longer than --domain-refresh")
 	}
 
-	mp := &ipn.MaskedPrefs{
-		Prefs: ipn.Prefs{
-			AdvertiseRoutes: routes,
-			WantRunning:     true,
-		},
-		AdvertiseRoutesSet: true,
-		WantRunningSet:     true,
+	var checks []HealthCheck
+	if CLI.HealthChecks != "" {
+		if checks, err = loadHealthChecks(CLI.HealthChecks); err != nil {
+			return err
+		}
 	}
 
-	if _, err := lc.EditPrefs(context.Background(), mp); err != nil {
-		log.Fatalf("edit prefs: %v", err)
+	var policy *EgressPolicy
+	if CLI.EgressPolicy != "" {
+		if policy, err = loadEgressPolicy(CLI.EgressPolicy); err != nil {
+			return err
+		}
+		log.Printf("egress policy: %d rules, default %s", len(policy.Rules), policy.Default)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	defer cancel()
+	var dnsUpstream netip.AddrPort
+	if CLI.ExitNode || len(domains) > 0 {
+		if CLI.DNSUpstream != "" {
+			dnsUpstream, err = netip.ParseAddrPort(CLI.DNSUpstream)
+		} else {
+			dnsUpstream, err = systemResolver()
+		}
+		if err != nil {
+			return fmt.Errorf("dns upstream: %w", err)
+		}
+		log.Printf("forwarding DNS to %s", dnsUpstream)
+	}
 
-	// Check if we need to log login URL
-	if CLI.AuthKey == "" {
-		status, err := lc.Status(ctx)
-		if err == nil && status.AuthURL != "" {
-			fmt.Printf("\nAuthentication required. Please visit:\n%s\n\n", status.AuthURL)
+	// Proxy traffic for the advertised subnets, and for exit node users,
+	// out of this host, since tsnet has no TUN device to route it through.
+	counters := NewCounters()
+	opts := ForwarderOptions{
+		Routes: func() []netip.Prefix {
+			return append(routeManager.Routes(), routeManager.DomainRoutes()...)
+		},
+		ExitNode:    CLI.ExitNode,
+		Policy:      policy,
+		Counters:    counters,
+		DNSUpstream: dnsUpstream,
+		SelfIPs:     s.TailscaleIPs,
+	}
+	var appConnector *AppConnector
+	if len(domains) > 0 {
+		log.Printf("app connector for: %s", strings.Join(domains, ", "))
+		appConnector = NewAppConnector(domains, dnsUpstream, CLI.DomainRouteMaxAge, routeManager)
+		opts.DNSHandler = appConnector.ServeDNS
+	}
+	forwarder := NewForwarder(opts)
+	if err := forwarder.Install(s); err != nil {
+		return fmt.Errorf("forwarder: %w", err)
+	}
+	if appConnector != nil {
+		if err := appConnector.Refresh(ctx); err != nil {
+			return fmt.Errorf("app connector: %w", err)
+		}
+	}
+	if CLI.RoutesFile != "" {
+		if err := routeManager.SetFileRoutes(ctx, fileRoutes); err != nil {
+			return fmt.Errorf("routes file: %w", err)
+		}
+	}
+	if err := routeManager.Set(ctx, base); err != nil {
+		return err
+	}
+
+	// Serve health before coming up, so probes see the node logging in.
+	errc := make(chan error, 2)
+	if CLI.HealthAddr != "" {
+		ln, err := net.Listen("tcp", localAddr(CLI.HealthAddr))
+		if err != nil {
+			return fmt.Errorf("health: %w", err)
 		}
+		srv := &http.Server{Handler: statusHandler(lc.StatusWithoutPeers, routeManager, counters)}
+		servers = append(servers, srv)
+		go func() { errc <- srv.Serve(ln) }()
+		log.Printf("health and metrics listening on http://%s/healthz and /metrics", ln.Addr())
 	}
 
+	// Wait as long as it takes to log in; tsnet logs the login URL if one
+	// is needed.
 	if _, err := s.Up(ctx); err != nil {
-		log.Fatalf("up: %v", err)
+		if ctx.Err() != nil {
+			log.Println("shutting down before coming up")
+			return nil
+		}
+		return fmt.Errorf("up: %w", err)
+	}
+	if len(CLI.Tags) > 0 {
+		if st, err := lc.StatusWithoutPeers(ctx); err == nil && st.Self != nil {
+			var tags []string
+			if st.Self.Tags != nil {
+				tags = st.Self.Tags.AsSlice()
+			}
+			for _, tag := range CLI.Tags {
+				if !slices.Contains(tags, tag) {
+					log.Printf("warning: node has tags %v, not the requested %v; remove the state dir to register with new tags", tags, CLI.Tags)
+					break
+				}
+			}
+		}
 	}
 
-	var routeStrs []string
-	for _, r := range routes {
-		routeStrs = append(routeStrs, r.String())
+	for _, c := range checks {
+		log.Printf("health checking %s with %s %s every %s", c.Route, c.Type, c.Target, time.Duration(c.Interval))
+		go runHealthCheck(ctx, routeManager, c)
+	}
+	if appConnector != nil {
+		go appConnector.Run(ctx, CLI.DomainRefresh)
+	}
+	if CLI.RoutesFile != "" {
+		go watchRoutesFile(ctx, routeManager, CLI.RoutesFile, routesFilePollInterval)
+	}
+	if CLI.APIAddr != "" {
+		ln, err := listenAPI(CLI.APIAddr)
+		if err != nil {
+			return fmt.Errorf("route API: %w", err)
+		}
+		log.Printf("route API listening on %s", ln.Addr())
+		srv := &http.Server{Handler: apiHandler(routeManager, counters)}
+		servers = append(servers, srv)
+		go func() { errc <- srv.Serve(ln) }()
+	}
+
+	log.Printf("subnet router is advertising: %s", joinPrefixes(routeManager.Advertised()))
+	select {
+	case err := <-errc:
+		return fmt.Errorf("serve: %w", err)
+	case <-ctx.Done():
+	}
+	log.Println("shutting down")
+	return nil
+}
+
+// shutdown drains the local servers and, for an ephemeral node, logs out
+// so that it leaves the tailnet straight away.
+func shutdown(lc *local.Client, servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("shutdown: %v", err)
+		}
+	}
+	if CLI.Ephemeral {
+		log.Println("logging out ephemeral node")
+		if err := lc.Logout(ctx); err != nil {
+			log.Printf("logout: %v", err)
+		}
 	}
-	log.Printf("subnet router is advertising: %s", strings.Join(routeStrs, ", "))
-	select {} // keep the process alive
 }
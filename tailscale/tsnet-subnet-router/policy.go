@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/hujson"
+)
+
+// EgressPolicy decides which destinations forwarded traffic may reach. Rules
+// are checked in order and the first match wins; flows matching no rule get
+// the default action.
+type EgressPolicy struct {
+	Default string       `json:"default"`
+	Rules   []EgressRule `json:"rules"`
+}
+
+// EgressRule allows or denies flows to a set of destinations.
+type EgressRule struct {
+	// Action is "allow" or "deny".
+	Action string `json:"action"`
+	// Dst lists destination prefixes. Empty matches any destination.
+	Dst []netip.Prefix `json:"dst"`
+	// Ports lists destination ports or ranges such as "8000-8100". Empty
+	// matches any port.
+	Ports []string `json:"ports"`
+	// Proto is "tcp" or "udp". Empty matches both.
+	Proto string `json:"proto"`
+
+	ports []portRange
+}
+
+type portRange struct {
+	first, last uint16
+}
+
+// loadEgressPolicy reads a HuJSON policy file.
+func loadEgressPolicy(path string) (*EgressPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseEgressPolicy(data)
+}
+
+func parseEgressPolicy(data []byte) (*EgressPolicy, error) {
+	data, err := hujson.Standardize(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse egress policy: %w", err)
+	}
+	var p EgressPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse egress policy: %w", err)
+	}
+
+	switch p.Default {
+	case "":
+		p.Default = "deny"
+	case "allow", "deny":
+	default:
+		return nil, fmt.Errorf("egress policy: default must be allow or deny, got %q", p.Default)
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Action != "allow" && r.Action != "deny" {
+			return nil, fmt.Errorf("egress rule %d: action must be allow or deny, got %q", i, r.Action)
+		}
+		if r.Proto != "" && r.Proto != "tcp" && r.Proto != "udp" {
+			return nil, fmt.Errorf("egress rule %d: proto must be tcp or udp, got %q", i, r.Proto)
+		}
+		for _, s := range r.Ports {
+			pr, err := parsePortRange(s)
+			if err != nil {
+				return nil, fmt.Errorf("egress rule %d: %w", i, err)
+			}
+			r.ports = append(r.ports, pr)
+		}
+	}
+	return &p, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	lo, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = strconv.ParseUint(strings.TrimSpace(last), 10, 16); err != nil || hi < lo {
+			return portRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return portRange{uint16(lo), uint16(hi)}, nil
+}
+
+func (r *EgressRule) matches(proto string, dst netip.AddrPort) bool {
+	if r.Proto != "" && r.Proto != proto {
+		return false
+	}
+	if len(r.Dst) > 0 {
+		ok := false
+		for _, p := range r.Dst {
+			if p.Contains(dst.Addr().Unmap()) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.ports) > 0 {
+		ok := false
+		for _, pr := range r.ports {
+			if dst.Port() >= pr.first && dst.Port() <= pr.last {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Allow reports whether a proto ("tcp" or "udp") flow to dst is permitted.
+// A nil policy allows everything.
+func (p *EgressPolicy) Allow(proto string, dst netip.AddrPort) bool {
+	if p == nil {
+		return true
+	}
+	for i := range p.Rules {
+		if p.Rules[i].matches(proto, dst) {
+			return p.Rules[i].Action == "allow"
+		}
+	}
+	return p.Default == "allow"
+}
+
+// allowsByDst reports whether the first rule matching a proto flow to dst
+// allows it and names its destinations, rather than the flow being allowed
+// by a rule for any destination or by the default. A nil policy allows
+// nothing this way.
+func (p *EgressPolicy) allowsByDst(proto string, dst netip.AddrPort) bool {
+	if p == nil {
+		return false
+	}
+	for i := range p.Rules {
+		if p.Rules[i].matches(proto, dst) {
+			return p.Rules[i].Action == "allow" && len(p.Rules[i].Dst) > 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// TestEgressPolicy tests first-match evaluation of egress rules.
+func TestEgressPolicy(t *testing.T) {
+	policy, err := parseEgressPolicy([]byte(`{
+		// Web and DNS only, never the metadata service.
+		"default": "deny",
+		"rules": [
+			{"action": "deny", "dst": ["169.254.0.0/16"]},
+			{"action": "allow", "proto": "tcp", "ports": ["80", "443", "8000-8100"]},
+			{"action": "allow", "proto": "udp", "dst": ["192.0.2.53/32"], "ports": ["53"]},
+		],
+	}`))
+	if err != nil {
+		t.Fatalf("parseEgressPolicy failed: %v", err)
+	}
+
+	tests := []struct {
+		proto string
+		dst   string
+		want  bool
+	}{
+		{"tcp", "198.51.100.1:443", true},
+		{"tcp", "[2001:db8::1]:80", true},
+		{"tcp", "198.51.100.1:8050", true},
+		{"tcp", "198.51.100.1:22", false},
+		{"udp", "198.51.100.1:443", false},
+		{"udp", "192.0.2.53:53", true},
+		{"udp", "192.0.2.54:53", false},
+		{"tcp", "169.254.169.254:80", false},
+	}
+	for _, tt := range tests {
+		if got := policy.Allow(tt.proto, netip.MustParseAddrPort(tt.dst)); got != tt.want {
+			t.Errorf("Allow(%s, %s) = %v, want %v", tt.proto, tt.dst, got, tt.want)
+		}
+	}
+
+	var none *EgressPolicy
+	if !none.Allow("tcp", netip.MustParseAddrPort("198.51.100.1:22")) {
+		t.Error("Expected no policy to allow everything")
+	}
+}
+
+// TestParseEgressPolicy_Invalid tests that malformed policies are rejected.
+func TestParseEgressPolicy_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{"bad default", `{"default": "maybe"}`, "default"},
+		{"bad action", `{"rules": [{"action": "permit"}]}`, "action"},
+		{"bad proto", `{"rules": [{"action": "allow", "proto": "icmp"}]}`, "proto"},
+		{"bad port", `{"rules": [{"action": "allow", "ports": ["http"]}]}`, "invalid port"},
+		{"bad range", `{"rules": [{"action": "allow", "ports": ["100-10"]}]}`, "invalid port range"},
+		{"bad cidr", `{"rules": [{"action": "allow", "dst": ["10.0.0.0/33"]}]}`, "parse"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseEgressPolicy([]byte(tt.policy))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	p, err := parseEgressPolicy([]byte(`{}`))
+	if err != nil || p.Default != "deny" {
+		t.Errorf("Expected an empty policy to deny by default, got %+v (%v)", p, err)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// exitNodeRoutes are advertised alongside the subnet routes when acting as
+// an exit node.
+var exitNodeRoutes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/0"),
+	netip.MustParsePrefix("::/0"),
+}
+
+// prefsEditor is the part of the LocalClient that the route manager needs.
+type prefsEditor interface {
+	EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error)
+}
+
+// parseRoutes parses and validates subnet routes. Routes must be valid,
+// masked prefixes that do not overlap each other; default routes are only
+// advertised through --exit-node.
+func parseRoutes(subnets []string) ([]netip.Prefix, error) {
+	var routes []netip.Prefix
+	for _, subnet := range subnets {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(subnet))
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %v", subnet, err)
+		}
+		if prefix != prefix.Masked() {
+			return nil, fmt.Errorf("invalid subnet %q: host bits set, did you mean %s?", subnet, prefix.Masked())
+		}
+		if prefix.Bits() == 0 {
+			return nil, fmt.Errorf("invalid subnet %q: use --exit-node to advertise default routes", subnet)
+		}
+		routes = append(routes, prefix)
+	}
+	return validateRoutes(routes)
+}
+
+// validateRoutes sorts routes, drops duplicates and rejects overlaps.
+func validateRoutes(routes []netip.Prefix) ([]netip.Prefix, error) {
+	routes = slices.Clone(routes)
+	slices.SortFunc(routes, comparePrefix)
+	routes = slices.Compact(routes)
+	for i, a := range routes {
+		for _, b := range routes[i+1:] {
+			if a.Overlaps(b) {
+				return nil, fmt.Errorf("subnets %s and %s overlap", a, b)
+			}
+		}
+	}
+	return routes, nil
+}
+
+func comparePrefix(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// diffRoutes returns the routes in cur but not prev, and in prev but not cur.
+func diffRoutes(prev, cur []netip.Prefix) (added, removed []netip.Prefix) {
+	for _, r := range cur {
+		if !slices.Contains(prev, r) {
+			added = append(added, r)
+		}
+	}
+	for _, r := range prev {
+		if !slices.Contains(cur, r) {
+			removed = append(removed, r)
+		}
+	}
+	return added, removed
+}
+
+func joinPrefixes(prefixes []netip.Prefix) string {
+	var strs []string
+	for _, p := range prefixes {
+		strs = append(strs, p.String())
+	}
+	return strings.Join(strs, ", ")
+}
+
+// RouteManager holds the subnet routes the node is configured with and
+// applies changes to them at runtime. Configured routes come from flags and
+// the API, and from the routes file; each is kept as its own layer, so that
+// reloading the file leaves routes added through the API alone and the API
+// cannot replace the file's routes. Configured routes can be temporarily
+// withdrawn, for example while they fail health checks. Routes learned for
+// app connector domains are kept separately, so that replacing the
+// configured routes leaves them alone.
+type RouteManager struct {
+	lc       prefsEditor
+	exitNode bool
+
+	mu           sync.Mutex
+	routes       []netip.Prefix // manual and fileRoutes, merged
+	manual       []netip.Prefix // from flags and the API
+	routesFile   bool
+	fileRoutes   []netip.Prefix
+	withdrawn    map[netip.Prefix]bool
+	appConnector bool
+	domainRoutes []netip.Prefix
+}
+
+// NewRouteManager returns a manager that advertises through lc.
+func NewRouteManager(lc prefsEditor, exitNode bool) *RouteManager {
+	return &RouteManager{lc: lc, exitNode: exitNode, withdrawn: make(map[netip.Prefix]bool)}
+}
+
+// Routes returns the configured subnet routes, including withdrawn ones.
+func (m *RouteManager) Routes() []netip.Prefix {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.routes)
+}
+
+// Withdrawn returns the configured routes that are not being advertised.
+func (m *RouteManager) Withdrawn() []netip.Prefix {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []netip.Prefix
+	for _, r := range m.routes {
+		if m.withdrawn[r] {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Advertised returns the routes currently being advertised: the configured
+// routes that are not withdrawn, the domain routes and, for an exit node,
+// the default routes.
+func (m *RouteManager) Advertised() []netip.Prefix {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.advertisedLocked(m.routes)
+}
+
+// DomainRoutes returns the routes learned for app connector domains.
+func (m *RouteManager) DomainRoutes() []netip.Prefix {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.domainRoutes)
+}
+
+// SetDomainRoutes replaces the routes learned for app connector domains.
+// Once it has been called, the manager may have no configured subnets.
+func (m *RouteManager) SetDomainRoutes(ctx context.Context, routes []netip.Prefix) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	routes = slices.Clone(routes)
+	slices.SortFunc(routes, comparePrefix)
+	routes = slices.Compact(routes)
+	m.appConnector = true
+	if slices.Equal(m.domainRoutes, routes) {
+		return nil
+	}
+	prev := m.domainRoutes
+	m.domainRoutes = routes
+	if err := m.advertiseLocked(ctx, m.routes); err != nil {
+		m.domainRoutes = prev
+		return err
+	}
+	added, removed := diffRoutes(prev, routes)
+	for _, r := range added {
+		log.Printf("domain route diff: + %s", r)
+	}
+	for _, r := range removed {
+		log.Printf("domain route diff: - %s", r)
+	}
+	return nil
+}
+
+// Set replaces the subnet routes configured by flags and the API. Routes
+// from the routes file are kept.
+func (m *RouteManager) Set(ctx context.Context, routes []netip.Prefix) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.setLocked(ctx, routes, m.fileRoutes)
+}
+
+// Add configures routes in addition to the current ones.
+func (m *RouteManager) Add(ctx context.Context, routes ...netip.Prefix) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.setLocked(ctx, append(slices.Clone(m.manual), routes...), m.fileRoutes)
+}
+
+// Remove stops advertising routes and forgets them. Routes from the routes
+// file can only be removed by editing the file.
+func (m *RouteManager) Remove(ctx context.Context, routes ...netip.Prefix) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var missing, inFile []netip.Prefix
+	for _, r := range routes {
+		switch {
+		case slices.Contains(m.manual, r):
+		case slices.Contains(m.fileRoutes, r):
+			inFile = append(inFile, r)
+		default:
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("not advertised: %s", joinPrefixes(missing))
+	}
+	if len(inFile) > 0 {
+		return fmt.Errorf("configured by the routes file: %s", joinPrefixes(inFile))
+	}
+	return m.setLocked(ctx, slices.DeleteFunc(slices.Clone(m.manual), func(r netip.Prefix) bool {
+		return slices.Contains(routes, r)
+	}), m.fileRoutes)
+}
+
+// SetFileRoutes replaces the routes read from the routes file, keeping
+// those configured by flags and the API. Once it has been called, the
+// manager may have no configured subnets until the file lists some.
+func (m *RouteManager) SetFileRoutes(ctx context.Context, routes []netip.Prefix) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routesFile = true
+	return m.setLocked(ctx, m.manual, routes)
+}
+
+// Withdraw stops advertising a configured route until it is restored.
+func (m *RouteManager) Withdraw(ctx context.Context, route netip.Prefix) error {
+	return m.setWithdrawn(ctx, route, true)
+}
+
+// Restore advertises a withdrawn route again.
+func (m *RouteManager) Restore(ctx context.Context, route netip.Prefix) error {
+	return m.setWithdrawn(ctx, route, false)
+}
+
+func (m *RouteManager) setWithdrawn(ctx context.Context, route netip.Prefix, withdrawn bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !slices.Contains(m.routes, route) {
+		return fmt.Errorf("not configured: %s", route)
+	}
+	if m.withdrawn[route] == withdrawn {
+		return nil
+	}
+	m.withdrawn[route] = withdrawn
+	if err := m.advertiseLocked(ctx, m.routes); err != nil {
+		m.withdrawn[route] = !withdrawn
+		return err
+	}
+	if withdrawn {
+		log.Printf("route withdrawn: %s", route)
+	} else {
+		log.Printf("route restored: %s", route)
+	}
+	return nil
+}
+
+// setLocked advertises the manual and file layers merged. A route in both
+// is advertised once; routes that overlap across layers are rejected.
+func (m *RouteManager) setLocked(ctx context.Context, manual, file []netip.Prefix) error {
+	routes, err := validateRoutes(append(slices.Clone(manual), file...))
+	if err != nil {
+		return err
+	}
+	added, removed := diffRoutes(m.routes, routes)
+	if m.routes != nil && len(added) == 0 && len(removed) == 0 {
+		m.manual, m.fileRoutes = slices.Clone(manual), slices.Clone(file)
+		return nil
+	}
+	if len(routes) == 0 && !m.exitNode && !m.appConnector && !m.routesFile {
+		return errors.New("no routes to advertise: specify subnets, --domain or --exit-node")
+	}
+
+	if err := m.advertiseLocked(ctx, routes); err != nil {
+		return err
+	}
+
+	for _, r := range added {
+		log.Printf("route diff: + %s", r)
+	}
+	for _, r := range removed {
+		log.Printf("route diff: - %s", r)
+		delete(m.withdrawn, r)
+	}
+	m.routes = routes
+	m.manual, m.fileRoutes = slices.Clone(manual), slices.Clone(file)
+	return nil
+}
+
+// advertiseLocked advertises routes, less any that are withdrawn, along
+// with the domain routes.
+func (m *RouteManager) advertiseLocked(ctx context.Context, routes []netip.Prefix) error {
+	mp := &ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			AdvertiseRoutes: m.advertisedLocked(routes),
+		},
+		AdvertiseRoutesSet: true,
+	}
+	if _, err := m.lc.EditPrefs(ctx, mp); err != nil {
+		return fmt.Errorf("edit prefs: %w", err)
+	}
+	return nil
+}
+
+func (m *RouteManager) advertisedLocked(routes []netip.Prefix) []netip.Prefix {
+	advertise := []netip.Prefix{}
+	for _, r := range routes {
+		if !m.withdrawn[r] {
+			advertise = append(advertise, r)
+		}
+	}
+	advertise = append(advertise, m.domainRoutes...)
+	if m.exitNode {
+		advertise = append(advertise, exitNodeRoutes...)
+	}
+	return advertise
+}
+
+// readRoutesFile reads subnets from path, one per line. Blank lines and
+// lines starting with # are ignored.
+func readRoutesFile(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var subnets []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		subnets = append(subnets, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseRoutes(subnets)
+}
+
+// watchRoutesFile polls path and, whenever it changes, replaces the file's
+// layer of routes. Invalid files are logged and leave the current routes in
+// place.
+func watchRoutesFile(ctx context.Context, m *RouteManager, path string, interval time.Duration) {
+	var modTime time.Time
+	var size int64
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Printf("routes file: %v", err)
+			continue
+		}
+		if fi.ModTime().Equal(modTime) && fi.Size() == size {
+			continue
+		}
+		modTime, size = fi.ModTime(), fi.Size()
+
+		routes, err := readRoutesFile(path)
+		if err != nil {
+			log.Printf("routes file %s rejected: %v", path, err)
+			continue
+		}
+		if err := m.SetFileRoutes(ctx, routes); err != nil {
+			log.Printf("routes file %s rejected: %v", path, err)
+		}
+	}
+}
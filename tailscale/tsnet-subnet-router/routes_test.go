@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// fakePrefs records the routes advertised through EditPrefs.
+type fakePrefs struct {
+	mu     sync.Mutex
+	routes []netip.Prefix
+	edits  int
+	err    error
+}
+
+func (f *fakePrefs) EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	if !mp.AdvertiseRoutesSet {
+		return nil, errors.New("AdvertiseRoutesSet not set")
+	}
+	f.routes = mp.AdvertiseRoutes
+	f.edits++
+	return &mp.Prefs, nil
+}
+
+func (f *fakePrefs) get() (string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return joinPrefixes(f.routes), f.edits
+}
+
+// TestParseRoutes tests route validation.
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnets []string
+		want    string
+		wantErr string
+	}{
+		{"sorted", []string{"192.168.1.0/24", "10.0.0.0/8", "fd00::/64"}, "10.0.0.0/8, 192.168.1.0/24, fd00::/64", ""},
+		{"duplicates", []string{"10.0.0.0/8", "10.0.0.0/8"}, "10.0.0.0/8", ""},
+		{"invalid", []string{"10.0.0.0/33"}, "", "invalid subnet"},
+		{"host bits", []string{"10.0.0.1/24"}, "", "10.0.0.0/24"},
+		{"overlap", []string{"10.0.0.0/8", "10.1.0.0/16"}, "", "overlap"},
+		{"default route", []string{"0.0.0.0/0"}, "", "--exit-node"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, err := parseRoutes(tt.subnets)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRoutes failed: %v", err)
+			}
+			if got := joinPrefixes(routes); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestRouteManager tests adding and removing routes at runtime.
+func TestRouteManager(t *testing.T) {
+	ctx := context.Background()
+	prefs := &fakePrefs{}
+	m := NewRouteManager(prefs, true)
+
+	if err := m.Set(ctx, mustRoutes(t, "10.0.0.0/24")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if got, _ := prefs.get(); got != "10.0.0.0/24, 0.0.0.0/0, ::/0" {
+		t.Errorf("Expected subnet and exit node routes, got %s", got)
+	}
+
+	if err := m.Add(ctx, mustRoutes(t, "10.0.1.0/24")...); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := m.Add(ctx, mustRoutes(t, "10.0.0.0/16")...); err == nil {
+		t.Error("Expected overlapping route to be rejected")
+	}
+	if err := m.Remove(ctx, mustRoutes(t, "10.0.0.0/24")...); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := m.Remove(ctx, mustRoutes(t, "192.168.0.0/24")...); err == nil {
+		t.Error("Expected removing an unknown route to fail")
+	}
+	if got := joinPrefixes(m.Routes()); got != "10.0.1.0/24" {
+		t.Errorf("Expected 10.0.1.0/24, got %s", got)
+	}
+
+	// Setting the same routes again is a no-op.
+	_, edits := prefs.get()
+	m.Set(ctx, mustRoutes(t, "10.0.1.0/24"))
+	if _, after := prefs.get(); after != edits {
+		t.Errorf("Expected no edit for unchanged routes")
+	}
+
+	prefs.err = errors.New("localapi down")
+	if err := m.Add(ctx, mustRoutes(t, "10.0.2.0/24")...); err == nil {
+		t.Error("Expected EditPrefs error")
+	}
+	if got := joinPrefixes(m.Routes()); got != "10.0.1.0/24" {
+		t.Errorf("Expected routes unchanged after a failed edit, got %s", got)
+	}
+}
+
+// TestRouteManager_NoRoutes tests that a subnet router must advertise
+// something.
+func TestRouteManager_NoRoutes(t *testing.T) {
+	if err := NewRouteManager(&fakePrefs{}, false).Set(context.Background(), nil); err == nil {
+		t.Error("Expected error with no routes")
+	}
+	if err := NewRouteManager(&fakePrefs{}, true).Set(context.Background(), nil); err != nil {
+		t.Errorf("Expected an exit node without subnets to be allowed, got %v", err)
+	}
+}
+
+// TestAPIHandler tests the local route API.
+func TestAPIHandler(t *testing.T) {
+	prefs := &fakePrefs{}
+	m := NewRouteManager(prefs, false)
+	m.Set(context.Background(), mustRoutes(t, "10.0.0.0/24"))
+	server := httptest.NewServer(apiHandler(m, NewCounters()))
+	defer server.Close()
+
+	do := func(method, body string) (int, routesResponse) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+"/routes", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s failed: %v", method, err)
+		}
+		defer resp.Body.Close()
+		var out routesResponse
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	if code, out := do(http.MethodPost, `{"routes": ["10.0.1.0/24"]}`); code != http.StatusOK || len(out.Routes) != 2 {
+		t.Errorf("POST: got %d %+v", code, out)
+	}
+	if code, _ := do(http.MethodPost, `{"routes": ["10.0.0.0/8"]}`); code != http.StatusBadRequest {
+		t.Errorf("POST overlapping: expected 400, got %d", code)
+	}
+	if code, _ := do(http.MethodPost, `{"routes": ["bogus"]}`); code != http.StatusBadRequest {
+		t.Errorf("POST invalid: expected 400, got %d", code)
+	}
+	if code, out := do(http.MethodDelete, `{"routes": ["10.0.0.0/24"]}`); code != http.StatusOK || len(out.Routes) != 1 {
+		t.Errorf("DELETE: got %d %+v", code, out)
+	}
+	if code, out := do(http.MethodPut, `{"routes": ["172.16.0.0/12"]}`); code != http.StatusOK || joinPrefixes(out.Routes) != "172.16.0.0/12" {
+		t.Errorf("PUT: got %d %+v", code, out)
+	}
+	if got, _ := prefs.get(); got != "172.16.0.0/12" {
+		t.Errorf("Expected PUT to be advertised, got %s", got)
+	}
+	if code, out := do(http.MethodGet, ""); code != http.StatusOK || joinPrefixes(out.Routes) != "172.16.0.0/12" {
+		t.Errorf("GET: got %d %+v", code, out)
+	}
+}
+
+// TestWatchRoutesFile tests that edits to the routes file are applied and
+// TestLocalAddr tests that local servers default to loopback.
+func TestLocalAddr(t *testing.T) {
+	tests := map[string]string{
+		":8081":          "127.0.0.1:8081",
+		"127.0.0.1:9080": "127.0.0.1:9080",
+		"0.0.0.0:9080":   "0.0.0.0:9080",
+		"[::1]:9080":     "[::1]:9080",
+	}
+	for addr, want := range tests {
+		if got := localAddr(addr); got != want {
+			t.Errorf("localAddr(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+// invalid edits are ignored.
+func TestWatchRoutesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes")
+	os.WriteFile(path, []byte("# lab\n10.0.0.0/24\n"), 0o644)
+
+	prefs := &fakePrefs{}
+	m := NewRouteManager(prefs, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Set(ctx, mustRoutes(t, "192.168.0.0/24"))
+
+	go watchRoutesFile(ctx, m, path, 10*time.Millisecond)
+
+	waitFor(t, func() bool { got, _ := prefs.get(); return got == "10.0.0.0/24, 192.168.0.0/24" })
+
+	os.WriteFile(path, []byte("10.0.0.0/24\n10.0.0.0/16\n"), 0o644)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	if got, _ := prefs.get(); got != "10.0.0.0/24, 192.168.0.0/24" {
+		t.Errorf("Expected invalid file to be ignored, got %s", got)
+	}
+
+	os.WriteFile(path, []byte("10.0.1.0/24\n"), 0o644)
+	os.Chtimes(path, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	waitFor(t, func() bool { got, _ := prefs.get(); return got == "10.0.1.0/24, 192.168.0.0/24" })
+}
+
+// TestWatchRoutesFile_APIRoutes tests that routes added through the API
+// survive a reload of the routes file, and that the API cannot replace or
+// remove the file's routes.
+func TestWatchRoutesFile_APIRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes")
+	os.WriteFile(path, []byte("10.0.0.0/24\n"), 0o644)
+
+	prefs := &fakePrefs{}
+	m := NewRouteManager(prefs, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchRoutesFile(ctx, m, path, 10*time.Millisecond)
+	waitFor(t, func() bool { got, _ := prefs.get(); return got == "10.0.0.0/24" })
+
+	if err := m.Add(ctx, mustRoutes(t, "172.16.0.0/24")...); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	os.WriteFile(path, []byte("10.0.1.0/24\n"), 0o644)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	waitFor(t, func() bool { got, _ := prefs.get(); return got == "10.0.1.0/24, 172.16.0.0/24" })
+
+	if err := m.Set(ctx, mustRoutes(t, "192.168.0.0/24")); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if got := joinPrefixes(m.Routes()); got != "10.0.1.0/24, 192.168.0.0/24" {
+		t.Errorf("Expected Set to keep the file's routes, got %s", got)
+	}
+	if err := m.Remove(ctx, mustRoutes(t, "10.0.1.0/24")...); err == nil {
+		t.Error("Expected removing a route from the routes file to fail")
+	}
+}
+
+func mustRoutes(t *testing.T, subnets ...string) []netip.Prefix {
+	t.Helper()
+	routes, err := parseRoutes(subnets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return routes
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
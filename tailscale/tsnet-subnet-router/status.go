@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// healthResponse is the body of GET /healthz.
+type healthResponse struct {
+	BackendState string `json:"backend_state"`
+	// ApprovedRoutes are advertised routes that the tailnet has approved;
+	// PendingRoutes are waiting for an admin, or an autoApprover, to
+	// approve them.
+	ApprovedRoutes  []netip.Prefix `json:"approved_routes"`
+	PendingRoutes   []netip.Prefix `json:"pending_routes"`
+	WithdrawnRoutes []netip.Prefix `json:"withdrawn_routes,omitempty"`
+	Error           string         `json:"error,omitempty"`
+}
+
+// routeApproval splits the advertised routes into those approved in the
+// netmap, which control adds to the node's AllowedIPs, and those pending.
+func routeApproval(st *ipnstate.Status, advertised []netip.Prefix) (approved, pending []netip.Prefix) {
+	var allowed []netip.Prefix
+	if st.Self != nil && st.Self.AllowedIPs != nil {
+		allowed = st.Self.AllowedIPs.AsSlice()
+	}
+	approved, pending = []netip.Prefix{}, []netip.Prefix{}
+	for _, r := range advertised {
+		if slices.Contains(allowed, r) {
+			approved = append(approved, r)
+		} else {
+			pending = append(pending, r)
+		}
+	}
+	return approved, pending
+}
+
+// statusHandler serves the router's health and metrics:
+//
+//	GET /healthz  backend state and route approval; 200 while running,
+//	              503 otherwise
+//	GET /metrics  the same, and forwarding counters, for Prometheus
+func statusHandler(status func(context.Context) (*ipnstate.Status, error), m *RouteManager, counters *Counters) http.Handler {
+	check := func(ctx context.Context) healthResponse {
+		var resp healthResponse
+		st, err := status(ctx)
+		if err != nil {
+			resp.Error = err.Error()
+			return resp
+		}
+		resp.BackendState = st.BackendState
+		resp.ApprovedRoutes, resp.PendingRoutes = routeApproval(st, m.Advertised())
+		resp.WithdrawnRoutes = m.Withdrawn()
+		return resp
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		resp := check(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if resp.BackendState != ipn.Running.String() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		resp := check(r.Context())
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		up := 0
+		if resp.BackendState == ipn.Running.String() {
+			up = 1
+		}
+		metric(w, "up", "gauge", "Whether the node is running on the tailnet.")
+		fmt.Fprintf(w, "tsnet_subnet_router_up %d\n", up)
+		if resp.BackendState != "" {
+			metric(w, "backend_state", "gauge", "The node's backend state.")
+			fmt.Fprintf(w, "tsnet_subnet_router_backend_state{state=%q} 1\n", resp.BackendState)
+		}
+
+		metric(w, "route_approved", "gauge", "Whether an advertised route is approved (1) or pending approval (0).")
+		for _, route := range resp.ApprovedRoutes {
+			fmt.Fprintf(w, "tsnet_subnet_router_route_approved{route=%q} 1\n", route)
+		}
+		for _, route := range resp.PendingRoutes {
+			fmt.Fprintf(w, "tsnet_subnet_router_route_approved{route=%q} 0\n", route)
+		}
+		metric(w, "routes_withdrawn", "gauge", "Configured routes withdrawn because they are failing health checks.")
+		fmt.Fprintf(w, "tsnet_subnet_router_routes_withdrawn %d\n", len(resp.WithdrawnRoutes))
+
+		snapshot := counters.Snapshot()
+		peers := make([]netip.Addr, 0, len(snapshot))
+		for peer := range snapshot {
+			peers = append(peers, peer)
+		}
+		slices.SortFunc(peers, netip.Addr.Compare)
+		metric(w, "forwarded_bytes_total", "counter", "Bytes forwarded per peer, by direction.")
+		for _, peer := range peers {
+			pc := snapshot[peer]
+			fmt.Fprintf(w, "tsnet_subnet_router_forwarded_bytes_total{peer=%q,direction=\"sent\"} %d\n", peer, pc.Sent)
+			fmt.Fprintf(w, "tsnet_subnet_router_forwarded_bytes_total{peer=%q,direction=\"received\"} %d\n", peer, pc.Received)
+		}
+		metric(w, "forwarded_flows_total", "counter", "Flows forwarded per peer.")
+		for _, peer := range peers {
+			fmt.Fprintf(w, "tsnet_subnet_router_forwarded_flows_total{peer=%q} %d\n", peer, snapshot[peer].Flows)
+		}
+		metric(w, "denied_flows_total", "counter", "Flows denied by the egress policy per peer.")
+		for _, peer := range peers {
+			fmt.Fprintf(w, "tsnet_subnet_router_denied_flows_total{peer=%q} %d\n", peer, snapshot[peer].Denied)
+		}
+	})
+	return mux
+}
+
+// metric writes the HELP and TYPE lines for a metric.
+func metric(w http.ResponseWriter, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP tsnet_subnet_router_%s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE tsnet_subnet_router_%s %s\n", name, typ)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/views"
+)
+
+// TestStatusHandler tests /healthz and /metrics, including route approval.
+func TestStatusHandler(t *testing.T) {
+	ctx := context.Background()
+	m := NewRouteManager(&fakePrefs{}, false)
+	m.Set(ctx, mustRoutes(t, "10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"))
+	m.Withdraw(ctx, netip.MustParsePrefix("10.0.2.0/24"))
+
+	allowed := views.SliceOf(mustRoutes(t, "100.64.0.1/32", "10.0.0.0/24"))
+	st := &ipnstate.Status{
+		BackendState: "Running",
+		Self:         &ipnstate.PeerStatus{AllowedIPs: &allowed},
+	}
+	var statusErr error
+	counters := NewCounters()
+	peer := netip.MustParseAddr("100.64.0.2")
+	counters.update(peer, func(pc *PeerCounters) { pc.Sent, pc.Received, pc.Flows = 10, 20, 1 })
+	handler := statusHandler(func(context.Context) (*ipnstate.Status, error) { return st, statusErr }, m, counters)
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		body, _ := io.ReadAll(rec.Body)
+		return rec.Code, string(body)
+	}
+
+	code, body := get("/healthz")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 while running, got %d: %s", code, body)
+	}
+	var resp healthResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if joinPrefixes(resp.ApprovedRoutes) != "10.0.0.0/24" || joinPrefixes(resp.PendingRoutes) != "10.0.1.0/24" || joinPrefixes(resp.WithdrawnRoutes) != "10.0.2.0/24" {
+		t.Errorf("Unexpected routes %+v", resp)
+	}
+
+	_, body = get("/metrics")
+	for _, want := range []string{
+		"tsnet_subnet_router_up 1\n",
+		`tsnet_subnet_router_backend_state{state="Running"} 1`,
+		`tsnet_subnet_router_route_approved{route="10.0.0.0/24"} 1`,
+		`tsnet_subnet_router_route_approved{route="10.0.1.0/24"} 0`,
+		"tsnet_subnet_router_routes_withdrawn 1\n",
+		`tsnet_subnet_router_forwarded_bytes_total{peer="100.64.0.2",direction="received"} 20`,
+		`tsnet_subnet_router_forwarded_flows_total{peer="100.64.0.2"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+
+	st.BackendState = "NeedsLogin"
+	if code, body := get("/healthz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "NeedsLogin") {
+		t.Errorf("Expected 503 while logging in, got %d: %s", code, body)
+	}
+
+	statusErr = errors.New("local API unavailable")
+	if code, _ := get("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when status fails, got %d", code)
+	}
+	if _, body := get("/metrics"); !strings.Contains(body, "tsnet_subnet_router_up 0\n") {
+		t.Errorf("Expected up 0 when status fails, got:\n%s", body)
+	}
+}
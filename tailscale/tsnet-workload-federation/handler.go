@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// newHandler returns the handler served on the tailnet for cfg's mode.
+func newHandler(cfg Config) (http.Handler, error) {
+	switch cfg.Handler {
+	case "hello", "":
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "hello from tsnet via WIF!\nremote addr: %s\n", r.RemoteAddr)
+		}), nil
+	case "proxy":
+		if cfg.Upstream == "" {
+			return nil, errors.New("--upstream is required with --handler=proxy")
+		}
+		target, err := url.Parse(cfg.Upstream)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q: want a URL like http://localhost:3000", cfg.Upstream)
+		}
+		return httputil.NewSingleHostReverseProxy(target), nil
+	case "static":
+		if cfg.StaticDir == "" {
+			return nil, errors.New("--static-dir is required with --handler=static")
+		}
+		fi, err := os.Stat(cfg.StaticDir)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", cfg.StaticDir)
+		}
+		return http.FileServer(http.Dir(cfg.StaticDir)), nil
+	default:
+		return nil, fmt.Errorf("unknown handler %q", cfg.Handler)
+	}
+}
+
+// healthHandler reports 200 while the node is running on the tailnet and
+// 503 otherwise, for orchestrator liveness and readiness probes.
+func healthHandler(status func(context.Context) (*ipnstate.Status, error)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		st, err := status(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if st.BackendState != ipn.Running.String() {
+			http.Error(w, "backend state "+st.BackendState, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// localAddr binds addr to loopback if it has no host, since /healthz is
+// unauthenticated. ":8081" would otherwise listen on every interface; pass
+// "0.0.0.0:8081" to mean that.
+func localAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/jaxxstorm/tailscale-examples/tailscale/tsnet-workload-federation/wif"
+)
+
+// newJWTSource returns the JWT source selected by cfg. Exactly one source
+// must be given.
+func newJWTSource(cfg Config) (wif.JWTSource, error) {
+	var sources []wif.JWTSource
+	if cfg.JWT != "" {
+		sources = append(sources, wif.StaticJWT(cfg.JWT))
+	}
+	if cfg.JWTFile != "" {
+		sources = append(sources, &wif.FileJWT{Path: cfg.JWTFile})
+	}
+	if cfg.JWTExec != "" {
+		sources = append(sources, wif.ExecJWT{Command: []string{"sh", "-c", cfg.JWTExec}})
+	}
+	if cfg.JWTGitHubActions {
+		gha, err := wif.GitHubActionsJWTFromEnv(cfg.JWTAudience)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, gha)
+	}
+	if cfg.JWTURL != "" {
+		header := make(http.Header)
+		for k, v := range cfg.JWTHeaders {
+			header.Set(k, v)
+		}
+		sources = append(sources, &wif.MetadataJWT{
+			URL:           cfg.JWTURL,
+			Audience:      cfg.JWTAudience,
+			AudienceParam: cfg.JWTAudienceParam,
+			Header:        header,
+		})
+	}
+
+	switch len(sources) {
+	case 0:
+		return nil, errors.New("one of --jwt, --jwt-file, --jwt-exec, --jwt-github-actions or --jwt-url is required")
+	case 1:
+		return sources[0], nil
+	default:
+		return nil, errors.New("--jwt, --jwt-file, --jwt-exec, --jwt-github-actions and --jwt-url are mutually exclusive")
+	}
+}
@@ -2,152 +2,148 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
-	"golang.org/x/oauth2/clientcredentials"
+	"github.com/jaxxstorm/tailscale-examples/tailscale/tsnet-workload-federation/wif"
 	"tailscale.com/tsnet"
 )
 
-const (
-	defaultTailscaleAPIBase = "https://api.tailscale.com"
-)
-
-var (
-	tailscaleAPIBase = defaultTailscaleAPIBase
-)
+// shutdownTimeout bounds draining connections and logging out on exit.
+const shutdownTimeout = 10 * time.Second
 
 func main() {
 	var cfg Config
 	kong.Parse(&cfg)
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Exchange JWT for Tailscale access token
-	fmt.Println("Exchanging JWT for Tailscale access token...")
-	accessToken, err := exchangeJWTForAccessToken(ctx, cfg.ClientID, cfg.JWT)
+	jwt, err := newJWTSource(cfg)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error exchanging JWT: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Println("Got access token (prefix):", prefix(accessToken))
 
-	// Create auth key using the access token
-	fmt.Println("Creating auth key...")
-	authKey, err := createAuthKey(ctx, accessToken, cfg.Tag)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating auth key: %v\n", err)
+	// Every renewal of the access token exchanges the current JWT, so a
+	// rotated JWT is used for both the first login and any reauth.
+	wcfg := wif.Config{
+		ClientID: cfg.ClientID,
+		JWT:      jwt,
+	}
+	opts := wif.AuthKeyOptions{
+		Tags:          cfg.Tags,
+		Ephemeral:     cfg.Ephemeral,
+		Reusable:      cfg.Reusable,
+		Preauthorized: cfg.Preauthorized,
+		Expiry:        cfg.KeyExpiry,
+		Description:   cfg.KeyDescription,
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Println("Got auth key (prefix):", prefix(authKey))
+	minter := wif.NewAuthKeyMinter(wcfg, wif.TokenSource(ctx, wcfg), opts)
 
-	// Start a tsnet server with that auth key
-	if err := startTsnetServer(ctx, cfg.Hostname, authKey, cfg.Port); err != nil {
+	// Start a tsnet server, minting its auth key only if it needs one
+	if err := startTsnetServer(ctx, cfg, printingMinter{minter}); err != nil {
 		fmt.Fprintf(os.Stderr, "Error starting tsnet server: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-// exchangeJWTForAccessToken exchanges a JWT for a Tailscale access token using oauth2.
-func exchangeJWTForAccessToken(ctx context.Context, clientID, jwt string) (string, error) {
-	config := clientcredentials.Config{
-		ClientID: clientID,
-		TokenURL: tailscaleAPIBase + "/api/v2/oauth/token-exchange",
-		EndpointParams: url.Values{
-			"jwt": {jwt},
-		},
-	}
+// printingMinter reports each auth key it mints.
+type printingMinter struct {
+	wif.AuthKeySource
+}
 
-	token, err := config.Token(ctx)
+func (m printingMinter) AuthKey(ctx context.Context) (string, error) {
+	fmt.Println("Exchanging JWT and creating auth key...")
+	authKey, err := m.AuthKeySource.AuthKey(ctx)
 	if err != nil {
-		return "", fmt.Errorf("token exchange failed: %w", err)
-	}
-
-	if token.AccessToken == "" {
-		return "", fmt.Errorf("no access token in response")
+		return "", fmt.Errorf("creating auth key: %w", err)
 	}
-
-	return token.AccessToken, nil
+	fmt.Println("Got auth key (prefix):", prefix(authKey))
+	return authKey, nil
 }
 
-// createAuthKey creates a Tailscale auth key using an access token.
-func createAuthKey(ctx context.Context, accessToken, tag string) (string, error) {
-	reqBody := AuthKeyRequest{
-		Capabilities: AuthKeyCapabilities{
-			Devices: DeviceCapabilities{
-				Create: DeviceCreateCapabilities{
-					Reusable:      false,
-					Ephemeral:     true,
-					Preauthorized: true,
-					Tags:          []string{tag},
-				},
-			},
-		},
-		ExpirySeconds: int((24 * time.Hour).Seconds()),
-		Description:   "tsnet WIF demo",
-	}
-
-	buf, err := json.Marshal(&reqBody)
+// startTsnetServer starts a tsnet server, keeps it logged in with keys
+// from keys, checks that it came up with the requested tags, and serves
+// until ctx is done.
+func startTsnetServer(ctx context.Context, cfg Config, keys wif.AuthKeySource) error {
+	handler, err := newHandler(cfg)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
-		tailscaleAPIBase+"/api/v2/tailnet/-/keys",
-		strings.NewReader(string(buf)),
-	)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+	var s tsnet.Server
+	s.Hostname = cfg.Hostname
+	s.Dir = cfg.StateDir
+	s.ControlURL = cfg.ControlURL
+	s.Ephemeral = cfg.Ephemeral
+	defer s.Close()
 
-	resp, err := http.DefaultClient.Do(req)
+	status, err := wif.Up(ctx, &s, keys)
 	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("create auth key failed: %s: %s", resp.Status, string(body))
+		return fmt.Errorf("tsnet up: %w", err)
 	}
-
-	var out AuthKeyResponse
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return "", err
+	if err := wif.VerifyTags(status, cfg.Tags); err != nil {
+		return fmt.Errorf("verifying tags: %w", err)
 	}
-	if out.Key == "" {
-		return "", fmt.Errorf("empty key in create auth key response")
+	lc, err := s.LocalClient()
+	if err != nil {
+		return err
 	}
-	return out.Key, nil
-}
 
-// startTsnetServer starts a tsnet server with the given auth key.
-func startTsnetServer(ctx context.Context, hostname, authKey, port string) error {
-	var s tsnet.Server
-	s.Hostname = hostname
-	s.AuthKey = authKey
-	defer s.Close()
-
-	ln, err := s.Listen("tcp", port)
+	ln, err := s.Listen("tcp", cfg.Port)
 	if err != nil {
 		return fmt.Errorf("tsnet listen: %w", err)
 	}
 	defer ln.Close()
 
-	fmt.Printf("tsnet server listening on tailnet port %s\n", port)
+	srv := &http.Server{Handler: handler}
+	errc := make(chan error, 2)
+	go func() { errc <- srv.Serve(ln) }()
+	fmt.Printf("tsnet server listening on tailnet port %s (%s handler)\n", cfg.Port, cfg.Handler)
+
+	var health *http.Server
+	if cfg.HealthAddr != "" {
+		hln, err := net.Listen("tcp", localAddr(cfg.HealthAddr))
+		if err != nil {
+			return fmt.Errorf("health listen: %w", err)
+		}
+		health = &http.Server{Handler: healthHandler(lc.StatusWithoutPeers)}
+		go func() { errc <- health.Serve(hln) }()
+		fmt.Printf("health check listening on http://%s/healthz\n", hln.Addr())
+	}
 
-	return http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "hello from tsnet via WIF!\nremote addr: %s\n", r.RemoteAddr)
-	}))
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	// ctx is done, which has also stopped wif from logging the node back in.
+	fmt.Println("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+	if health != nil {
+		health.Shutdown(shutdownCtx)
+	}
+	if cfg.Ephemeral {
+		fmt.Println("Logging out ephemeral node...")
+		if err := lc.Logout(shutdownCtx); err != nil {
+			return fmt.Errorf("logout: %w", err)
+		}
+	}
+	return nil
 }
 
 // prefix returns the first 10 characters of a string for display purposes.
@@ -1,48 +1,34 @@
 package main
 
-// OAuthTokenResponse represents the response from the WIF token-exchange endpoint.
-type OAuthTokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	ExpiresIn   int    `json:"expires_in"`
-}
+import "time"
 
-// AuthKeyRequest represents the payload to create a Tailscale auth key.
-type AuthKeyRequest struct {
-	Capabilities  AuthKeyCapabilities `json:"capabilities"`
-	ExpirySeconds int                 `json:"expirySeconds,omitempty"`
-	Description   string              `json:"description,omitempty"`
-}
+// Config holds the application configuration.
+type Config struct {
+	ClientID string `kong:"required,env='TS_WIF_CLIENT_ID',help='Tailscale WIF client ID'"`
+	JWT      string `kong:"env='TS_WIF_JWT',help='JWT token for workload identity federation'"`
+	JWTFile  string `kong:"name='jwt-file',env='TS_WIF_JWT_FILE',help='File containing the JWT, re-read whenever it changes'"`
 
-// AuthKeyCapabilities defines the capabilities for the auth key.
-type AuthKeyCapabilities struct {
-	Devices DeviceCapabilities `json:"devices"`
-}
+	JWTExec          string            `kong:"name='jwt-exec',env='TS_WIF_JWT_EXEC',help='Shell command that prints the JWT, run before each exchange'"`
+	JWTGitHubActions bool              `kong:"name='jwt-github-actions',env='TS_WIF_JWT_GITHUB_ACTIONS',help='Request the JWT from the GitHub Actions OIDC provider'"`
+	JWTURL           string            `kong:"name='jwt-url',env='TS_WIF_JWT_URL',help='Metadata URL to fetch the JWT from, such as GCP or Azure instance metadata'"`
+	JWTAudience      string            `kong:"name='jwt-audience',env='TS_WIF_JWT_AUDIENCE',help='Audience to request with --jwt-github-actions or --jwt-url'"`
+	JWTAudienceParam string            `kong:"name='jwt-audience-param',default='audience',help='Query parameter for the audience with --jwt-url (Azure uses resource)'"`
+	JWTHeaders       map[string]string `kong:"name='jwt-header',help='Header to send with --jwt-url, as name=value (repeatable)'"`
+	Tags             []string          `kong:"name='tag',default='tag:tsnet-wif-demo',env='TS_TAG',help='Tailscale tag for the device (repeatable)'"`
 
-// DeviceCapabilities defines device-specific capabilities.
-type DeviceCapabilities struct {
-	Create DeviceCreateCapabilities `json:"create"`
-}
+	Ephemeral      bool          `kong:"negatable,default='true',help='Create an ephemeral node that is removed when it goes offline'"`
+	Reusable       bool          `kong:"help='Create a reusable auth key'"`
+	Preauthorized  bool          `kong:"negatable,default='true',help='Create a preauthorized auth key'"`
+	KeyExpiry      time.Duration `kong:"name='key-expiry',default='24h',help='How long the auth key is valid for'"`
+	KeyDescription string        `kong:"name='key-description',default='tsnet WIF demo',help='Description of the auth key'"`
 
-// DeviceCreateCapabilities defines capabilities for creating devices.
-type DeviceCreateCapabilities struct {
-	Reusable      bool     `json:"reusable"`
-	Ephemeral     bool     `json:"ephemeral"`
-	Preauthorized bool     `json:"preauthorized"`
-	Tags          []string `json:"tags,omitempty"`
-}
-
-// AuthKeyResponse represents the response from creating an auth key.
-type AuthKeyResponse struct {
-	Key string `json:"key"`
-	ID  string `json:"id,omitempty"`
-}
+	Hostname   string `kong:"default='tsnet-wif-demo',env='TS_HOSTNAME',help='Hostname for the tsnet server'"`
+	Port       string `kong:"default=':8080',env='TS_PORT',help='Port to listen on'"`
+	StateDir   string `kong:"name='state-dir',env='TS_STATE_DIR',help='Directory to keep tsnet state in, so restarts reuse the same node'"`
+	ControlURL string `kong:"name='control-url',env='TS_CONTROL_URL',help='Coordination server URL, if not Tailscale'"`
 
-// Config holds the application configuration.
-type Config struct {
-	ClientID string `kong:"required,env='TS_WIF_CLIENT_ID',help='Tailscale WIF client ID'"`
-	JWT      string `kong:"required,env='TS_WIF_JWT',help='JWT token for workload identity federation'"`
-	Tag      string `kong:"default='tag:tsnet-wif-demo',env='TS_TAG',help='Tailscale tag for the device'"`
-	Hostname string `kong:"default='tsnet-wif-demo',env='TS_HOSTNAME',help='Hostname for the tsnet server'"`
-	Port     string `kong:"default=':8080',env='TS_PORT',help='Port to listen on'"`
+	Handler    string `kong:"enum='hello,proxy,static',default='hello',env='TS_HANDLER',help='What to serve on the tailnet: hello, proxy or static'"`
+	Upstream   string `kong:"env='TS_UPSTREAM',help='Upstream URL for --handler=proxy'"`
+	StaticDir  string `kong:"name='static-dir',env='TS_STATIC_DIR',help='Directory to serve for --handler=static'"`
+	HealthAddr string `kong:"name='health-addr',default='127.0.0.1:8081',env='TS_HEALTH_ADDR',help='Local address for /healthz; a bare :port binds to loopback, empty to disable'"`
 }
@@ -0,0 +1,128 @@
+package wif
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// AuthKeyOptions are the properties of minted auth keys.
+type AuthKeyOptions struct {
+	// Tags are applied to nodes that log in with the key. Keys minted with
+	// a federated identity must be tagged.
+	Tags          []string
+	Ephemeral     bool
+	Reusable      bool
+	Preauthorized bool
+	// Expiry is how long the key is valid for. Zero uses the API default.
+	Expiry      time.Duration
+	Description string
+}
+
+// AuthKeyMinter creates auth keys with an access token from a TokenSource.
+type AuthKeyMinter struct {
+	tokens  oauth2.TokenSource
+	baseURL string
+	client  *http.Client
+	opts    AuthKeyOptions
+}
+
+// NewAuthKeyMinter returns a minter that creates keys with opts in the
+// tailnet that cfg's identity belongs to.
+func NewAuthKeyMinter(cfg Config, tokens oauth2.TokenSource, opts AuthKeyOptions) *AuthKeyMinter {
+	client := cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &AuthKeyMinter{
+		tokens:  tokens,
+		baseURL: cfg.baseURL(),
+		client:  client,
+		opts:    opts,
+	}
+}
+
+// AuthKey creates a new auth key.
+func (m *AuthKeyMinter) AuthKey(ctx context.Context) (string, error) {
+	if err := m.opts.Validate(); err != nil {
+		return "", err
+	}
+	token, err := m.tokens.Token()
+	if err != nil {
+		return "", err
+	}
+
+	reqBody := AuthKeyRequest{
+		Capabilities: AuthKeyCapabilities{
+			Devices: DeviceCapabilities{
+				Create: DeviceCreateCapabilities{
+					Reusable:      m.opts.Reusable,
+					Ephemeral:     m.opts.Ephemeral,
+					Preauthorized: m.opts.Preauthorized,
+					Tags:          m.opts.Tags,
+				},
+			},
+		},
+		ExpirySeconds: int(m.opts.Expiry.Seconds()),
+		Description:   m.opts.Description,
+	}
+
+	buf, err := json.Marshal(&reqBody)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		m.baseURL+"/api/v2/tailnet/-/keys",
+		bytes.NewReader(buf),
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token.SetAuthHeader(req)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("create auth key failed: %s: %s", resp.Status, string(body))
+	}
+
+	var out AuthKeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	if out.Key == "" {
+		return "", fmt.Errorf("empty key in create auth key response")
+	}
+	return out.Key, nil
+}
+
+// Validate checks opts before any API call is made.
+func (o AuthKeyOptions) Validate() error {
+	if len(o.Tags) == 0 {
+		return errors.New("at least one tag is required")
+	}
+	for _, tag := range o.Tags {
+		if !strings.HasPrefix(tag, "tag:") || len(tag) == len("tag:") {
+			return fmt.Errorf("invalid tag %q: tags must look like tag:name", tag)
+		}
+	}
+	if o.Expiry < 0 {
+		return fmt.Errorf("invalid key expiry %s", o.Expiry)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package wif
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtExpiryLeeway is how long a JWT must still be valid for to be
+// exchanged, leaving time for the request to reach the API.
+const jwtExpiryLeeway = 30 * time.Second
+
+// ValidateJWT checks that jwt is a well formed JWT that does not expire
+// within a short leeway of now. The signature is not checked; that is up to
+// Tailscale when the token is exchanged.
+func ValidateJWT(jwt string, now time.Time) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed JWT: want three dot separated parts")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return fmt.Errorf("malformed JWT payload: %w", err)
+	}
+	var claims struct {
+		Exp *json.Number `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("malformed JWT claims: %w", err)
+	}
+	if claims.Exp == nil {
+		return errors.New("JWT has no exp claim")
+	}
+	exp, err := claims.Exp.Float64()
+	if err != nil {
+		return fmt.Errorf("invalid JWT exp claim: %w", err)
+	}
+	expiry := time.Unix(int64(exp), 0)
+	if !now.Add(jwtExpiryLeeway).Before(expiry) {
+		return fmt.Errorf("JWT expired at %s", expiry.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// FileJWT reads the JWT from a file. The file is re-read whenever it
+// changes, so rotated tokens (such as projected Kubernetes service account
+// tokens) are picked up without a restart.
+type FileJWT struct {
+	Path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	token   string
+}
+
+// JWT returns the file's current token.
+func (f *FileJWT) JWT(context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return "", fmt.Errorf("read JWT file: %w", err)
+	}
+	if f.token != "" && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.token, nil
+	}
+
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return "", fmt.Errorf("read JWT file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("JWT file %s is empty", f.Path)
+	}
+	f.token, f.modTime, f.size = token, fi.ModTime(), fi.Size()
+	return token, nil
+}
+
+// ExecJWT runs a command and uses its standard output as the JWT.
+type ExecJWT struct {
+	// Command is the program and its arguments.
+	Command []string
+}
+
+// JWT runs the command.
+func (e ExecJWT) JWT(ctx context.Context) (string, error) {
+	if len(e.Command) == 0 {
+		return "", errors.New("no JWT command")
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("JWT command: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", errors.New("JWT command printed nothing")
+	}
+	return token, nil
+}
+
+// GitHubActionsJWT requests an ID token from the GitHub Actions OIDC
+// provider. The workflow needs the id-token: write permission.
+type GitHubActionsJWT struct {
+	// RequestURL and RequestToken are ACTIONS_ID_TOKEN_REQUEST_URL and
+	// ACTIONS_ID_TOKEN_REQUEST_TOKEN from the runner's environment.
+	RequestURL   string
+	RequestToken string
+	// Audience is the aud claim to request. Empty uses GitHub's default.
+	Audience   string
+	HTTPClient *http.Client
+}
+
+// GitHubActionsJWTFromEnv returns a source configured from the runner's
+// environment.
+func GitHubActionsJWTFromEnv(audience string) (*GitHubActionsJWT, error) {
+	g := &GitHubActionsJWT{
+		RequestURL:   os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL"),
+		RequestToken: os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN"),
+		Audience:     audience,
+	}
+	if g.RequestURL == "" || g.RequestToken == "" {
+		return nil, errors.New("ACTIONS_ID_TOKEN_REQUEST_URL and ACTIONS_ID_TOKEN_REQUEST_TOKEN are not set; does the workflow have id-token: write permission?")
+	}
+	return g, nil
+}
+
+// JWT requests a new ID token.
+func (g *GitHubActionsJWT) JWT(ctx context.Context) (string, error) {
+	u, err := withQuery(g.RequestURL, "audience", g.Audience)
+	if err != nil {
+		return "", err
+	}
+	header := http.Header{"Authorization": {"Bearer " + g.RequestToken}}
+	body, err := fetch(ctx, g.HTTPClient, u, header)
+	if err != nil {
+		return "", fmt.Errorf("GitHub Actions ID token: %w", err)
+	}
+	var out struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", fmt.Errorf("GitHub Actions ID token: %w", err)
+	}
+	if out.Value == "" {
+		return "", errors.New("GitHub Actions ID token: empty value in response")
+	}
+	return out.Value, nil
+}
+
+// MetadataJWT fetches an identity token from a cloud metadata endpoint,
+// such as GCP's
+//
+//	http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity
+//
+// with the Metadata-Flavor: Google header, or Azure's IMDS token endpoint
+// with the Metadata: true header and a resource audience parameter.
+type MetadataJWT struct {
+	URL string
+	// Audience is added to the URL as AudienceParam, if set.
+	Audience string
+	// AudienceParam is the query parameter for Audience. Empty means
+	// "audience".
+	AudienceParam string
+	Header        http.Header
+	HTTPClient    *http.Client
+}
+
+// JWT fetches a new token. The response may be the bare token or a JSON
+// object holding it in access_token, id_token, token or value.
+func (m *MetadataJWT) JWT(ctx context.Context) (string, error) {
+	param := m.AudienceParam
+	if param == "" {
+		param = "audience"
+	}
+	u, err := withQuery(m.URL, param, m.Audience)
+	if err != nil {
+		return "", err
+	}
+	body, err := fetch(ctx, m.HTTPClient, u, m.Header)
+	if err != nil {
+		return "", fmt.Errorf("metadata token: %w", err)
+	}
+
+	body = bytes.TrimSpace(body)
+	if !bytes.HasPrefix(body, []byte("{")) {
+		if len(body) == 0 {
+			return "", errors.New("metadata token: empty response")
+		}
+		return string(body), nil
+	}
+	var out map[string]any
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", fmt.Errorf("metadata token: %w", err)
+	}
+	for _, key := range []string{"access_token", "id_token", "token", "value"} {
+		if v, ok := out[key].(string); ok && v != "" {
+			return v, nil
+		}
+	}
+	return "", errors.New("metadata token: no token in response")
+}
+
+// withQuery returns rawURL with key set to value, unless value is empty.
+func withQuery(rawURL, key, value string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid token URL: %w", err)
+	}
+	if value != "" {
+		q := u.Query()
+		q.Set(key, value)
+		u.RawQuery = q.Encode()
+	}
+	return u.String(), nil
+}
+
+func fetch(ctx context.Context, client *http.Client, u string, header http.Header) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
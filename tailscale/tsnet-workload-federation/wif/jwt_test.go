@@ -0,0 +1,195 @@
+package wif
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJWT returns an unsigned JWT that expires at exp.
+func testJWT(t *testing.T, exp time.Time) string {
+	t.Helper()
+	claims, err := json.Marshal(map[string]any{"sub": "workload", "aud": "tailscale", "exp": exp.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"none"}`)) + "." + enc(claims) + "." + enc([]byte("sig"))
+}
+
+// TestValidateJWT tests the exp check made before each exchange.
+func TestValidateJWT(t *testing.T) {
+	now := time.Now()
+	enc := base64.RawURLEncoding.EncodeToString
+
+	tests := []struct {
+		name    string
+		jwt     string
+		wantErr string
+	}{
+		{"valid", testJWT(t, now.Add(time.Hour)), ""},
+		{"expired", testJWT(t, now.Add(-time.Minute)), "expired"},
+		{"expires within leeway", testJWT(t, now.Add(10*time.Second)), "expired"},
+		{"no exp", enc([]byte("{}")) + "." + enc([]byte(`{"sub":"x"}`)) + ".sig", "no exp"},
+		{"not a JWT", "opaque-token", "malformed"},
+		{"bad payload", "a.!!!.c", "malformed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateJWT(tt.jwt, now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestFileJWT tests that a rotated JWT file is picked up.
+func TestFileJWT(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("first-jwt\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	src := &FileJWT{Path: path}
+	token, err := src.JWT(context.Background())
+	if err != nil || token != "first-jwt" {
+		t.Fatalf("Expected first-jwt, got %q (%v)", token, err)
+	}
+
+	os.WriteFile(path, []byte("second-jwt"), 0o600)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	token, err = src.JWT(context.Background())
+	if err != nil || token != "second-jwt" {
+		t.Errorf("Expected second-jwt after rotation, got %q (%v)", token, err)
+	}
+
+	os.WriteFile(path, nil, 0o600)
+	os.Chtimes(path, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	if _, err := src.JWT(context.Background()); err == nil {
+		t.Error("Expected error for empty JWT file, got nil")
+	}
+}
+
+// TestExecJWT tests reading the JWT from a command's output.
+func TestExecJWT(t *testing.T) {
+	ctx := context.Background()
+	jwt, err := ExecJWT{Command: []string{"sh", "-c", "echo exec-jwt"}}.JWT(ctx)
+	if err != nil || jwt != "exec-jwt" {
+		t.Errorf("Expected exec-jwt, got %q (%v)", jwt, err)
+	}
+
+	if _, err := (ExecJWT{Command: []string{"sh", "-c", "echo boom >&2; exit 1"}}).JWT(ctx); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Expected error with stderr, got %v", err)
+	}
+	if _, err := (ExecJWT{Command: []string{"true"}}).JWT(ctx); err == nil {
+		t.Error("Expected error for empty output, got nil")
+	}
+	if _, err := (ExecJWT{}).JWT(ctx); err == nil {
+		t.Error("Expected error for no command, got nil")
+	}
+}
+
+// TestGitHubActionsJWT tests requesting an ID token from a stand-in for the
+// GitHub Actions OIDC provider.
+func TestGitHubActionsJWT(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer request-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("api-version") != "2.0" {
+			t.Errorf("Expected the runner's query to be kept, got %s", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"value": "gha-jwt-for-" + r.URL.Query().Get("audience")})
+	}))
+	defer server.Close()
+
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", server.URL+"/token?api-version=2.0")
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "request-token")
+	src, err := GitHubActionsJWTFromEnv("api.tailscale.com")
+	if err != nil {
+		t.Fatalf("GitHubActionsJWTFromEnv failed: %v", err)
+	}
+	jwt, err := src.JWT(context.Background())
+	if err != nil || jwt != "gha-jwt-for-api.tailscale.com" {
+		t.Errorf("Expected gha-jwt-for-api.tailscale.com, got %q (%v)", jwt, err)
+	}
+
+	src.RequestToken = "wrong"
+	if _, err := src.JWT(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected unauthorized error, got %v", err)
+	}
+
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "")
+	if _, err := GitHubActionsJWTFromEnv(""); err == nil {
+		t.Error("Expected error outside GitHub Actions, got nil")
+	}
+}
+
+// TestMetadataJWT tests fetching tokens from stand-ins for GCP and Azure
+// style metadata endpoints.
+func TestMetadataJWT(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gcp/identity":
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				http.Error(w, "missing header", http.StatusForbidden)
+				return
+			}
+			io.WriteString(w, "gcp-jwt-for-"+r.URL.Query().Get("audience")+"\n")
+		case "/azure/token":
+			if r.Header.Get("Metadata") != "true" {
+				http.Error(w, "missing header", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "azure-jwt-for-" + r.URL.Query().Get("resource"), "token_type": "Bearer"})
+		case "/empty":
+			io.WriteString(w, "{}")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		src     *MetadataJWT
+		want    string
+		wantErr bool
+	}{
+		{"gcp", &MetadataJWT{URL: server.URL + "/gcp/identity", Audience: "tailscale", Header: http.Header{"Metadata-Flavor": {"Google"}}}, "gcp-jwt-for-tailscale", false},
+		{"gcp missing header", &MetadataJWT{URL: server.URL + "/gcp/identity", Audience: "tailscale"}, "", true},
+		{"azure", &MetadataJWT{URL: server.URL + "/azure/token?api-version=2018-02-01", Audience: "api://tailscale", AudienceParam: "resource", Header: http.Header{"Metadata": {"true"}}}, "azure-jwt-for-api://tailscale", false},
+		{"no token", &MetadataJWT{URL: server.URL + "/empty"}, "", true},
+		{"not found", &MetadataJWT{URL: server.URL + "/missing"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwt, err := tt.src.JWT(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("JWT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if jwt != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, jwt)
+			}
+		})
+	}
+}
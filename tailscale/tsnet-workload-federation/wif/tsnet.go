@@ -0,0 +1,196 @@
+package wif
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+)
+
+// reauthRetryInterval is how long to wait before retrying a failed
+// reauthentication or a lost IPN bus watch.
+const reauthRetryInterval = 30 * time.Second
+
+// AuthKeySource mints auth keys on demand. *AuthKeyMinter implements it.
+type AuthKeySource interface {
+	AuthKey(ctx context.Context) (string, error)
+}
+
+// Up brings s up, fetching its AuthKey from keys only if the node has no
+// saved login, and keeps it logged in until ctx is done: whenever control
+// asks the node to log in again, for example because its key expired, a
+// new key is minted and login restarted with it.
+func Up(ctx context.Context, s *tsnet.Server, keys AuthKeySource) (*ipnstate.Status, error) {
+	if needsAuthKey(s) {
+		authKey, err := keys.AuthKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.AuthKey = authKey
+	}
+
+	lc, err := s.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	// tsnet passes through NeedsLogin while it logs in with an auth key,
+	// so a node given one is only reauthenticated once it has been
+	// Running. A node resuming a saved login that has lapsed never gets
+	// that far, and is reauthenticated straight away.
+	go keepLoggedIn(ctx, localClient{lc}, keys, s.AuthKey == "", userLogf(s))
+
+	return s.Up(ctx)
+}
+
+// VerifyTags checks that the node in st carries exactly the tags in want.
+// Control drops tags that the identity is not allowed to apply, so this
+// catches a policy that does not match the requested tags.
+func VerifyTags(st *ipnstate.Status, want []string) error {
+	if st == nil || st.Self == nil {
+		return errors.New("no self status")
+	}
+	var got []string
+	if st.Self.Tags != nil {
+		got = st.Self.Tags.AsSlice()
+	}
+	got, want = slices.Sorted(slices.Values(got)), slices.Sorted(slices.Values(want))
+	if !slices.Equal(got, want) {
+		return fmt.Errorf("node has tags [%s], want [%s]", strings.Join(got, ", "), strings.Join(want, ", "))
+	}
+	return nil
+}
+
+// needsAuthKey reports whether s should be given an auth key before it
+// starts. A node with saved state in its Dir is already logged in; if its
+// login has since lapsed, keepLoggedIn supplies a key instead.
+func needsAuthKey(s *tsnet.Server) bool {
+	if s.AuthKey != "" || s.Store != nil {
+		return false
+	}
+	if s.Dir == "" {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(s.Dir, "tailscaled.state"))
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+func userLogf(s *tsnet.Server) func(string, ...any) {
+	if s.UserLogf != nil {
+		return s.UserLogf
+	}
+	return log.Printf
+}
+
+// ipnBusWatcher is the part of *tailscale.IPNBusWatcher that
+// watchNeedsLogin uses.
+type ipnBusWatcher interface {
+	Next() (ipn.Notify, error)
+	Close() error
+}
+
+// loginClient is the part of the LocalClient that keepLoggedIn uses.
+type loginClient interface {
+	WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (ipnBusWatcher, error)
+	Start(ctx context.Context, opts ipn.Options) error
+}
+
+// localClient adapts a LocalClient to loginClient.
+type localClient struct {
+	*tailscale.LocalClient
+}
+
+func (c localClient) WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (ipnBusWatcher, error) {
+	w, err := c.LocalClient.WatchIPNBus(ctx, mask)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// keepLoggedIn watches the IPN bus and reauthenticates whenever the node
+// needs to log in again. Until the node is first Running, NeedsLogin is
+// only acted on if loggedIn is set, meaning the node started from a saved
+// login rather than with an auth key.
+func keepLoggedIn(ctx context.Context, lc loginClient, keys AuthKeySource, loggedIn bool, logf func(string, ...any)) {
+	for {
+		err := watchNeedsLogin(ctx, lc, keys, loggedIn, logf)
+		if ctx.Err() != nil {
+			return
+		}
+		logf("wif: IPN bus watch ended: %v; retrying in %s", err, reauthRetryInterval)
+		if !sleepCtx(ctx, reauthRetryInterval) {
+			return
+		}
+	}
+}
+
+// watchNeedsLogin reauthenticates on each NeedsLogin that follows Running,
+// or that comes first if armed is set. Any other NeedsLogin is part of a
+// login already under way, including one started by reauth.
+func watchNeedsLogin(ctx context.Context, lc loginClient, keys AuthKeySource, armed bool, logf func(string, ...any)) error {
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialState|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return err
+		}
+		if n.State == nil {
+			continue
+		}
+		if *n.State == ipn.Running {
+			armed = true
+		}
+		if *n.State != ipn.NeedsLogin || !armed {
+			continue
+		}
+		armed = false
+
+		logf("wif: node needs login, reauthenticating with a new auth key")
+		for {
+			err := reauth(ctx, lc, keys)
+			if err == nil {
+				break
+			}
+			logf("wif: reauthenticating: %v; retrying in %s", err, reauthRetryInterval)
+			if !sleepCtx(ctx, reauthRetryInterval) {
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+func reauth(ctx context.Context, lc loginClient, keys AuthKeySource) error {
+	authKey, err := keys.AuthKey(ctx)
+	if err != nil {
+		return fmt.Errorf("minting auth key: %w", err)
+	}
+	return lc.Start(ctx, ipn.Options{AuthKey: authKey})
+}
+
+// sleepCtx waits for d and reports whether ctx is still live.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,154 @@
+package wif
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+// fakeLoginClient serves notifications sent on notes over its IPN bus and
+// records calls to Start.
+type fakeLoginClient struct {
+	notes chan ipn.Notify
+
+	mu     sync.Mutex
+	starts []ipn.Options
+}
+
+func (c *fakeLoginClient) WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (ipnBusWatcher, error) {
+	return &fakeWatcher{ctx: ctx, notes: c.notes}, nil
+}
+
+func (c *fakeLoginClient) Start(ctx context.Context, opts ipn.Options) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.starts = append(c.starts, opts)
+	return nil
+}
+
+func (c *fakeLoginClient) getStarts() []ipn.Options {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]ipn.Options(nil), c.starts...)
+}
+
+// send delivers a notification for each state. Once it returns, all but
+// the last have been handled.
+func (c *fakeLoginClient) send(states ...ipn.State) {
+	for _, st := range states {
+		c.notes <- ipn.Notify{State: &st}
+	}
+}
+
+// sync waits until every notification sent so far has been handled.
+func (c *fakeLoginClient) sync() {
+	c.notes <- ipn.Notify{}
+}
+
+type fakeWatcher struct {
+	ctx   context.Context
+	notes chan ipn.Notify
+}
+
+func (w *fakeWatcher) Next() (ipn.Notify, error) {
+	select {
+	case n := <-w.notes:
+		return n, nil
+	case <-w.ctx.Done():
+		return ipn.Notify{}, w.ctx.Err()
+	}
+}
+
+func (w *fakeWatcher) Close() error { return nil }
+
+// countingKeys mints numbered auth keys.
+type countingKeys struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (k *countingKeys) AuthKey(ctx context.Context) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.n++
+	return fmt.Sprintf("tskey-auth-%d", k.n), nil
+}
+
+func (k *countingKeys) count() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.n
+}
+
+func startKeepLoggedIn(t *testing.T, loggedIn bool) (*fakeLoginClient, *countingKeys) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	lc := &fakeLoginClient{notes: make(chan ipn.Notify)}
+	keys := &countingKeys{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		keepLoggedIn(ctx, lc, keys, loggedIn, t.Logf)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return lc, keys
+}
+
+// TestKeepLoggedIn tests that a node given an auth key is reauthenticated
+// only when its login lapses after it has been Running.
+func TestKeepLoggedIn(t *testing.T) {
+	lc, keys := startKeepLoggedIn(t, false)
+	check := func(wantKeys int) {
+		t.Helper()
+		lc.sync()
+		if got := keys.count(); got != wantKeys {
+			t.Errorf("Expected %d keys minted, got %d", wantKeys, got)
+		}
+		if got := len(lc.getStarts()); got != wantKeys {
+			t.Errorf("Expected Start to be called %d times, got %d", wantKeys, got)
+		}
+	}
+
+	// The first login passes through NeedsLogin on its way to Running.
+	lc.send(ipn.NoState, ipn.NeedsLogin, ipn.Starting, ipn.Running)
+	check(0)
+
+	// Nothing happens while the node stays Running.
+	lc.send(ipn.Running, ipn.Running)
+	check(0)
+
+	// A lapsed login is reauthenticated once, with a new key.
+	lc.send(ipn.NeedsLogin)
+	check(1)
+	if got := lc.getStarts()[0].AuthKey; got != "tskey-auth-1" {
+		t.Errorf("Expected Start with the minted key, got %q", got)
+	}
+
+	// The NeedsLogin of that login is not taken as another lapse.
+	lc.send(ipn.NeedsLogin, ipn.Starting, ipn.Running)
+	check(1)
+
+	lc.send(ipn.NeedsLogin)
+	check(2)
+}
+
+// TestKeepLoggedIn_SavedLogin tests that a node resuming a lapsed saved
+// login is reauthenticated without first being Running.
+func TestKeepLoggedIn_SavedLogin(t *testing.T) {
+	lc, keys := startKeepLoggedIn(t, true)
+
+	lc.send(ipn.NoState, ipn.NeedsLogin, ipn.NeedsLogin)
+	lc.sync()
+	if got := keys.count(); got != 1 {
+		t.Errorf("Expected 1 key minted, got %d", got)
+	}
+	if starts := lc.getStarts(); len(starts) != 1 || starts[0].AuthKey != "tskey-auth-1" {
+		t.Errorf("Expected one Start with the minted key, got %+v", starts)
+	}
+}
@@ -0,0 +1,39 @@
+package wif
+
+// OAuthTokenResponse represents the response from the WIF token-exchange endpoint.
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// AuthKeyRequest represents the payload to create a Tailscale auth key.
+type AuthKeyRequest struct {
+	Capabilities  AuthKeyCapabilities `json:"capabilities"`
+	ExpirySeconds int                 `json:"expirySeconds,omitempty"`
+	Description   string              `json:"description,omitempty"`
+}
+
+// AuthKeyCapabilities defines the capabilities for the auth key.
+type AuthKeyCapabilities struct {
+	Devices DeviceCapabilities `json:"devices"`
+}
+
+// DeviceCapabilities defines device-specific capabilities.
+type DeviceCapabilities struct {
+	Create DeviceCreateCapabilities `json:"create"`
+}
+
+// DeviceCreateCapabilities defines capabilities for creating devices.
+type DeviceCreateCapabilities struct {
+	Reusable      bool     `json:"reusable"`
+	Ephemeral     bool     `json:"ephemeral"`
+	Preauthorized bool     `json:"preauthorized"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+// AuthKeyResponse represents the response from creating an auth key.
+type AuthKeyResponse struct {
+	Key string `json:"key"`
+	ID  string `json:"id,omitempty"`
+}
@@ -0,0 +1,111 @@
+// Package wif authenticates to Tailscale with workload identity federation.
+//
+// A JWT from an identity provider is exchanged for a short-lived Tailscale
+// access token, which in turn is used to mint auth keys for new nodes. The
+// package also brings up a tsnet.Server with those keys, minting one only
+// when the node actually needs to log in.
+package wif
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// DefaultBaseURL is the Tailscale API used when no base URL is given.
+const DefaultBaseURL = "https://api.tailscale.com"
+
+// JWTSource supplies the identity provider JWT to exchange. It is asked for
+// a token every time a new access token is needed, so it may rotate, and
+// the token's exp is checked before each exchange.
+type JWTSource interface {
+	JWT(ctx context.Context) (string, error)
+}
+
+// StaticJWT is a JWTSource that always returns the same token.
+type StaticJWT string
+
+// JWT returns the token.
+func (s StaticJWT) JWT(context.Context) (string, error) {
+	if s == "" {
+		return "", errors.New("empty JWT")
+	}
+	return string(s), nil
+}
+
+// Config describes a workload identity federation client.
+type Config struct {
+	// ClientID is the ID of the federated identity in Tailscale.
+	ClientID string
+	// JWT supplies the token to exchange.
+	JWT JWTSource
+	// BaseURL is the Tailscale API to use. Empty means DefaultBaseURL.
+	BaseURL string
+	// HTTPClient is used for API requests. Nil means http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+func (c Config) baseURL() string {
+	if c.BaseURL == "" {
+		return DefaultBaseURL
+	}
+	return strings.TrimSuffix(c.BaseURL, "/")
+}
+
+func (c Config) context(ctx context.Context) context.Context {
+	if c.HTTPClient == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, c.HTTPClient)
+}
+
+// TokenSource returns a source of Tailscale access tokens. Tokens are reused
+// until they expire, and each renewal exchanges a freshly fetched JWT.
+func TokenSource(ctx context.Context, cfg Config) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &exchangeSource{ctx: ctx, cfg: cfg})
+}
+
+type exchangeSource struct {
+	ctx context.Context
+	cfg Config
+}
+
+func (s *exchangeSource) Token() (*oauth2.Token, error) {
+	jwt, err := s.cfg.JWT.JWT(s.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get JWT: %w", err)
+	}
+	if err := ValidateJWT(jwt, time.Now()); err != nil {
+		return nil, err
+	}
+	return exchange(s.cfg.context(s.ctx), s.cfg.baseURL(), s.cfg.ClientID, jwt)
+}
+
+// exchange trades jwt for a Tailscale access token.
+func exchange(ctx context.Context, baseURL, clientID, jwt string) (*oauth2.Token, error) {
+	config := clientcredentials.Config{
+		ClientID: clientID,
+		TokenURL: baseURL + "/api/v2/oauth/token-exchange",
+		EndpointParams: url.Values{
+			"jwt": {jwt},
+		},
+	}
+
+	token, err := config.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange failed: %w", err)
+	}
+
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("no access token in response")
+	}
+
+	return token, nil
+}
@@ -3,9 +3,9 @@ module github.com/jaxxstorm/tailscale-examples/tailscale/whitelabel-sshgateway
 go 1.24.7
 
 require (
-	tailscale.com v1.78.3
-	golang.org/x/crypto v0.31.0
 	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.31.0
+	tailscale.com v1.78.3
 )
 
 require (
@@ -75,7 +75,6 @@ require (
 	github.com/x448/float16 v0.8.4 // indirect
 	go4.org/mem v0.0.0-20220726221520-4f986261bf13 // indirect
 	go4.org/netipx v0.0.0-20231129151722-fdeea329fbba // indirect
-	golang.org/x/crypto v0.31.0 // indirect
 	golang.org/x/exp v0.0.0-20240119083558-1b970713d09a // indirect
 	golang.org/x/mod v0.19.0 // indirect
 	golang.org/x/net v0.27.0 // indirect